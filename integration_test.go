@@ -36,14 +36,6 @@ func TestIntegration(t *testing.T) {
 	err = fileOps.CopyTestFiles(testDataSource, tmpDir)
 	require.NoError(t, err)
 
-	// Save current directory
-	originalDir, _ := os.Getwd()
-	defer os.Chdir(originalDir)
-
-	// Change to test directory
-	err = fileOps.ChangeToWorkDir()
-	require.NoError(t, err)
-
 	// Load config
 	cfg, err := config.LoadConfig()
 	require.NoError(t, err)
@@ -63,7 +55,7 @@ func TestIntegration(t *testing.T) {
 		assert.Equal(t, 3, result.FilesMerged, "Expected 3 files merged for group %s", result.Group.Prefix)
 
 		// Check output file exists
-		outputPath := filepath.Join(tmpDir, result.OutputFile)
+		outputPath := result.OutputFile
 		_, err := os.Stat(outputPath)
 		assert.NoError(t, err, "Output file %s should exist", result.OutputFile)
 
@@ -76,12 +68,18 @@ func TestIntegration(t *testing.T) {
 		contentStr := string(content)
 		lines := strings.Split(strings.TrimSpace(contentStr), "\n")
 
-		// Should have 9 lines (3 files × 3 lines each, minus headers)
-		assert.Len(t, lines, 9, "Expected 9 lines in output file %s", result.OutputFile)
+		// Should have 10 lines (common header + 3 files × 3 data lines each)
+		assert.Len(t, lines, 10, "Expected 10 lines in output file %s", result.OutputFile)
+		assert.True(t, strings.HasPrefix(lines[0], "Date,Ad Unit,"), "Expected header line in %s", result.OutputFile)
 
 		// Check chronological order
-		assert.True(t, strings.HasPrefix(lines[0], "2025-01-01"), "Expected first line to start with 2025-01-01 in %s", result.OutputFile)
-		assert.True(t, strings.HasPrefix(lines[8], "2025-01-03"), "Expected last line to start with 2025-01-03 in %s", result.OutputFile)
+		assert.True(t, strings.HasPrefix(lines[1], "2025-01-01"), "Expected first data line to start with 2025-01-01 in %s", result.OutputFile)
+		assert.True(t, strings.HasPrefix(lines[9], "2025-01-03"), "Expected last line to start with 2025-01-03 in %s", result.OutputFile)
+
+		// Check output matches the expected file
+		expected, err := os.ReadFile(filepath.Join(wd, "testdata", "expected", filepath.Base(result.OutputFile)))
+		require.NoError(t, err)
+		assert.Equal(t, strings.TrimSpace(string(expected)), strings.TrimSpace(contentStr), "Unexpected content in %s", result.OutputFile)
 	}
 
 	// Verify source files were deleted
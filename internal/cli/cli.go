@@ -0,0 +1,416 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/spossner/ad-reporting-merger/internal/config"
+	"github.com/spossner/ad-reporting-merger/internal/filesystem"
+	"github.com/spossner/ad-reporting-merger/internal/processor"
+)
+
+const usage = `Usage: ad-reporting-merger [command] [flags]
+
+Commands:
+  merge    merge the files of every group into its output (default)
+  plan     show what merge would do without touching any file (alias: dry-run)
+  list     show the files matching each group and their detected dates
+  verify   check existing outputs against the source files still present
+  history  show the files merged into each output by earlier runs
+
+Flags:
+  --config path     configuration file (overrides the lookup chain)
+  --work-dir dir    directory to process (overrides work_dir)
+  --group name      only process the group with this prefix or output; repeatable
+  --dry-run         make merge behave like plan
+  --file name       only show history of files whose name contains name
+`
+
+// Exit codes returned by Run.
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+type command func(env *environment) int
+
+var commands = map[string]command{
+	"merge":   runMerge,
+	"plan":    runPlan,
+	"dry-run": runPlan,
+	"list":    runList,
+	"verify":  runVerify,
+	"history": runHistory,
+}
+
+// groupFilter collects repeated --group flags.
+type groupFilter []string
+
+func (g *groupFilter) String() string {
+	return strings.Join(*g, ",")
+}
+
+func (g *groupFilter) Set(value string) error {
+	*g = append(*g, value)
+	return nil
+}
+
+type environment struct {
+	stdout  io.Writer
+	stderr  io.Writer
+	groups  []config.Group
+	outputs []string // of all configured groups, also those not selected
+	fileOps *filesystem.FileOperations
+	dryRun  bool
+	file    string
+}
+
+func (env *environment) processor(opts ...processor.Option) *processor.Processor {
+	return processor.NewProcessor(env.fileOps, append([]processor.Option{processor.WithOutputs(env.outputs...)}, opts...)...)
+}
+
+// rel shortens a path in the work dir for display.
+func (env *environment) rel(path string) string {
+	if rel, err := filepath.Rel(env.fileOps.WorkDir(), path); err == nil && filepath.IsLocal(rel) {
+		return rel
+	}
+	return path
+}
+
+func (env *environment) rels(paths []string) []string {
+	rels := make([]string, len(paths))
+	for i, path := range paths {
+		rels[i] = env.rel(path)
+	}
+	return rels
+}
+
+// Run executes the command line and returns the process exit code.
+func Run(args []string, stdout, stderr io.Writer) int {
+	name := "merge"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		fmt.Fprint(stdout, usage)
+		return exitOK
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", name, usage)
+		return exitUsage
+	}
+
+	var (
+		configPath string
+		workDir    string
+		filter     groupFilter
+		dryRun     bool
+		file       string
+	)
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, usage) }
+	flags.StringVar(&configPath, "config", "", "configuration file")
+	flags.StringVar(&workDir, "work-dir", "", "directory to process")
+	flags.Var(&filter, "group", "group prefix or output to process")
+	flags.BoolVar(&dryRun, "dry-run", false, "compute results without touching any file")
+	flags.StringVar(&file, "file", "", "file name to show the history of")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if flags.NArg() > 0 {
+		fmt.Fprintf(stderr, "unexpected arguments: %s\n\n%s", strings.Join(flags.Args(), " "), usage)
+		return exitUsage
+	}
+
+	cfg, source, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to load configuration: %v\n", err)
+		return exitError
+	}
+	fmt.Fprintf(stdout, "Using configuration: %s\n", source)
+
+	if workDir != "" {
+		cfg.WorkDir = workDir
+	}
+	groups, err := selectGroups(cfg.GetGroups(), filter)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n", err)
+		return exitUsage
+	}
+
+	fileOps, err := filesystem.NewFileOperations(cfg.GetWorkDir())
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to initialize file operations: %v\n", err)
+		return exitError
+	}
+	var outputs []string
+	for _, group := range cfg.GetGroups() {
+		outputs = append(outputs, group.Output)
+	}
+
+	return cmd(&environment{
+		stdout:  stdout,
+		stderr:  stderr,
+		groups:  groups,
+		outputs: outputs,
+		fileOps: fileOps,
+		dryRun:  dryRun,
+		file:    file,
+	})
+}
+
+// selectGroups keeps the groups whose prefix or output matches one of the
+// filters, once each and in config order. Every filter has to match at least
+// one group.
+func selectGroups(groups []config.Group, filter groupFilter) ([]config.Group, error) {
+	if len(filter) == 0 {
+		return groups, nil
+	}
+	matched := make([]bool, len(groups))
+	for _, name := range filter {
+		found := false
+		for i, group := range groups {
+			if group.Name() == name || group.Output == name {
+				matched[i] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no group matches %q", name)
+		}
+	}
+	var selected []config.Group
+	for i, group := range groups {
+		if matched[i] {
+			selected = append(selected, group)
+		}
+	}
+	return selected, nil
+}
+
+func runMerge(env *environment) int {
+	if env.dryRun {
+		return runPlan(env)
+	}
+	proc := env.processor()
+	recovered, err := proc.Recover()
+	for _, state := range recovered {
+		fmt.Fprintf(env.stdout, "Recovered interrupted run for %s (started %s)\n",
+			env.rel(state.Output), state.Started.Format("2006-01-02 15:04:05"))
+	}
+	if err != nil {
+		fmt.Fprintf(env.stderr, "Failed to recover interrupted run: %v\n", err)
+		return exitError
+	}
+
+	code := exitOK
+	for _, result := range proc.ProcessAllGroups(env.groups) {
+		fmt.Fprintf(env.stdout, "Processing group: %s\n", result.Group.Name())
+		if result.Error != nil {
+			fmt.Fprintf(env.stdout, "Error: %v\n", result.Error)
+			env.printInProgress(result)
+			env.printDuplicates(result)
+			code = exitError
+			continue
+		}
+		for _, date := range result.DatesFound {
+			fmt.Fprintf(env.stdout, "  %s\n", date)
+		}
+		printWarnings(env.stdout, result)
+		env.printInProgress(result)
+		env.printDuplicates(result)
+		env.printRestated(result)
+		env.printSkippedLines(result)
+		printDedupe(env.stdout, result)
+		printAppend(env.stdout, result)
+		for i, file := range result.Disposed {
+			if i < len(result.DisposedTo) {
+				fmt.Fprintf(env.stdout, "  moved %s -> %s\n", env.rel(file), env.rel(result.DisposedTo[i]))
+			}
+		}
+		fmt.Fprintf(env.stdout, "Merged group: %s -> %s (Duration: %v)\n",
+			result.Group.Name(), env.rel(result.OutputFile), result.Duration)
+	}
+	return code
+}
+
+func runPlan(env *environment) int {
+	code := exitOK
+	for _, result := range env.processor(processor.WithDryRun()).ProcessAllGroups(env.groups) {
+		fmt.Fprintf(env.stdout, "Group: %s -> %s\n", result.Group.Name(), env.rel(result.OutputFile))
+		if result.Error != nil {
+			fmt.Fprintf(env.stdout, "  Error: %v\n", result.Error)
+			env.printInProgress(result)
+			env.printDuplicates(result)
+			code = exitError
+			continue
+		}
+		fmt.Fprintf(env.stdout, "  Merge order (%d files, %d rows):\n", result.FilesMerged, result.RowsMerged)
+		for i, file := range result.Files {
+			fmt.Fprintf(env.stdout, "    %d. %s (%s, %d rows)\n", i+1, env.rel(file), result.DatesFound[i], result.RowsPerFile[i])
+		}
+		printWarnings(env.stdout, result)
+		env.printInProgress(result)
+		env.printDuplicates(result)
+		env.printRestated(result)
+		env.printSkippedLines(result)
+		printDedupe(env.stdout, result)
+		printAppend(env.stdout, result)
+		if len(result.Disposed) > 0 {
+			fmt.Fprintf(env.stdout, "  Would %s:\n", result.Disposal)
+		}
+		for _, file := range result.Disposed {
+			fmt.Fprintf(env.stdout, "    %s\n", env.rel(file))
+		}
+	}
+	return code
+}
+
+func printWarnings(w io.Writer, result *processor.ProcessingResult) {
+	for _, warning := range result.Warnings {
+		fmt.Fprintf(w, "  Warning: %s\n", warning)
+	}
+}
+
+func (env *environment) printInProgress(result *processor.ProcessingResult) {
+	for _, file := range result.InProgress {
+		fmt.Fprintf(env.stdout, "  Skipped in-progress file %s: %s\n", env.rel(file.File), file.Reason)
+	}
+}
+
+func (env *environment) printDuplicates(result *processor.ProcessingResult) {
+	for _, cluster := range result.Duplicates {
+		fmt.Fprintf(env.stdout, "  Identical files: %s\n", strings.Join(env.rels(cluster), ", "))
+	}
+	for _, m := range result.AlreadyMerged {
+		fmt.Fprintf(env.stdout, "  Already merged: %s (as %s, run %s)\n", env.rel(m.File), env.rel(m.Entry.File), m.Entry.RunID)
+	}
+	for i, file := range result.Skipped {
+		if i < len(result.SkippedTo) {
+			fmt.Fprintf(env.stdout, "  Moved duplicate %s -> %s\n", env.rel(file), env.rel(result.SkippedTo[i]))
+		} else {
+			fmt.Fprintf(env.stdout, "  Skipped duplicate %s\n", env.rel(file))
+		}
+	}
+}
+
+func (env *environment) printRestated(result *processor.ProcessingResult) {
+	for _, r := range result.Restated {
+		fmt.Fprintf(env.stdout, "  Restated %s: kept %s, dropped %s\n", r.Date, env.rel(r.Kept), strings.Join(env.rels(r.Dropped), ", "))
+	}
+}
+
+func (env *environment) printSkippedLines(result *processor.ProcessingResult) {
+	for _, s := range result.SkippedLines {
+		fmt.Fprintf(env.stdout, "  Skipped %d preamble and %d footer lines of %s\n", s.Preamble, s.Footer, env.rel(s.File))
+	}
+}
+
+func printDedupe(w io.Writer, result *processor.ProcessingResult) {
+	if result.DuplicateRows > 0 {
+		fmt.Fprintf(w, "  Dropped %d duplicate rows\n", result.DuplicateRows)
+	}
+	if result.ConflictRows > 0 {
+		fmt.Fprintf(w, "  Dropped %d conflicting rows\n", result.ConflictRows)
+	}
+}
+
+func printAppend(w io.Writer, result *processor.ProcessingResult) {
+	if result.ExistingRows == 0 {
+		return
+	}
+	fmt.Fprintf(w, "  Appended to %d existing rows\n", result.ExistingRows)
+	if len(result.ReplacedDates) > 0 {
+		fmt.Fprintf(w, "  Replaced %d rows for %s\n", result.ReplacedRows, strings.Join(result.ReplacedDates, ", "))
+	}
+}
+
+func runList(env *environment) int {
+	code := exitOK
+	for _, group := range env.groups {
+		fmt.Fprintf(env.stdout, "Group: %s\n", group.Name())
+		files, err := env.processor().ListFiles(group)
+		if err != nil {
+			fmt.Fprintf(env.stdout, "  Error: %v\n", err)
+			code = exitError
+			continue
+		}
+		if len(files) == 0 {
+			fmt.Fprintln(env.stdout, "  (no files)")
+		}
+		for _, fd := range files {
+			date := fd.Date
+			if fd.Err != nil {
+				date = "invalid"
+				code = exitError
+			} else if date == "" {
+				date = "no date"
+			}
+			fmt.Fprintf(env.stdout, "  %s  %s\n", date, env.rel(fd.File))
+			if fd.Err != nil {
+				fmt.Fprintf(env.stdout, "    Error: %v\n", fd.Err)
+			}
+		}
+	}
+	return code
+}
+
+func runVerify(env *environment) int {
+	code := exitOK
+	for _, group := range env.groups {
+		result := env.processor().VerifyGroup(group)
+		fmt.Fprintf(env.stdout, "Output: %s\n", env.rel(result.OutputFile))
+		if result.Error != nil {
+			fmt.Fprintf(env.stdout, "  Error: %v\n", result.Error)
+			code = exitError
+			continue
+		}
+		v := result.Verification
+		fmt.Fprintf(env.stdout, "  %d rows, %d source files checked\n", v.OutputRows, len(result.Sources))
+		for _, line := range v.Unsorted {
+			fmt.Fprintf(env.stdout, "  line %d is out of chronological order\n", line)
+		}
+		for _, file := range result.Sources {
+			if missing := v.Missing[file]; missing > 0 {
+				fmt.Fprintf(env.stdout, "  %s: %d rows missing from output\n", env.rel(file), missing)
+			}
+		}
+		if v.OK() {
+			fmt.Fprintln(env.stdout, "  OK")
+		} else {
+			code = exitError
+		}
+	}
+	return code
+}
+
+func runHistory(env *environment) int {
+	code := exitOK
+	for _, group := range env.groups {
+		fmt.Fprintf(env.stdout, "Output: %s\n", group.Output)
+		entries, err := env.processor().History(group, env.file)
+		if err != nil {
+			fmt.Fprintf(env.stdout, "  Error: %v\n", err)
+			code = exitError
+			continue
+		}
+		if len(entries) == 0 {
+			fmt.Fprintln(env.stdout, "  (no files)")
+		}
+		for _, e := range entries {
+			fmt.Fprintf(env.stdout, "  %s  %s..%s  %d rows  %s  (run %s, %s)\n",
+				e.Merged.Format("2006-01-02 15:04"), e.FirstDate, e.LastDate, e.Rows, env.rel(e.File), e.RunID, e.Hash)
+		}
+	}
+	return code
+}
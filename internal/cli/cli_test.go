@@ -0,0 +1,153 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spossner/ad-reporting-merger/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setupWorkDir creates a work dir with two AdManager exports and a config
+// file pointing at it.
+func setupWorkDir(t *testing.T) (workDir, configPath string) {
+	tmpDir, err := os.MkdirTemp("", "cli_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmpDir) })
+
+	workDir = filepath.Join(tmpDir, "work")
+	require.NoError(t, os.Mkdir(workDir, 0755))
+
+	files := map[string]string{
+		"AdManager Reporting_2025-01-02.csv": "Date,Value\n2025-01-02,200\n",
+		"AdManager Reporting_2025-01-01.csv": "Date,Value\n2025-01-01,100\n",
+	}
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(workDir, name), []byte(content), 0644))
+	}
+
+	configPath = filepath.Join(tmpDir, "config.json")
+	cfg := fmt.Sprintf(`{"work_dir": %q, "groups": [
+		{"prefix": "AdManager Reporting", "output": "raw.csv"},
+		{"prefix": "Revenue per AdUnit", "output": "raw-revenue.csv"}
+	]}`, workDir)
+	require.NoError(t, os.WriteFile(configPath, []byte(cfg), 0644))
+
+	return workDir, configPath
+}
+
+func run(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := Run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRun(t *testing.T) {
+	t.Run("unknown command", func(t *testing.T) {
+		code, _, stderr := run("explode")
+		assert.Equal(t, exitUsage, code)
+		assert.Contains(t, stderr, "unknown command")
+	})
+
+	t.Run("unknown group", func(t *testing.T) {
+		_, configPath := setupWorkDir(t)
+		code, _, stderr := run("list", "--config", configPath, "--group", "Nope")
+		assert.Equal(t, exitUsage, code)
+		assert.Contains(t, stderr, `no group matches "Nope"`)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		_, configPath := setupWorkDir(t)
+		code, stdout, _ := run("list", "--config", configPath, "--group", "AdManager Reporting")
+		assert.Equal(t, exitOK, code)
+		assert.Contains(t, stdout, "2025-01-01  AdManager Reporting_2025-01-01.csv")
+		assert.NotContains(t, stdout, "Revenue per AdUnit")
+	})
+
+	t.Run("plan does not touch files", func(t *testing.T) {
+		workDir, configPath := setupWorkDir(t)
+		code, stdout, _ := run("plan", "--config", configPath, "--group", "raw.csv")
+		assert.Equal(t, exitOK, code)
+		assert.Contains(t, stdout, "1. AdManager Reporting_2025-01-01.csv (2025-01-01, 1 rows)")
+		assert.Contains(t, stdout, "2. AdManager Reporting_2025-01-02.csv (2025-01-02, 1 rows)")
+
+		entries, err := os.ReadDir(workDir)
+		require.NoError(t, err)
+		assert.Len(t, entries, 2, "Plan must not create or delete files")
+	})
+
+	t.Run("merge dry run", func(t *testing.T) {
+		workDir, configPath := setupWorkDir(t)
+		code, stdout, _ := run("merge", "--dry-run", "--config", configPath, "--group", "raw.csv")
+		assert.Equal(t, exitOK, code)
+		assert.Contains(t, stdout, "Would delete:")
+
+		entries, err := os.ReadDir(workDir)
+		require.NoError(t, err)
+		assert.Len(t, entries, 2, "Dry run must not create or delete files")
+	})
+
+	t.Run("merge and verify", func(t *testing.T) {
+		workDir, configPath := setupWorkDir(t)
+		code, stdout, _ := run("--config", configPath, "--group", "AdManager Reporting")
+		assert.Equal(t, exitOK, code)
+		assert.Contains(t, stdout, "Merged group: AdManager Reporting -> raw.csv")
+
+		content, err := os.ReadFile(filepath.Join(workDir, "raw.csv"))
+		require.NoError(t, err)
+		assert.Equal(t, "Date,Value\n2025-01-01,100\n2025-01-02,200\n", string(content))
+
+		code, stdout, _ = run("verify", "--config", configPath, "--group", "raw.csv")
+		assert.Equal(t, exitOK, code)
+		assert.Contains(t, stdout, "OK")
+	})
+
+	t.Run("history", func(t *testing.T) {
+		_, configPath := setupWorkDir(t)
+		code, _, _ := run("--config", configPath, "--group", "raw.csv")
+		require.Equal(t, exitOK, code)
+
+		code, stdout, _ := run("history", "--config", configPath, "--group", "raw.csv", "--file", "01-02")
+		assert.Equal(t, exitOK, code)
+		assert.Contains(t, stdout, "2025-01-02..2025-01-02  1 rows  AdManager Reporting_2025-01-02.csv")
+		assert.NotContains(t, stdout, "AdManager Reporting_2025-01-01.csv")
+	})
+
+	t.Run("work dir override", func(t *testing.T) {
+		_, configPath := setupWorkDir(t)
+		otherDir, _ := setupWorkDir(t)
+		require.NoError(t, os.Remove(filepath.Join(otherDir, "AdManager Reporting_2025-01-02.csv")))
+
+		code, stdout, _ := run("list", "--config", configPath, "--work-dir", otherDir, "--group", "raw.csv")
+		assert.Equal(t, exitOK, code)
+		assert.NotContains(t, stdout, "2025-01-02")
+	})
+}
+
+func TestSelectGroups(t *testing.T) {
+	groups := []config.Group{
+		{Prefix: "AdManager Reporting", Output: "raw.csv"},
+		{Prefix: "Revenue per AdUnit", Output: "raw-revenue.csv"},
+	}
+
+	selected, err := selectGroups(groups, nil)
+	require.NoError(t, err)
+	assert.Equal(t, groups, selected)
+
+	selected, err = selectGroups(groups, groupFilter{"raw-revenue.csv"})
+	require.NoError(t, err)
+	assert.Equal(t, groups[1:], selected)
+
+	selected, err = selectGroups(groups, groupFilter{"raw-revenue.csv", "AdManager Reporting", "raw.csv"})
+	require.NoError(t, err)
+	assert.Equal(t, groups, selected, "Groups matched by several filters are selected once, in config order")
+
+	_, err = selectGroups(groups, groupFilter{"missing"})
+	assert.Error(t, err)
+}
@@ -3,14 +3,117 @@ package config
 import (
 	_ "embed"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
 )
 
 //go:embed groups.json
 var groupsJSON []byte
 
+const appName = "ad-reporting-merger"
+
+// Kinds of configuration sources, in lookup order.
+const (
+	SourceFlag     = "flag"
+	SourceXDG      = "xdg"
+	SourceCwd      = "cwd"
+	SourceEmbedded = "embedded"
+)
+
+// Match selects the source files of a group by name. Every condition that is
+// set must hold, as well as the group's prefix if any.
+type Match struct {
+	Glob       string   `json:"glob,omitempty"`       // e.g. "AdManager Reporting_*.csv"
+	Regex      string   `json:"regex,omitempty"`      // a named group "date" dates files without rows
+	Extensions []string `json:"extensions,omitempty"` // e.g. [".csv"]
+	Exclude    []string `json:"exclude,omitempty"`    // glob patterns of names to leave out
+}
+
 type Group struct {
-	Prefix string `json:"prefix"`
-	Output string `json:"output"`
+	Prefix        string   `json:"prefix"`
+	Match         *Match   `json:"match,omitempty"`
+	Output        string   `json:"output"`
+	Disposal      string   `json:"disposal,omitempty"`       // delete (default), archive, trash or keep
+	ArchiveDir    string   `json:"archive_dir,omitempty"`    // defaults to "archive" in the work dir
+	Mode          string   `json:"mode,omitempty"`           // replace (default) or append
+	Overlap       string   `json:"overlap,omitempty"`        // reject (default) or replace dates already in the output
+	Restatement   string   `json:"restatement,omitempty"`    // none (default), mtime or suffix: keep the newest export of a date
+	Header        string   `json:"header,omitempty"`         // strict (default), write or omit the header row
+	Columns       string   `json:"columns,omitempty"`        // positional (default) or union: map columns by header name
+	ColumnOrder   []string `json:"column_order,omitempty"`   // pin the output columns
+	Fill          string   `json:"fill,omitempty"`           // value for columns missing from a file
+	Delimiter     string   `json:"delimiter,omitempty"`      // field delimiter of inputs and output, "," (default), ";", "tab", ...
+	DateColumn    string   `json:"date_column,omitempty"`    // name or 1-based position of the date column, first by default
+	DateLayouts   []string `json:"date_layouts,omitempty"`   // Go time layouts of the dates, "2006-01-02" by default
+	SortKeys      []string `json:"sort_keys,omitempty"`      // columns to sort all rows by, e.g. ["Date", "Ad Unit"]
+	DedupeKeys    []string `json:"dedupe_keys,omitempty"`    // columns identifying a row, e.g. ["Date", "Ad Unit"]
+	Dedupe        string   `json:"dedupe,omitempty"`         // first-wins (default), last-wins or error-on-conflict
+	Duplicates    string   `json:"duplicates,omitempty"`     // abort (default), keep-oldest, keep-newest or move-aside identical files
+	DuplicatesDir string   `json:"duplicates_dir,omitempty"` // defaults to "duplicates" in the work dir
+	StableFor     string   `json:"stable_for,omitempty"`     // how long a file must not change to be merged, e.g. "5s"
+
+	// Character encodings: inputs are detected by byte order mark and as
+	// UTF-8, falling back to the legacy fallback_encoding (windows-1252 by
+	// default); the output is written in output_encoding (utf-8 by default)
+	FallbackEncoding string `json:"fallback_encoding,omitempty"`
+	OutputEncoding   string `json:"output_encoding,omitempty"`
+
+	// Delimiters of the inputs and the output apart, each delimiter by
+	// default; an input_delimiter of "auto" sniffs the delimiter and quote of
+	// every input
+	InputDelimiter  string `json:"input_delimiter,omitempty"`
+	OutputDelimiter string `json:"output_delimiter,omitempty"`
+
+	// Regexps matched against the lines of every file with their fields
+	// joined by commas: lines before the first one matching header_pattern
+	// are skipped as preamble, and the first data row matching
+	// footer_pattern and all after it as footer, e.g. "^Total,"
+	HeaderPattern string `json:"header_pattern,omitempty"`
+	FooterPattern string `json:"footer_pattern,omitempty"`
+
+	// Types of metric columns by name or 1-based position: integer, decimal,
+	// percent or currency. Their values are read as written in number_locale,
+	// e.g. "de-DE" (English by default), and normalised to 1234.56
+	ColumnTypes  map[string]string `json:"column_types,omitempty"`
+	NumberLocale string            `json:"number_locale,omitempty"`
+
+	// Dirs to find the files in, the work dir by default
+	Sources []SourceDir `json:"sources,omitempty"`
+}
+
+// SourceDir is a directory a group finds its files in. In JSON it is either an
+// object or just the path.
+type SourceDir struct {
+	Dir       string `json:"dir"`                 // relative dirs are resolved against the work dir
+	Recursive bool   `json:"recursive,omitempty"` // also search subdirectories
+	MaxDepth  int    `json:"max_depth,omitempty"` // levels of subdirectories searched, unlimited if 0 and recursive
+}
+
+func (d *SourceDir) UnmarshalJSON(data []byte) error {
+	var dir string
+	if err := json.Unmarshal(data, &dir); err == nil {
+		*d = SourceDir{Dir: dir}
+		return nil
+	}
+	type plain SourceDir
+	return json.Unmarshal(data, (*plain)(d))
+}
+
+// Name identifies the group in messages: its prefix, or else its match
+// pattern or output.
+func (g Group) Name() string {
+	switch {
+	case g.Prefix != "":
+		return g.Prefix
+	case g.Match != nil && g.Match.Glob != "":
+		return g.Match.Glob
+	case g.Match != nil && g.Match.Regex != "":
+		return g.Match.Regex
+	}
+	return g.Output
 }
 
 type Config struct {
@@ -18,9 +121,87 @@ type Config struct {
 	WorkDir string  `json:"work_dir"`
 }
 
+// Source describes where a configuration was loaded from.
+type Source struct {
+	Kind string
+	Path string
+}
+
+func (s Source) String() string {
+	if s.Path == "" {
+		return s.Kind
+	}
+	return fmt.Sprintf("%s (%s)", s.Path, s.Kind)
+}
+
+// LoadConfig returns the configuration embedded in the binary.
 func LoadConfig() (*Config, error) {
+	return parse(groupsJSON)
+}
+
+// Load resolves the configuration using the lookup chain: the explicit path
+// (if given), $XDG_CONFIG_HOME/ad-reporting-merger/config.json, ./groups.json
+// and finally the embedded default. An explicit path that cannot be read is
+// an error rather than a reason to fall back.
+func Load(explicitPath string) (*Config, Source, error) {
+	if explicitPath != "" {
+		cfg, err := loadFile(explicitPath)
+		if err != nil {
+			return nil, Source{}, fmt.Errorf("unable to load config %s: %w", explicitPath, err)
+		}
+		return cfg, Source{Kind: SourceFlag, Path: explicitPath}, nil
+	}
+
+	for _, candidate := range candidates() {
+		cfg, err := loadFile(candidate.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, Source{}, fmt.Errorf("unable to load config %s: %w", candidate.Path, err)
+		}
+		return cfg, candidate, nil
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		return nil, Source{}, fmt.Errorf("unable to load embedded config: %w", err)
+	}
+	return cfg, Source{Kind: SourceEmbedded}, nil
+}
+
+func candidates() []Source {
+	var sources []Source
+	if dir := xdgConfigHome(); dir != "" {
+		sources = append(sources, Source{Kind: SourceXDG, Path: filepath.Join(dir, appName, "config.json")})
+	}
+	return append(sources, Source{Kind: SourceCwd, Path: "groups.json"})
+}
+
+// xdgConfigHome follows the XDG base directory spec: relative values are
+// ignored and ~/.config is the fallback.
+func xdgConfigHome() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(dir) {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config")
+}
+
+func loadFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parse(data)
+}
+
+func parse(data []byte) (*Config, error) {
 	var config Config
-	err := json.Unmarshal(groupsJSON, &config)
+	err := json.Unmarshal(data, &config)
 	if err != nil {
 		return nil, err
 	}
@@ -36,4 +217,4 @@ func (c *Config) GetWorkDir() string {
 		return "~/Downloads"
 	}
 	return c.WorkDir
-}
\ No newline at end of file
+}
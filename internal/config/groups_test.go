@@ -1,6 +1,8 @@
 package config
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -36,4 +38,91 @@ func TestGetWorkDirDefault(t *testing.T) {
 	cfg := &Config{} // Empty config
 	workDir := cfg.GetWorkDir()
 	assert.Equal(t, "~/Downloads", workDir)
-}
\ No newline at end of file
+}
+
+func TestLoad(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "config_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	xdgDir := filepath.Join(tmpDir, "xdg")
+	cwdDir := filepath.Join(tmpDir, "cwd")
+	require.NoError(t, os.MkdirAll(filepath.Join(xdgDir, appName), 0755))
+	require.NoError(t, os.MkdirAll(cwdDir, 0755))
+
+	t.Setenv("XDG_CONFIG_HOME", xdgDir)
+	t.Chdir(cwdDir)
+
+	t.Run("embedded default", func(t *testing.T) {
+		cfg, source, err := Load("")
+		require.NoError(t, err)
+		assert.Equal(t, SourceEmbedded, source.Kind)
+		assert.Len(t, cfg.GetGroups(), 2)
+	})
+
+	cwdConfig := `{"work_dir": "/cwd", "groups": [{"prefix": "Cwd", "output": "cwd.csv"}]}`
+	require.NoError(t, os.WriteFile(filepath.Join(cwdDir, "groups.json"), []byte(cwdConfig), 0644))
+
+	t.Run("groups.json in working directory", func(t *testing.T) {
+		cfg, source, err := Load("")
+		require.NoError(t, err)
+		assert.Equal(t, SourceCwd, source.Kind)
+		assert.Equal(t, "/cwd", cfg.GetWorkDir())
+	})
+
+	xdgConfig := `{"work_dir": "/xdg", "groups": [{"prefix": "Xdg", "output": "xdg.csv"}]}`
+	xdgPath := filepath.Join(xdgDir, appName, "config.json")
+	require.NoError(t, os.WriteFile(xdgPath, []byte(xdgConfig), 0644))
+
+	t.Run("xdg config wins over working directory", func(t *testing.T) {
+		cfg, source, err := Load("")
+		require.NoError(t, err)
+		assert.Equal(t, Source{Kind: SourceXDG, Path: xdgPath}, source)
+		assert.Equal(t, "/xdg", cfg.GetWorkDir())
+	})
+
+	explicitPath := filepath.Join(tmpDir, "explicit.json")
+	require.NoError(t, os.WriteFile(explicitPath, []byte(`{"work_dir": "/explicit"}`), 0644))
+
+	t.Run("explicit path wins", func(t *testing.T) {
+		cfg, source, err := Load(explicitPath)
+		require.NoError(t, err)
+		assert.Equal(t, SourceFlag, source.Kind)
+		assert.Equal(t, "/explicit", cfg.GetWorkDir())
+		assert.Contains(t, source.String(), explicitPath)
+	})
+
+	t.Run("missing explicit path", func(t *testing.T) {
+		_, _, err := Load(filepath.Join(tmpDir, "missing.json"))
+		assert.Error(t, err, "Expected error for missing explicit config")
+	})
+
+	t.Run("invalid json", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(xdgPath, []byte("{"), 0644))
+		_, _, err := Load("")
+		assert.Error(t, err, "Expected error for invalid config")
+	})
+}
+
+func TestGroupName(t *testing.T) {
+	assert.Equal(t, "Revenue", Group{Prefix: "Revenue", Output: "revenue.csv"}.Name())
+	assert.Equal(t, "Revenue_*.csv", Group{Match: &Match{Glob: "Revenue_*.csv"}, Output: "revenue.csv"}.Name())
+	assert.Equal(t, "revenue.csv", Group{Match: &Match{Extensions: []string{".csv"}}, Output: "revenue.csv"}.Name())
+}
+
+func TestSourceDirs(t *testing.T) {
+	cfg, err := parse([]byte(`{"groups": [{"prefix": "Report", "output": "report.csv", "sources": [
+		"~/Downloads",
+		{"dir": "/mnt/share/reports", "recursive": true, "max_depth": 2}
+	]}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, []SourceDir{
+		{Dir: "~/Downloads"},
+		{Dir: "/mnt/share/reports", Recursive: true, MaxDepth: 2},
+	}, cfg.GetGroups()[0].Sources)
+
+	_, err = parse([]byte(`{"groups": [{"sources": [42]}]}`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,373 @@
+// Package decode reads the records of report exports: plain CSV, gzipped CSV,
+// the CSV members of a zip archive and the first worksheet of an xlsx
+// workbook. CSV text is converted to UTF-8 from the encoding it is detected
+// in, and written back in the encoding of the output.
+package decode
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Format is how an input file is encoded.
+type Format string
+
+const (
+	FormatCSV  Format = "csv"
+	FormatGzip Format = "gzip"
+	FormatZip  Format = "zip"
+	FormatXLSX Format = "xlsx"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zipMagic  = []byte("PK\x03\x04")
+)
+
+// Detect picks the format of a file by the extension of name, falling back
+// to the magic bytes at the start of its content. Zip archives are only told
+// apart from xlsx workbooks by the extension; Open looks inside.
+func Detect(name string, head []byte) Format {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".gz":
+		return FormatGzip
+	case ".zip":
+		return FormatZip
+	case ".xlsx":
+		return FormatXLSX
+	}
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		return FormatGzip
+	case bytes.HasPrefix(head, zipMagic):
+		return FormatZip
+	}
+	return FormatCSV
+}
+
+// TrimExt removes the extension of name, including a ".gz" or ".zip" added to
+// the extension of the exported file.
+func TrimExt(name string) string {
+	ext := filepath.Ext(name)
+	name = strings.TrimSuffix(name, ext)
+	switch strings.ToLower(ext) {
+	case ".gz", ".zip":
+		return strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return name
+}
+
+// Records reads the records of a part of a file.
+type Records interface {
+	part
+	// Skipped returns how many records of the preamble and the footer were
+	// skipped so far.
+	Skipped() (preamble, footer int)
+}
+
+// part reads all records of a part of a file.
+type part interface {
+	Read() ([]string, error)
+	// Line returns the line or worksheet row the last record starts on.
+	Line() int
+	// Sniffed returns the dialect told from the first lines of CSV text;
+	// false before the first read, if it could not be told or for worksheets.
+	Sniffed() (Dialect, bool)
+}
+
+// File is an input file opened for reading. Zip archives have a part for
+// every CSV member, all other formats a single part.
+type File struct {
+	Name   string
+	Format Format
+
+	file    fs.File
+	opts    Options
+	parts   []func() (string, part, error)
+	current io.Closer
+}
+
+// Options configure how the CSV parts of a file are read.
+type Options struct {
+	Comma    rune     // field delimiter; a comma if zero
+	Quote    rune     // a double quote if zero; otherwise only a single quote is supported
+	Sniff    bool     // read every part in the dialect sniffed from its first lines where it can be told
+	Fallback Encoding // of text that has no byte order mark and is not UTF-8; Windows-1252 if empty
+
+	// Header skips the records of every part before the first one it
+	// matches, Footer the first record after the header it matches and all
+	// records after that. Both are matched against the fields of a record
+	// joined by commas.
+	Header *regexp.Regexp
+	Footer *regexp.Regexp
+}
+
+// Open opens the named file of fsys.
+func Open(fsys fs.FS, name string, opts Options) (*File, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Comma == 0 {
+		opts.Comma = ','
+	}
+	if opts.Quote == 0 {
+		opts.Quote = '"'
+	}
+	if opts.Fallback == "" {
+		opts.Fallback = EncodingWindows1252
+	}
+	d := &File{Name: name, file: f, opts: opts}
+	if err := d.init(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *File) init() error {
+	br := bufio.NewReader(d.file)
+	head, _ := br.Peek(len(zipMagic))
+	d.Format = Detect(d.Name, head)
+
+	switch d.Format {
+	case FormatGzip:
+		d.parts = append(d.parts, func() (string, part, error) {
+			gz, err := gzip.NewReader(br)
+			if err != nil {
+				return "", nil, fmt.Errorf("unable to decompress %s: %w", d.Name, err)
+			}
+			d.current = gz
+			return d.Name, d.csv(gz), nil
+		})
+		return nil
+	case FormatZip, FormatXLSX:
+		archive, err := openZip(d.file, br)
+		if err != nil {
+			return fmt.Errorf("unable to open %s: %w", d.Name, err)
+		}
+		if isWorkbook(archive) {
+			d.Format = FormatXLSX
+			d.parts = append(d.parts, func() (string, part, error) {
+				sheet, err := openSheet(archive)
+				if err != nil {
+					return "", nil, fmt.Errorf("unable to read workbook %s: %w", d.Name, err)
+				}
+				d.current = sheet
+				return d.Name, sheet, nil
+			})
+			return nil
+		}
+		if d.Format == FormatXLSX {
+			return fmt.Errorf("%s is not an xlsx workbook", d.Name)
+		}
+		for _, member := range csvMembers(archive) {
+			d.parts = append(d.parts, func() (string, part, error) {
+				r, err := member.Open()
+				if err != nil {
+					return "", nil, fmt.Errorf("unable to open %s in %s: %w", member.Name, d.Name, err)
+				}
+				d.current = r
+				return d.Name + "/" + member.Name, d.csv(r), nil
+			})
+		}
+		if len(d.parts) == 0 {
+			return fmt.Errorf("no CSV files in %s", d.Name)
+		}
+		return nil
+	}
+	d.parts = append(d.parts, func() (string, part, error) {
+		return d.Name, d.csv(br), nil
+	})
+	return nil
+}
+
+// Next returns the name and records of the next part: the file itself, or
+// "archive.zip/member.csv" for a zip member. It returns io.EOF after the last
+// part.
+func (d *File) Next() (string, Records, error) {
+	name, r, err := d.next()
+	if err != nil {
+		return "", nil, err
+	}
+	return name, &trimmed{part: r, header: d.opts.Header, footer: d.opts.Footer}, nil
+}
+
+func (d *File) next() (string, part, error) {
+	d.closeCurrent()
+	if len(d.parts) == 0 {
+		return "", nil, io.EOF
+	}
+	next := d.parts[0]
+	d.parts = d.parts[1:]
+	return next()
+}
+
+func (d *File) Close() error {
+	d.closeCurrent()
+	return d.file.Close()
+}
+
+func (d *File) closeCurrent() {
+	if d.current != nil {
+		d.current.Close()
+		d.current = nil
+	}
+}
+
+func (d *File) csv(r io.Reader) part {
+	return &csvRecords{src: r, opts: d.opts}
+}
+
+// csvRecords reads the records of a CSV part. The reader is only created on
+// the first read, so the content can still be copied as it is.
+type csvRecords struct {
+	src     io.Reader
+	opts    Options
+	reader  *csvReader
+	sniffed Dialect
+}
+
+func (r *csvRecords) Read() ([]string, error) {
+	if r.reader == nil {
+		_, text := NewReader(r.src, r.opts.Fallback)
+		br := bufio.NewReaderSize(text, sniffSize)
+		sample, _ := br.Peek(sniffSize)
+		dialect := Dialect{Comma: r.opts.Comma, Quote: r.opts.Quote}
+		if sniffed, ok := SniffDialect(headerSample(sample, r.opts.Header)); ok {
+			r.sniffed = sniffed
+			if r.opts.Sniff {
+				dialect = sniffed
+			}
+		}
+		r.reader = newCSVReader(br, dialect)
+	}
+	return r.reader.Read()
+}
+
+func (r *csvRecords) Sniffed() (Dialect, bool) {
+	return r.sniffed, r.sniffed.Comma != 0
+}
+
+func (r *csvRecords) Line() int {
+	if r.reader == nil {
+		return 0
+	}
+	line, _ := r.reader.FieldPos(0)
+	return line
+}
+
+// source returns the undecoded CSV content; only valid before the first read.
+func (r *csvRecords) source() io.Reader {
+	return r.src
+}
+
+// openZip opens a zip archive, reading it at random where the file allows.
+func openZip(f fs.File, br *bufio.Reader) (*zip.Reader, error) {
+	if ra, ok := f.(io.ReaderAt); ok {
+		if info, err := f.Stat(); err == nil {
+			return zip.NewReader(ra, info.Size())
+		}
+	}
+	data, err := io.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	return zip.NewReader(bytes.NewReader(data), int64(len(data)))
+}
+
+// csvMembers returns the CSV and TSV files of an archive in archive order, leaving
+// out hidden files and macOS resource forks.
+func csvMembers(archive *zip.Reader) []*zip.File {
+	var members []*zip.File
+	for _, f := range archive.File {
+		name := path.Base(f.Name)
+		if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if ext := strings.ToLower(path.Ext(name)); ext == ".csv" || ext == ".tsv" {
+			members = append(members, f)
+		}
+	}
+	return members
+}
+
+// Hash returns the MD5 of the decoded content of the named file: the bytes
+// of plain CSV files, the decompressed bytes of gzip files and zip members
+// and the records of xlsx worksheets written as CSV. Copies of a report
+// therefore hash the same however they were packed.
+func Hash(fsys fs.FS, name string) (string, error) {
+	d, err := Open(fsys, name, Options{})
+	if err != nil {
+		return "", err
+	}
+	defer d.Close()
+
+	h := md5.New()
+	if d.Format == FormatXLSX {
+		err = d.writeCSV(h)
+	} else {
+		err = d.copyParts(h)
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// copyParts copies the raw content of every part to w.
+func (d *File) copyParts(w io.Writer) error {
+	for {
+		_, records, err := d.next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r, ok := records.(*csvRecords)
+		if !ok {
+			return fmt.Errorf("%s has no raw content", d.Name)
+		}
+		if _, err := io.Copy(w, r.source()); err != nil {
+			return err
+		}
+	}
+}
+
+// writeCSV writes the records of the file to w as CSV.
+func (d *File) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	for {
+		_, records, err := d.Next()
+		if errors.Is(err, io.EOF) {
+			cw.Flush()
+			return cw.Error()
+		}
+		if err != nil {
+			return err
+		}
+		for {
+			record, err := records.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			cw.Write(record)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package decode
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"testing"
+	"testing/fstest"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const report = "Date,Impressions\n2025-01-01,100\n2025-01-02,200\n"
+
+func gzipped(t *testing.T, content string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func zipped(t *testing.T, members ...string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for i := 0; i < len(members); i += 2 {
+		f, err := w.Create(members[i])
+		require.NoError(t, err)
+		_, err = f.Write([]byte(members[i+1]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+// workbook builds an xlsx file with a single worksheet.
+func workbook(t *testing.T, sheetData string) []byte {
+	return zipped(t,
+		"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Report" sheetId="1" r:id="rId1"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/report.xml"/>
+</Relationships>`,
+		"xl/sharedStrings.xml", `<?xml version="1.0" encoding="UTF-8"?>
+<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<si><t>Date</t></si><si><t>Impressions</t></si><si><r><t>Ad </t></r><r><t>Unit</t></r></si>
+</sst>`,
+		"xl/styles.xml", `<?xml version="1.0" encoding="UTF-8"?>
+<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+<numFmts><numFmt numFmtId="164" formatCode="dd/mm/yyyy;@"/></numFmts>
+<cellXfs><xf numFmtId="0"/><xf numFmtId="14"/><xf numFmtId="164"/><xf numFmtId="4"/></cellXfs>
+</styleSheet>`,
+		"xl/worksheets/report.xml", `<?xml version="1.0" encoding="UTF-8"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`+sheetData+`</sheetData></worksheet>`,
+	)
+}
+
+func readAll(t *testing.T, fsys fstest.MapFS, name string) (Format, []string, [][]string) {
+	f, err := Open(fsys, name, Options{})
+	require.NoError(t, err)
+	defer f.Close()
+
+	var parts []string
+	var records [][]string
+	for {
+		part, r, err := f.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		parts = append(parts, part)
+		for {
+			record, err := r.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			records = append(records, record)
+		}
+	}
+	return f.Format, parts, records
+}
+
+func TestDetect(t *testing.T) {
+	assert.Equal(t, FormatCSV, Detect("report.csv", []byte("Date")))
+	assert.Equal(t, FormatGzip, Detect("report.csv.gz", nil))
+	assert.Equal(t, FormatGzip, Detect("report.csv", []byte{0x1f, 0x8b, 8, 0}))
+	assert.Equal(t, FormatZip, Detect("report.ZIP", nil))
+	assert.Equal(t, FormatZip, Detect("report", []byte("PK\x03\x04")))
+	assert.Equal(t, FormatXLSX, Detect("report.xlsx", nil))
+
+	assert.Equal(t, "report_2025-01-01", TrimExt("report_2025-01-01.csv.gz"))
+	assert.Equal(t, "report_2025-01-01 (1)", TrimExt("report_2025-01-01 (1).zip"))
+	assert.Equal(t, "report_2025-01-01", TrimExt("report_2025-01-01.xlsx"))
+}
+
+func TestOpen(t *testing.T) {
+	expected := [][]string{{"Date", "Impressions"}, {"2025-01-01", "100"}, {"2025-01-02", "200"}}
+	fsys := fstest.MapFS{
+		"report.csv":    {Data: []byte(report)},
+		"report.csv.gz": {Data: gzipped(t, report)},
+		"report.bin":    {Data: gzipped(t, report)},
+		"report.zip": {Data: zipped(t,
+			"part1.csv", "Date,Impressions\n2025-01-01,100\n",
+			"__MACOSX/._part1.csv", "resource fork",
+			"README.txt", "not a report",
+			"part2.CSV", "Date,Impressions\n2025-01-02,200\n",
+		)},
+		"empty.zip": {Data: zipped(t, "README.txt", "not a report")},
+		"report.xlsx": {Data: workbook(t, `
+<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c><c r="C1" t="s"><v>2</v></c><c r="D1" s="3"/></row>
+<row r="2"><c r="A2" s="1"><v>45658</v></c><c r="B2"><v>100</v></c><c r="C2" t="inlineStr"><is><t>Top</t></is></c></row>
+<row r="3"><c r="A3" s="3"/></row>
+<row r="5"><c r="A5" s="2"><v>45659.5</v></c><c r="C5" t="b"><v>1</v></c></row>`)},
+	}
+
+	for _, name := range []string{"report.csv", "report.csv.gz", "report.bin"} {
+		t.Run(name, func(t *testing.T) {
+			_, parts, records := readAll(t, fsys, name)
+			assert.Equal(t, []string{name}, parts)
+			assert.Equal(t, expected, records)
+		})
+	}
+
+	t.Run("zip members", func(t *testing.T) {
+		format, parts, records := readAll(t, fsys, "report.zip")
+		assert.Equal(t, FormatZip, format)
+		assert.Equal(t, []string{"report.zip/part1.csv", "report.zip/part2.CSV"}, parts)
+		assert.Equal(t, [][]string{
+			{"Date", "Impressions"}, {"2025-01-01", "100"},
+			{"Date", "Impressions"}, {"2025-01-02", "200"},
+		}, records)
+
+		_, err := Open(fsys, "empty.zip", Options{})
+		assert.ErrorContains(t, err, "no CSV files")
+	})
+
+	t.Run("xlsx worksheet", func(t *testing.T) {
+		format, _, records := readAll(t, fsys, "report.xlsx")
+		assert.Equal(t, FormatXLSX, format)
+		assert.Equal(t, [][]string{
+			{"Date", "Impressions", "Ad Unit"},
+			{"2025-01-01", "100", "Top"},
+			{"2025-01-02 12:00:00", "", "TRUE"},
+		}, records)
+
+		f, err := Open(fsys, "report.xlsx", Options{})
+		require.NoError(t, err)
+		defer f.Close()
+		_, r, err := f.Next()
+		require.NoError(t, err)
+		for range 3 {
+			_, err := r.Read()
+			require.NoError(t, err)
+		}
+		assert.Equal(t, 5, r.Line(), "Lines are worksheet rows")
+	})
+
+	t.Run("xlsx column limit", func(t *testing.T) {
+		for ref, ok := range map[string]bool{"XFD1": true, "XFE1": false, "ZZZZZZZ1": false} {
+			fsys := fstest.MapFS{"report.xlsx": {Data: workbook(t, `<row r="1"><c r="`+ref+`" t="inlineStr"><is><t>Date</t></is></c></row>`)}}
+			f, err := Open(fsys, "report.xlsx", Options{})
+			require.NoError(t, err)
+			_, r, err := f.Next()
+			require.NoError(t, err)
+			record, err := r.Read()
+			if ok {
+				require.NoError(t, err, ref)
+				assert.Len(t, record, 16384)
+			} else {
+				assert.ErrorContains(t, err, "beyond column XFD", ref)
+			}
+			f.Close()
+		}
+	})
+}
+
+func TestHash(t *testing.T) {
+	fsys := fstest.MapFS{
+		"report.csv":    {Data: []byte(report)},
+		"report.csv.gz": {Data: gzipped(t, report)},
+		"report.zip":    {Data: zipped(t, "report.csv", report)},
+		"other.csv":     {Data: []byte("Date,Impressions\n2025-01-03,300\n")},
+	}
+	plain, err := Hash(fsys, "report.csv")
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%x", md5.Sum([]byte(report))), plain, "Plain files hash as they are")
+
+	for _, name := range []string{"report.csv.gz", "report.zip"} {
+		hash, err := Hash(fsys, name)
+		require.NoError(t, err)
+		assert.Equal(t, plain, hash, "Decoded content of %s should hash like the plain file", name)
+	}
+	other, err := Hash(fsys, "other.csv")
+	require.NoError(t, err)
+	assert.NotEqual(t, plain, other)
+}
+
+func TestEncoding(t *testing.T) {
+	utf16 := func(bigEndian bool, s string) []byte {
+		var b []byte
+		for _, u := range utf16.Encode([]rune(s)) {
+			if bigEndian {
+				b = append(b, byte(u>>8), byte(u))
+			} else {
+				b = append(b, byte(u), byte(u>>8))
+			}
+		}
+		return b
+	}
+	text := "Date,Ad Unit\n2025-01-01,Café 😀\n"
+
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		expected Encoding
+		text     string
+	}{
+		{"utf-8", []byte(text), EncodingUTF8, text},
+		{"utf-8 with bom", append([]byte{0xef, 0xbb, 0xbf}, text...), EncodingUTF8BOM, text},
+		{"utf-16le with bom", append([]byte{0xff, 0xfe}, utf16(false, text)...), EncodingUTF16LE, text},
+		{"utf-16be with bom", append([]byte{0xfe, 0xff}, utf16(true, text)...), EncodingUTF16BE, text},
+		{"utf-16le without bom", utf16(false, text), EncodingUTF16LE, text},
+		{"windows-1252", []byte("Date,Ad Unit\n2025-01-01,Caf\xe9 \x80\n"), EncodingWindows1252, "Date,Ad Unit\n2025-01-01,Café €\n"},
+		{"mixed", []byte("Caf\xc3\xa9,Caf\xe9\n"), EncodingUTF8, "Café,Café\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			enc, r := NewReader(bytes.NewReader(tc.data), EncodingWindows1252)
+			assert.Equal(t, tc.expected, enc)
+			decoded, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, tc.text, string(decoded))
+		})
+	}
+
+	t.Run("parse", func(t *testing.T) {
+		enc, err := ParseEncoding("UTF-16")
+		require.NoError(t, err)
+		assert.Equal(t, EncodingUTF16LE, enc)
+		_, err = ParseEncoding("ebcdic")
+		assert.ErrorContains(t, err, "unknown encoding")
+
+		enc, err = ParseFallback("")
+		require.NoError(t, err)
+		assert.Equal(t, EncodingWindows1252, enc)
+		_, err = ParseFallback("utf-8")
+		assert.ErrorContains(t, err, "not a legacy encoding")
+	})
+
+	t.Run("write", func(t *testing.T) {
+		for _, enc := range []Encoding{EncodingUTF8, EncodingUTF8BOM, EncodingUTF16LE, EncodingUTF16BE} {
+			var buf bytes.Buffer
+			w := NewWriter(&buf, enc)
+			// Split in the middle of a character
+			_, err := w.Write([]byte(text[:28]))
+			require.NoError(t, err)
+			_, err = w.Write([]byte(text[28:]))
+			require.NoError(t, err)
+
+			detected, r := NewReader(&buf, EncodingWindows1252)
+			assert.Equal(t, enc, detected)
+			decoded, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, text, string(decoded), "%s should read back as written", enc)
+		}
+
+		var buf bytes.Buffer
+		_, err := NewWriter(&buf, EncodingLatin9).Write([]byte("Café €"))
+		require.NoError(t, err)
+		assert.Equal(t, "Caf\xe9 \xa4", buf.String())
+		_, err = NewWriter(&buf, EncodingLatin9).Write([]byte("😀"))
+		assert.ErrorContains(t, err, "cannot be encoded in iso-8859-15")
+	})
+}
+
+func TestSniffDialect(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		sample   string
+		expected Dialect
+	}{
+		{"comma", "Date,Ad Unit,Revenue\n2025-01-01,\"Top; Banner\",1.5\n", Dialect{',', '"'}},
+		{"decimal commas", "Datum;Anzeigenblock;Umsatz\n2025-01-01;Top;1,5\n2025-01-02;Top;2,25\n", Dialect{';', '"'}},
+		{"tab", "Date\tAd Unit\n2025-01-01\tTop, Banner\n", Dialect{'\t', '"'}},
+		{"pipe", "Date|Ad Unit\r\n2025-01-01|Top\r\n", Dialect{'|', '"'}},
+		{"single quotes", "'Date';'Ad Unit'\n'2025-01-01';'Top; Banner'\n", Dialect{';', '\''}},
+		{"apostrophes", "Date,Ad Unit\n2025-01-01,Men's Wear\n2025-01-02,Women's Wear\n", Dialect{',', '"'}},
+		{"cut off", "Date;Revenue\n2025-01-01;1,5\n2025-01-02;2,", Dialect{';', '"'}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dialect, ok := SniffDialect([]byte(tc.sample))
+			require.True(t, ok)
+			assert.Equal(t, tc.expected, dialect)
+		})
+	}
+
+	_, ok := SniffDialect([]byte("Date\n2025-01-01\n"))
+	assert.False(t, ok, "A single column has no delimiter")
+
+	t.Run("open", func(t *testing.T) {
+		fsys := fstest.MapFS{"report.tsv": {Data: []byte("'Date'\t'Ad Unit'\n2025-01-01\t'Top\tBanner'\n")}}
+		f, err := Open(fsys, "report.tsv", Options{Sniff: true})
+		require.NoError(t, err)
+		defer f.Close()
+		_, r, err := f.Next()
+		require.NoError(t, err)
+		_, ok := r.Sniffed()
+		assert.False(t, ok, "Nothing is sniffed before the first read")
+
+		var records [][]string
+		for {
+			record, err := r.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			records = append(records, record)
+		}
+		assert.Equal(t, [][]string{{"Date", "Ad Unit"}, {"2025-01-01", "Top\tBanner"}}, records)
+		sniffed, ok := r.Sniffed()
+		require.True(t, ok)
+		assert.Equal(t, Dialect{'\t', '\''}, sniffed)
+	})
+}
+
+func TestTrim(t *testing.T) {
+	export := "Report name,Revenue per day\nDate range,\"2025-01-01 - 2025-01-02\"\nNetwork,\"12345\" (Publisher)\n\n" +
+		"Date,Impressions\n2025-01-01,100\n2025-01-02,200\nTotal,300\n\nGenerated,2025-01-03\n"
+	fsys := fstest.MapFS{
+		"report.csv":  {Data: []byte(export)},
+		"report.xlsx": {Data: workbook(t, `<row r="1"><c r="A1" t="inlineStr"><is><t>Revenue per day</t></is></c></row>`)},
+	}
+	opts := Options{Header: regexp.MustCompile(`^Date,`), Footer: regexp.MustCompile(`^Total,`)}
+
+	f, err := Open(fsys, "report.csv", opts)
+	require.NoError(t, err)
+	defer f.Close()
+	_, r, err := f.Next()
+	require.NoError(t, err)
+	var records [][]string
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		records = append(records, record)
+	}
+	assert.Equal(t, [][]string{{"Date", "Impressions"}, {"2025-01-01", "100"}, {"2025-01-02", "200"}}, records)
+	preamble, footer := r.Skipped()
+	assert.Equal(t, 3, preamble, "Invalid CSV in the preamble is skipped as well")
+	assert.Equal(t, 2, footer)
+
+	t.Run("sniffed after the preamble", func(t *testing.T) {
+		export := "Bericht,Umsatz pro Tag\nZeitraum,01.01.2025 - 02.01.2025\nNetzwerk,12345\n\n" +
+			"Date;Impressions;Revenue\n2025-01-01;100;1,5\n2025-01-02;200;2,25\n"
+		fsys := fstest.MapFS{"report.csv": {Data: []byte(export)}}
+		f, err := Open(fsys, "report.csv", Options{Comma: ',', Quote: '"', Sniff: true, Header: regexp.MustCompile(`^Date`)})
+		require.NoError(t, err)
+		defer f.Close()
+		_, r, err := f.Next()
+		require.NoError(t, err)
+		var records [][]string
+		for {
+			record, err := r.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			records = append(records, record)
+		}
+		assert.Equal(t, [][]string{{"Date", "Impressions", "Revenue"}, {"2025-01-01", "100", "1,5"}, {"2025-01-02", "200", "2,25"}}, records)
+		sniffed, _ := r.Sniffed()
+		assert.Equal(t, Dialect{';', '"'}, sniffed, "The comma separated preamble is not sniffed")
+	})
+
+	f, err = Open(fsys, "report.xlsx", opts)
+	require.NoError(t, err)
+	defer f.Close()
+	_, r, err = f.Next()
+	require.NoError(t, err)
+	_, err = r.Read()
+	assert.ErrorContains(t, err, "no line matches the header pattern")
+}
@@ -0,0 +1,173 @@
+package decode
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Dialect is how the fields of CSV text are delimited and quoted.
+type Dialect struct {
+	Comma rune
+	Quote rune
+}
+
+func (d Dialect) String() string {
+	return fmt.Sprintf("delimiter %q, quote %q", d.Comma, d.Quote)
+}
+
+var (
+	sniffDelimiters = []rune{',', ';', '\t', '|'}
+	sniffQuotes     = []rune{'"', '\''}
+)
+
+// sniffRecords is how many records of the sample are compared.
+const sniffRecords = 20
+
+// SniffDialect infers the dialect of CSV text from its first lines: the
+// delimiter that splits the header into the most fields and the following
+// lines into as many, and the quote that fields start and end with. It
+// returns false if no delimiter splits the header.
+func SniffDialect(sample []byte) (Dialect, bool) {
+	// The last line of the sample may be cut off
+	if i := bytes.LastIndexByte(sample, '\n'); i >= 0 {
+		sample = sample[:i+1]
+	}
+
+	var best Dialect
+	var bestConsistent bool
+	bestFields := 1
+	for _, comma := range sniffDelimiters {
+		d := Dialect{Comma: comma, Quote: sniffQuote(sample, comma)}
+		fields, consistent := sniffFields(sample, d)
+		if fields < 2 {
+			continue
+		}
+		if consistent && !bestConsistent || consistent == bestConsistent && fields > bestFields {
+			best, bestConsistent, bestFields = d, consistent, fields
+		}
+	}
+	return best, best.Comma != 0
+}
+
+// headerSample returns the sample from the first line that matches the header
+// pattern, so that a preamble does not skew sniffing, or the whole sample if
+// no line matches. As for records, the pattern is matched against the fields
+// of the line joined by commas, for every delimiter that may split it.
+func headerSample(sample []byte, header *regexp.Regexp) []byte {
+	if header == nil {
+		return sample
+	}
+	for start := 0; start < len(sample); {
+		end := bytes.IndexByte(sample[start:], '\n')
+		if end < 0 {
+			end = len(sample)
+		} else {
+			end += start
+		}
+		line := strings.TrimSuffix(string(sample[start:end]), "\r")
+		for _, comma := range sniffDelimiters {
+			record, err := newCSVReader(strings.NewReader(line), Dialect{Comma: comma, Quote: sniffQuote([]byte(line), comma)}).Read()
+			if err == nil && header.MatchString(strings.Join(record, ",")) {
+				return sample[start:]
+			}
+		}
+		start = end + 1
+	}
+	return sample
+}
+
+// sniffQuote returns the single quote if fields are quoted with it and never
+// with double quotes, and the double quote otherwise.
+func sniffQuote(sample []byte, comma rune) rune {
+	var quoted [2]int
+	for i, quote := range sniffQuotes {
+		for _, line := range strings.Split(string(sample), "\n") {
+			for _, field := range strings.Split(strings.TrimSuffix(line, "\r"), string(comma)) {
+				if len(field) >= 2 && rune(field[0]) == quote && rune(field[len(field)-1]) == quote {
+					quoted[i]++
+				}
+			}
+		}
+	}
+	if quoted[1] > 0 && quoted[0] == 0 {
+		return '\''
+	}
+	return '"'
+}
+
+// sniffFields returns the number of fields of the header and whether the
+// records after it have as many.
+func sniffFields(sample []byte, d Dialect) (int, bool) {
+	r := newCSVReader(bytes.NewReader(sample), d)
+	header, err := r.Read()
+	if err != nil {
+		return 0, false
+	}
+	for range sniffRecords {
+		record, err := r.Read()
+		if err != nil {
+			return len(header), errors.Is(err, io.EOF)
+		}
+		if len(record) != len(header) {
+			return len(header), false
+		}
+	}
+	return len(header), true
+}
+
+// csvReader reads CSV text in a dialect. encoding/csv only quotes with double
+// quotes, so for single quotes both are swapped in the text and back in the
+// fields.
+type csvReader struct {
+	*csv.Reader
+	swap bool
+}
+
+func newCSVReader(r io.Reader, d Dialect) *csvReader {
+	c := &csvReader{swap: d.Quote == '\''}
+	if c.swap {
+		r = &quoteSwapper{r: r}
+	}
+	c.Reader = csv.NewReader(r)
+	c.Comma = d.Comma
+	c.LazyQuotes = c.swap  // apostrophes in unquoted fields
+	c.FieldsPerRecord = -1 // differing headers are checked by the merger
+	return c
+}
+
+func (c *csvReader) Read() ([]string, error) {
+	record, err := c.Reader.Read()
+	if c.swap {
+		for i, field := range record {
+			record[i] = strings.Map(swapQuote, field)
+		}
+	}
+	return record, err
+}
+
+type quoteSwapper struct {
+	r io.Reader
+}
+
+func (q *quoteSwapper) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	for i, b := range p[:n] {
+		p[i] = byte(swapQuote(rune(b)))
+	}
+	return n, err
+}
+
+func swapQuote(r rune) rune {
+	switch r {
+	case '"':
+		return '\''
+	case '\'':
+		return '"'
+	}
+	return r
+}
@@ -0,0 +1,359 @@
+package decode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Encoding is the character encoding of a text file.
+type Encoding string
+
+const (
+	EncodingUTF8        Encoding = "utf-8"
+	EncodingUTF8BOM     Encoding = "utf-8-bom"
+	EncodingUTF16LE     Encoding = "utf-16le" // with a byte order mark
+	EncodingUTF16BE     Encoding = "utf-16be" // with a byte order mark
+	EncodingWindows1252 Encoding = "windows-1252"
+	EncodingLatin1      Encoding = "iso-8859-1"
+	EncodingLatin9      Encoding = "iso-8859-15"
+)
+
+var encodingAliases = map[string]Encoding{
+	"utf8":     EncodingUTF8,
+	"utf8-bom": EncodingUTF8BOM,
+	"utf-16":   EncodingUTF16LE,
+	"utf16le":  EncodingUTF16LE,
+	"utf16be":  EncodingUTF16BE,
+	"cp1252":   EncodingWindows1252,
+	"latin1":   EncodingLatin1,
+	"latin9":   EncodingLatin9,
+}
+
+var (
+	bomUTF8    = []byte{0xef, 0xbb, 0xbf}
+	bomUTF16LE = []byte{0xff, 0xfe}
+	bomUTF16BE = []byte{0xfe, 0xff}
+)
+
+// ParseEncoding validates an output encoding; the empty string means UTF-8
+// without a byte order mark. Names are case-insensitive.
+func ParseEncoding(s string) (Encoding, error) {
+	if s == "" {
+		return EncodingUTF8, nil
+	}
+	e := Encoding(strings.ToLower(s))
+	if alias, ok := encodingAliases[string(e)]; ok {
+		e = alias
+	}
+	switch e {
+	case EncodingUTF8, EncodingUTF8BOM, EncodingUTF16LE, EncodingUTF16BE:
+		return e, nil
+	}
+	if e.Legacy() {
+		return e, nil
+	}
+	return "", fmt.Errorf("unknown encoding %q", s)
+}
+
+// ParseFallback validates the legacy encoding of input files that have no
+// byte order mark and are not valid UTF-8; the empty string means
+// Windows-1252.
+func ParseFallback(s string) (Encoding, error) {
+	if s == "" {
+		return EncodingWindows1252, nil
+	}
+	e, err := ParseEncoding(s)
+	if err != nil {
+		return "", err
+	}
+	if !e.Legacy() {
+		return "", fmt.Errorf("fallback encoding %q is not a legacy encoding", s)
+	}
+	return e, nil
+}
+
+// Legacy reports whether e is a single-byte encoding such as Windows-1252.
+func (e Encoding) Legacy() bool {
+	_, ok := charmaps[e]
+	return ok
+}
+
+// charmap maps the bytes of a single-byte encoding to runes.
+type charmap [256]rune
+
+var charmaps = map[Encoding]*charmap{
+	EncodingWindows1252: newCharmap(map[byte]rune{
+		0x80: '€', 0x82: '‚', 0x83: 'ƒ', 0x84: '„', 0x85: '…', 0x86: '†', 0x87: '‡',
+		0x88: 'ˆ', 0x89: '‰', 0x8a: 'Š', 0x8b: '‹', 0x8c: 'Œ', 0x8e: 'Ž',
+		0x91: '‘', 0x92: '’', 0x93: '“', 0x94: '”', 0x95: '•', 0x96: '–', 0x97: '—',
+		0x98: '˜', 0x99: '™', 0x9a: 'š', 0x9b: '›', 0x9c: 'œ', 0x9e: 'ž', 0x9f: 'Ÿ',
+	}),
+	EncodingLatin1: newCharmap(nil),
+	EncodingLatin9: newCharmap(map[byte]rune{
+		0xa4: '€', 0xa6: 'Š', 0xa8: 'š', 0xb4: 'Ž', 0xb8: 'ž', 0xbc: 'Œ', 0xbd: 'œ', 0xbe: 'Ÿ',
+	}),
+}
+
+// newCharmap returns Latin-1 with the given bytes mapped differently.
+func newCharmap(overrides map[byte]rune) *charmap {
+	var cm charmap
+	for b := range cm {
+		cm[b] = rune(b)
+	}
+	for b, r := range overrides {
+		cm[b] = r
+	}
+	return &cm
+}
+
+// sniffSize is how much of a file is looked at to detect its encoding.
+const sniffSize = 64 << 10
+
+// DetectEncoding guesses the encoding of a file from its first bytes: a byte
+// order mark, the zero bytes of UTF-16 text without one, or else UTF-8 if the
+// sample is valid UTF-8 and the fallback if it is not.
+func DetectEncoding(sample []byte, fallback Encoding) Encoding {
+	switch {
+	case bytes.HasPrefix(sample, bomUTF8):
+		return EncodingUTF8BOM
+	case bytes.HasPrefix(sample, bomUTF16LE):
+		return EncodingUTF16LE
+	case bytes.HasPrefix(sample, bomUTF16BE):
+		return EncodingUTF16BE
+	}
+
+	var even, odd int
+	pairs := min(len(sample), 512) / 2
+	for i := range pairs {
+		if sample[2*i] == 0 {
+			even++
+		}
+		if sample[2*i+1] == 0 {
+			odd++
+		}
+	}
+	// Mostly ASCII text has a zero in every other byte; the other half only
+	// has zeros in surrogates and rare characters
+	switch {
+	case odd*2 > pairs && even*10 < pairs:
+		return EncodingUTF16LE
+	case even*2 > pairs && odd*10 < pairs:
+		return EncodingUTF16BE
+	}
+
+	// The sample may end in the middle of a character
+	for range utf8.UTFMax - 1 {
+		if utf8.Valid(sample) {
+			return EncodingUTF8
+		}
+		sample = sample[:max(len(sample)-1, 0)]
+	}
+	if utf8.Valid(sample) {
+		return EncodingUTF8
+	}
+	return fallback
+}
+
+// NewReader detects the encoding of r and returns it with a reader of its
+// text as UTF-8 without a byte order mark. Bytes that are not valid UTF-8 in
+// an otherwise UTF-8 file are read in the fallback encoding.
+func NewReader(r io.Reader, fallback Encoding) (Encoding, io.Reader) {
+	br := bufio.NewReaderSize(r, sniffSize)
+	sample, _ := br.Peek(sniffSize)
+	enc := DetectEncoding(sample, fallback)
+	cm := charmaps[fallback]
+	if cm == nil {
+		cm = charmaps[EncodingWindows1252]
+	}
+
+	switch enc {
+	case EncodingUTF8BOM:
+		br.Discard(len(bomUTF8))
+		return enc, &transcoder{r: br, decode: utf8Decoder(cm)}
+	case EncodingUTF16LE, EncodingUTF16BE:
+		if bytes.HasPrefix(sample, bomUTF16LE) || bytes.HasPrefix(sample, bomUTF16BE) {
+			br.Discard(len(bomUTF16LE))
+		}
+		return enc, &transcoder{r: br, decode: utf16Decoder(enc == EncodingUTF16BE)}
+	case EncodingUTF8:
+		return enc, &transcoder{r: br, decode: utf8Decoder(cm)}
+	}
+	return enc, &transcoder{r: br, decode: charmapDecoder(charmaps[enc])}
+}
+
+// transcoder converts the bytes of r to UTF-8. decode appends the decoded
+// characters at the start of src to dst and returns how many bytes it used;
+// it leaves an incomplete character at the end for the next read unless eof.
+type transcoder struct {
+	r      io.Reader
+	decode func(dst, src []byte, eof bool) ([]byte, int)
+	in     []byte
+	out    []byte
+	eof    bool
+}
+
+func (t *transcoder) Read(p []byte) (int, error) {
+	for len(t.out) == 0 {
+		if t.eof {
+			return 0, io.EOF
+		}
+		chunk := make([]byte, 32<<10)
+		n, err := t.r.Read(chunk)
+		t.in = append(t.in, chunk[:n]...)
+		if err == io.EOF {
+			t.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+		var used int
+		t.out, used = t.decode(t.out[:0], t.in, t.eof)
+		t.in = append(t.in[:0], t.in[used:]...)
+	}
+	n := copy(p, t.out)
+	t.out = t.out[n:]
+	return n, nil
+}
+
+// utf8Decoder passes UTF-8 through and reads invalid bytes with cm.
+func utf8Decoder(cm *charmap) func(dst, src []byte, eof bool) ([]byte, int) {
+	return func(dst, src []byte, eof bool) ([]byte, int) {
+		start, i := 0, 0
+		for i < len(src) {
+			if src[i] < utf8.RuneSelf {
+				i++
+				continue
+			}
+			if !eof && !utf8.FullRune(src[i:]) {
+				break
+			}
+			r, size := utf8.DecodeRune(src[i:])
+			if r == utf8.RuneError && size == 1 {
+				dst = append(dst, src[start:i]...)
+				dst = utf8.AppendRune(dst, cm[src[i]])
+				start = i + 1
+			}
+			i += size
+		}
+		return append(dst, src[start:i]...), i
+	}
+}
+
+func charmapDecoder(cm *charmap) func(dst, src []byte, eof bool) ([]byte, int) {
+	return func(dst, src []byte, _ bool) ([]byte, int) {
+		for _, b := range src {
+			dst = utf8.AppendRune(dst, cm[b])
+		}
+		return dst, len(src)
+	}
+}
+
+func utf16Decoder(bigEndian bool) func(dst, src []byte, eof bool) ([]byte, int) {
+	unit := func(b []byte) rune {
+		if bigEndian {
+			return rune(b[0])<<8 | rune(b[1])
+		}
+		return rune(b[1])<<8 | rune(b[0])
+	}
+	return func(dst, src []byte, eof bool) ([]byte, int) {
+		i := 0
+		for i+1 < len(src) {
+			r := unit(src[i:])
+			if utf16.IsSurrogate(r) {
+				if i+3 >= len(src) && !eof {
+					break
+				}
+				if i+3 < len(src) {
+					if pair := utf16.DecodeRune(r, unit(src[i+2:])); pair != utf8.RuneError {
+						dst = utf8.AppendRune(dst, pair)
+						i += 4
+						continue
+					}
+				}
+				r = utf8.RuneError
+			}
+			dst = utf8.AppendRune(dst, r)
+			i += 2
+		}
+		if eof && i < len(src) {
+			dst = utf8.AppendRune(dst, utf8.RuneError)
+			i = len(src)
+		}
+		return dst, i
+	}
+}
+
+// NewWriter returns a writer that encodes the UTF-8 text written to it in
+// enc, starting with a byte order mark for utf-8-bom and UTF-16. Characters
+// that enc cannot represent fail the write.
+func NewWriter(w io.Writer, enc Encoding) io.Writer {
+	e := &encoder{w: w, enc: enc}
+	switch enc {
+	case EncodingUTF8BOM:
+		e.bom = bomUTF8
+	case EncodingUTF16LE:
+		e.bom = bomUTF16LE
+	case EncodingUTF16BE:
+		e.bom = bomUTF16BE
+	case EncodingUTF8, "":
+		return w
+	}
+	if cm, ok := charmaps[enc]; ok {
+		e.bytes = make(map[rune]byte, 256)
+		for b, r := range cm {
+			e.bytes[r] = byte(b)
+		}
+	}
+	return e
+}
+
+type encoder struct {
+	w       io.Writer
+	enc     Encoding
+	bom     []byte // written before the text
+	bytes   map[rune]byte
+	pending []byte // incomplete character at the end of the last write
+}
+
+func (e *encoder) Write(p []byte) (int, error) {
+	src := append(e.pending, p...)
+	e.pending = nil
+	var out []byte
+	if e.bom != nil {
+		out, e.bom = append(out, e.bom...), nil
+	}
+	for i := 0; i < len(src); {
+		if !utf8.FullRune(src[i:]) {
+			e.pending = append(e.pending, src[i:]...)
+			break
+		}
+		r, size := utf8.DecodeRune(src[i:])
+		i += size
+		switch e.enc {
+		case EncodingUTF8BOM:
+			out = utf8.AppendRune(out, r)
+		case EncodingUTF16LE, EncodingUTF16BE:
+			for _, u := range utf16.AppendRune(nil, r) {
+				if e.enc == EncodingUTF16BE {
+					out = append(out, byte(u>>8), byte(u))
+				} else {
+					out = append(out, byte(u), byte(u>>8))
+				}
+			}
+		default:
+			b, ok := e.bytes[r]
+			if !ok {
+				return 0, fmt.Errorf("%q cannot be encoded in %s", r, e.enc)
+			}
+			out = append(out, b)
+		}
+	}
+	if _, err := e.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
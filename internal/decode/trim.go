@@ -0,0 +1,55 @@
+package decode
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// trimmed skips the preamble before the header of a part, such as the report
+// name and date range of an Ad Manager download, and its footer, such as a
+// totals row.
+type trimmed struct {
+	part
+	header, footer   *regexp.Regexp
+	started, ended   bool
+	preamble, footed int
+}
+
+func (r *trimmed) Read() ([]string, error) {
+	for {
+		record, err := r.part.Read()
+		var parseErr *csv.ParseError
+		switch {
+		case errors.Is(err, io.EOF) && !r.started && r.header != nil && r.preamble > 0:
+			return nil, fmt.Errorf("no line matches the header pattern %q", r.header)
+		case errors.As(err, &parseErr) && !r.started && r.header != nil:
+			// Preamble lines need not be valid CSV
+			r.preamble++
+			continue
+		case err != nil:
+			return nil, err
+		case r.ended:
+			r.footed++
+			continue
+		case !r.started:
+			if r.header != nil && !r.header.MatchString(strings.Join(record, ",")) {
+				r.preamble++
+				continue
+			}
+			r.started = true
+		case r.footer != nil && r.footer.MatchString(strings.Join(record, ",")):
+			r.ended = true
+			r.footed++
+			continue
+		}
+		return record, nil
+	}
+}
+
+func (r *trimmed) Skipped() (int, int) {
+	return r.preamble, r.footed
+}
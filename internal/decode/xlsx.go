@@ -0,0 +1,342 @@
+package decode
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	workbookPath = "xl/workbook.xml"
+	relsPath     = "xl/_rels/workbook.xml.rels"
+	stringsPath  = "xl/sharedStrings.xml"
+	stylesPath   = "xl/styles.xml"
+	defaultSheet = "xl/worksheets/sheet1.xml"
+)
+
+func isWorkbook(archive *zip.Reader) bool {
+	for _, f := range archive.File {
+		if f.Name == workbookPath {
+			return true
+		}
+	}
+	return false
+}
+
+type xlsxWorkbook struct {
+	Properties struct {
+		Date1904 bool `xml:"date1904,attr"`
+	} `xml:"workbookPr"`
+	Sheets []struct {
+		ID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+// xlsxText is a string of the workbook, either plain or as rich text runs.
+type xlsxText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	var b strings.Builder
+	b.WriteString(t.T)
+	for _, r := range t.Runs {
+		b.WriteString(r.T)
+	}
+	return b.String()
+}
+
+type xlsxStrings struct {
+	Items []xlsxText `xml:"si"`
+}
+
+type xlsxStyles struct {
+	NumFmts []struct {
+		ID   int    `xml:"numFmtId,attr"`
+		Code string `xml:"formatCode,attr"`
+	} `xml:"numFmts>numFmt"`
+	CellXfs []struct {
+		NumFmtID int `xml:"numFmtId,attr"`
+	} `xml:"cellXfs>xf"`
+}
+
+type xlsxRow struct {
+	R     int `xml:"r,attr"`
+	Cells []struct {
+		Ref    string   `xml:"r,attr"`
+		Type   string   `xml:"t,attr"`
+		Style  int      `xml:"s,attr"`
+		Value  string   `xml:"v"`
+		Inline xlsxText `xml:"is"`
+	} `xml:"c"`
+}
+
+// sheet reads the rows of a worksheet as records. Cell values are formatted
+// the way they would be exported to CSV: shared and inline strings as they
+// are, numbers in their stored form and date cells as ISO dates.
+type sheet struct {
+	r       io.ReadCloser
+	decoder *xml.Decoder
+	strings []string
+	dates   []bool // per cell style: whether it formats a date
+	epoch   time.Time
+	width   int // fields of the first record
+	row     int
+	first   bool
+}
+
+// openSheet opens the first worksheet of the workbook.
+func openSheet(archive *zip.Reader) (*sheet, error) {
+	var workbook xlsxWorkbook
+	if err := readXML(archive, workbookPath, &workbook); err != nil {
+		return nil, err
+	}
+	s := &sheet{epoch: time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC), first: true}
+	if workbook.Properties.Date1904 {
+		s.epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	var shared xlsxStrings
+	if err := readXML(archive, stringsPath, &shared); err != nil && !errors.Is(err, errMissing) {
+		return nil, err
+	}
+	for _, item := range shared.Items {
+		s.strings = append(s.strings, item.String())
+	}
+
+	var styles xlsxStyles
+	if err := readXML(archive, stylesPath, &styles); err != nil && !errors.Is(err, errMissing) {
+		return nil, err
+	}
+	custom := make(map[int]string)
+	for _, f := range styles.NumFmts {
+		custom[f.ID] = f.Code
+	}
+	for _, xf := range styles.CellXfs {
+		s.dates = append(s.dates, isDateFormat(xf.NumFmtID, custom[xf.NumFmtID]))
+	}
+
+	name := defaultSheet
+	if len(workbook.Sheets) > 0 {
+		name = sheetPath(archive, workbook.Sheets[0].ID)
+	}
+	f, err := archive.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	s.r = f
+	s.decoder = xml.NewDecoder(f)
+	return s, nil
+}
+
+var errMissing = errors.New("missing part")
+
+func readXML(archive *zip.Reader, name string, v any) error {
+	f, err := archive.Open(name)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, errMissing)
+	}
+	defer f.Close()
+	if err := xml.NewDecoder(f).Decode(v); err != nil {
+		return fmt.Errorf("unable to parse %s: %w", name, err)
+	}
+	return nil
+}
+
+// sheetPath resolves the worksheet of a relationship id.
+func sheetPath(archive *zip.Reader, id string) string {
+	var rels xlsxRelationships
+	if err := readXML(archive, relsPath, &rels); err != nil {
+		return defaultSheet
+	}
+	for _, rel := range rels.Relationships {
+		if rel.ID != id {
+			continue
+		}
+		if target, ok := strings.CutPrefix(rel.Target, "/"); ok {
+			return target
+		}
+		return path.Join("xl", rel.Target)
+	}
+	return defaultSheet
+}
+
+// isDateFormat reports whether a number format shows a date: one of the
+// built-in date formats or a custom format with day or year placeholders.
+func isDateFormat(id int, code string) bool {
+	switch {
+	case id >= 14 && id <= 22, id >= 27 && id <= 36, id >= 45 && id <= 47, id >= 50 && id <= 58:
+		return true
+	case code == "":
+		return false
+	}
+	var plain strings.Builder
+	quoted, bracket := false, false
+	for _, r := range code {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case quoted:
+		case r == '[':
+			bracket = true
+		case r == ']':
+			bracket = false
+		case !bracket:
+			plain.WriteRune(r)
+		}
+	}
+	return strings.ContainsAny(strings.ToLower(plain.String()), "dy")
+}
+
+func (s *sheet) Read() ([]string, error) {
+	for {
+		token, err := s.decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "row" {
+			continue
+		}
+		var row xlsxRow
+		if err := s.decoder.DecodeElement(&row, &start); err != nil {
+			return nil, err
+		}
+		s.row++
+		if row.R > 0 {
+			s.row = row.R
+		}
+		record, err := s.record(row)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", s.row, err)
+		}
+		if record != nil {
+			return record, nil
+		}
+	}
+}
+
+func (s *sheet) Line() int {
+	return s.row
+}
+
+func (s *sheet) Sniffed() (Dialect, bool) {
+	return Dialect{}, false
+}
+
+func (s *sheet) Close() error {
+	return s.r.Close()
+}
+
+// record returns the values of the row padded to the width of the first
+// record, or nil for an empty row.
+func (s *sheet) record(row xlsxRow) ([]string, error) {
+	var record []string
+	for _, c := range row.Cells {
+		i := len(record)
+		if c.Ref != "" {
+			col, err := columnOf(c.Ref)
+			if err != nil {
+				return nil, err
+			}
+			i = col
+		}
+		value, err := s.value(c.Type, c.Style, c.Value, c.Inline)
+		if err != nil {
+			return nil, fmt.Errorf("cell %s: %w", c.Ref, err)
+		}
+		for len(record) <= i {
+			record = append(record, "")
+		}
+		record[i] = value
+	}
+	// Formatted but empty cells are stored as well; drop them at the end
+	for len(record) > 0 && record[len(record)-1] == "" {
+		record = record[:len(record)-1]
+	}
+	if len(record) == 0 {
+		return nil, nil
+	}
+	if s.first {
+		s.first, s.width = false, len(record)
+	}
+	for len(record) < s.width {
+		record = append(record, "")
+	}
+	return record, nil
+}
+
+func (s *sheet) value(typ string, style int, v string, inline xlsxText) (string, error) {
+	switch typ {
+	case "s":
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 || i >= len(s.strings) {
+			return "", fmt.Errorf("invalid shared string %q", v)
+		}
+		return s.strings[i], nil
+	case "inlineStr":
+		return inline.String(), nil
+	case "b":
+		if v == "1" {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case "", "n":
+		if style >= 0 && style < len(s.dates) && s.dates[style] && v != "" {
+			return s.date(v)
+		}
+	}
+	return v, nil
+}
+
+// date formats a serial date: days since the epoch of the workbook, with the
+// time of day as fraction.
+func (s *sheet) date(v string) (string, error) {
+	serial, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid date %q", v)
+	}
+	t := s.epoch.Add(time.Duration(math.Round(serial*86400)) * time.Second)
+	if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 {
+		return t.Format(time.DateOnly), nil
+	}
+	return t.Format(time.DateTime), nil
+}
+
+// maxColumns is the number of columns of a worksheet, up to XFD.
+const maxColumns = 16384
+
+// columnOf returns the 0-based column of a cell reference such as "C12".
+func columnOf(ref string) (int, error) {
+	col := 0
+	for i, r := range ref {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			if col = col*26 + int(r-'A') + 1; col > maxColumns {
+				return 0, fmt.Errorf("cell reference %q beyond column XFD", ref)
+			}
+		case i > 0 && r >= '0' && r <= '9':
+			return col - 1, nil
+		default:
+			return 0, fmt.Errorf("invalid cell reference %q", ref)
+		}
+	}
+	return 0, fmt.Errorf("invalid cell reference %q", ref)
+}
@@ -1,30 +1,85 @@
 package detector
 
 import (
-	"crypto/md5"
 	"fmt"
-	"os"
+	"io/fs"
+
+	"github.com/spossner/ad-reporting-merger/internal/decode"
+	"github.com/spossner/ad-reporting-merger/internal/ledger"
+	"github.com/spossner/ad-reporting-merger/internal/vfs"
 )
 
-type DuplicateDetector struct{}
+type DuplicateDetector struct {
+	fs fs.FS
+}
+
+// Merged is a source file whose content was already merged into the output
+// by an earlier run.
+type Merged struct {
+	File  string
+	Entry ledger.Entry
+}
 
 func NewDuplicateDetector() *DuplicateDetector {
-	return &DuplicateDetector{}
+	return NewDuplicateDetectorFS(vfs.OS{})
+}
+
+// NewDuplicateDetectorFS reads the files from fsys.
+func NewDuplicateDetectorFS(fsys fs.FS) *DuplicateDetector {
+	return &DuplicateDetector{fs: fsys}
+}
+
+// FindDuplicates returns the clusters of files with identical content. Files
+// keep their given order within a cluster, and clusters are ordered by their
+// first file.
+func (d *DuplicateDetector) FindDuplicates(files []string) ([][]string, error) {
+	var clusters [][]string
+	byHash := make(map[string]int) // contentHash -> index in clusters
+	for _, file := range files {
+		hash, err := HashFile(d.fs, file)
+		if err != nil {
+			return nil, err
+		}
+		if i, exists := byHash[hash]; exists {
+			clusters[i] = append(clusters[i], file)
+			continue
+		}
+		byHash[hash] = len(clusters)
+		clusters = append(clusters, []string{file})
+	}
+
+	duplicates := clusters[:0]
+	for _, cluster := range clusters {
+		if len(cluster) > 1 {
+			duplicates = append(duplicates, cluster)
+		}
+	}
+	return duplicates, nil
 }
 
-func (d *DuplicateDetector) HasDuplicates(files []string) (bool, error) {
-	hashes := make(map[string]string) // contentHash -> filename
+// FindMerged returns the files whose content the ledger records as merged
+// into output before.
+func (d *DuplicateDetector) FindMerged(files []string, l *ledger.Ledger, output string) ([]Merged, error) {
+	var merged []Merged
 	for _, file := range files {
-		content, err := os.ReadFile(file)
+		hash, err := HashFile(d.fs, file)
 		if err != nil {
-			return false, fmt.Errorf("unable to read file %s: %w", file, err)
+			return nil, err
 		}
-		hash := fmt.Sprintf("%x", md5.Sum(content))
-		if prev, exists := hashes[hash]; exists {
-			fmt.Printf("Duplicate files: %s and %s\n", file, prev)
-			return true, nil
+		if entry, ok := l.Lookup(output, hash); ok {
+			merged = append(merged, Merged{File: file, Entry: entry})
 		}
-		hashes[hash] = file
 	}
-	return false, nil
-}
\ No newline at end of file
+	return merged, nil
+}
+
+// HashFile returns the MD5 of the decoded file content, which identifies
+// files in the ledger. A report hashes the same whether it is plain,
+// gzipped or zipped.
+func HashFile(fsys fs.FS, file string) (string, error) {
+	hash, err := decode.Hash(fsys, file)
+	if err != nil {
+		return "", fmt.Errorf("unable to read file %s: %w", file, err)
+	}
+	return hash, nil
+}
@@ -1,15 +1,20 @@
 package detector
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/spossner/ad-reporting-merger/internal/ledger"
+	"github.com/spossner/ad-reporting-merger/internal/vfs"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-func TestHasDuplicates(t *testing.T) {
+func TestDuplicateFiles(t *testing.T) {
 	// Create temporary directory
 	tmpDir, err := os.MkdirTemp("", "detector_test")
 	if err != nil {
@@ -38,25 +43,96 @@ func TestHasDuplicates(t *testing.T) {
 	detector := NewDuplicateDetector()
 
 	t.Run("no duplicates", func(t *testing.T) {
-		hasDuplicates, err := detector.HasDuplicates([]string{file1, file2})
+		clusters, err := detector.FindDuplicates([]string{file1, file2})
 		require.NoError(t, err)
-		assert.False(t, hasDuplicates, "Expected no duplicates")
+		assert.Empty(t, clusters, "Expected no duplicates")
 	})
 
 	t.Run("with duplicates", func(t *testing.T) {
-		hasDuplicates, err := detector.HasDuplicates([]string{file1, file2, file3})
+		clusters, err := detector.FindDuplicates([]string{file1, file2, file3})
 		require.NoError(t, err)
-		assert.True(t, hasDuplicates, "Expected duplicates")
+		assert.Equal(t, [][]string{{file1, file3}}, clusters, "Expected duplicates")
 	})
 
 	t.Run("single file", func(t *testing.T) {
-		hasDuplicates, err := detector.HasDuplicates([]string{file1})
+		clusters, err := detector.FindDuplicates([]string{file1})
 		require.NoError(t, err)
-		assert.False(t, hasDuplicates, "Expected no duplicates for single file")
+		assert.Empty(t, clusters, "Expected no duplicates for single file")
 	})
 
 	t.Run("nonexistent file", func(t *testing.T) {
-		_, err := detector.HasDuplicates([]string{"nonexistent.csv"})
+		_, err := detector.FindDuplicates([]string{"nonexistent.csv"})
 		assert.Error(t, err, "Expected error for nonexistent file")
 	})
-}
\ No newline at end of file
+}
+
+func TestFindDuplicates(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "detector_clusters_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	files := make([]string, 5)
+	contents := []string{"a", "b", "a", "b", "a"}
+	for i, content := range contents {
+		files[i] = filepath.Join(tmpDir, fmt.Sprintf("file%d.csv", i))
+		require.NoError(t, os.WriteFile(files[i], []byte("Date,Value\n"+content+"\n"), 0644))
+	}
+
+	clusters, err := NewDuplicateDetector().FindDuplicates(files)
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{files[0], files[2], files[4]}, {files[1], files[3]}}, clusters)
+
+	clusters, err = NewDuplicateDetector().FindDuplicates(files[:2])
+	require.NoError(t, err)
+	assert.Empty(t, clusters)
+}
+
+func TestFindMerged(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "detector_ledger_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	file1 := filepath.Join(tmpDir, "file1.csv")
+	file2 := filepath.Join(tmpDir, "file2.csv")
+	require.NoError(t, os.WriteFile(file1, []byte("Date,Value\n2025-01-01,100\n"), 0644))
+	require.NoError(t, os.WriteFile(file2, []byte("Date,Value\n2025-01-02,200\n"), 0644))
+
+	hash, err := HashFile(vfs.OS{}, file1)
+	require.NoError(t, err)
+	l, err := ledger.Open(vfs.OS{}, filepath.Join(tmpDir, "ledger.json"))
+	require.NoError(t, err)
+	l.Add(ledger.Entry{Hash: hash, File: "old.csv", Output: "raw.csv"})
+
+	merged, err := NewDuplicateDetector().FindMerged([]string{file1, file2}, l, "raw.csv")
+	require.NoError(t, err)
+	require.Len(t, merged, 1)
+	assert.Equal(t, file1, merged[0].File)
+	assert.Equal(t, "old.csv", merged[0].Entry.File)
+
+	merged, err = NewDuplicateDetector().FindMerged([]string{file1, file2}, l, "other.csv")
+	require.NoError(t, err)
+	assert.Empty(t, merged)
+}
+
+func TestFindDuplicatesCompressed(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("/reports", 0755))
+
+	content := "Date,Value\n2025-01-01,100\n"
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, err := w.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	require.NoError(t, vfs.WriteFile(fsys, "/reports/report.csv", []byte(content), 0644))
+	require.NoError(t, vfs.WriteFile(fsys, "/reports/report.csv.gz", gz.Bytes(), 0644))
+
+	clusters, err := NewDuplicateDetectorFS(fsys).FindDuplicates([]string{"/reports/report.csv", "/reports/report.csv.gz"})
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"/reports/report.csv", "/reports/report.csv.gz"}}, clusters, "Expected the gzipped copy to be a duplicate")
+}
@@ -0,0 +1,83 @@
+package filesystem
+
+import (
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// DownloadSuffixes are appended by browsers to files that are still being
+// downloaded: Chrome and Edge (.crdownload), Safari (.download bundles),
+// Firefox (.part) and Opera (.opdownload).
+var DownloadSuffixes = []string{".crdownload", ".download", ".part", ".opdownload"}
+
+// InProgress is a matching file that is left alone because it is still being
+// downloaded or written.
+type InProgress struct {
+	File   string
+	Reason string
+}
+
+// downloadTarget returns the name a browser temp file will be renamed to.
+func downloadTarget(name string) (string, bool) {
+	for _, suffix := range DownloadSuffixes {
+		if target, ok := strings.CutSuffix(name, suffix); ok {
+			return target, true
+		}
+	}
+	return "", false
+}
+
+// pendingDownload returns the browser temp file of name if it is among names.
+// Firefox creates the final file empty when a download starts.
+func pendingDownload(name string, names map[string]bool) (string, bool) {
+	for _, suffix := range DownloadSuffixes {
+		if names[name+suffix] {
+			return name + suffix, true
+		}
+	}
+	return "", false
+}
+
+// stableFiles splits files into those whose size and modification time stay
+// the same for stableFor and those that change. Files last modified longer
+// than stableFor ago are stable without waiting.
+func (f *FileOperations) stableFiles(files []string, stableFor time.Duration) ([]string, []InProgress, error) {
+	now := time.Now()
+	recent := make(map[string]fs.FileInfo)
+	var wait time.Duration
+	for _, file := range files {
+		info, err := f.fs.Stat(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		if age := now.Sub(info.ModTime()); age < stableFor {
+			recent[file] = info
+			wait = max(wait, min(stableFor-age, stableFor))
+		}
+	}
+	if len(recent) == 0 {
+		return files, nil, nil
+	}
+	f.sleep(wait)
+
+	var stable []string
+	var changing []InProgress
+	for _, file := range files {
+		before, ok := recent[file]
+		if !ok {
+			stable = append(stable, file)
+			continue
+		}
+		after, err := f.fs.Stat(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+			changing = append(changing, InProgress{File: file, Reason: "still being written"})
+		} else {
+			stable = append(stable, file)
+		}
+	}
+	return stable, changing, nil
+}
@@ -0,0 +1,141 @@
+package filesystem
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spossner/ad-reporting-merger/internal/vfs"
+)
+
+// SourceDir is a directory searched for source files.
+type SourceDir struct {
+	Dir       string // relative dirs are resolved against the work dir
+	Recursive bool
+	MaxDepth  int // levels of subdirectories searched; unlimited if 0 and recursive
+}
+
+// depth returns the levels of subdirectories to search, -1 for unlimited.
+func (d SourceDir) depth() int {
+	switch {
+	case d.MaxDepth > 0:
+		return d.MaxDepth
+	case d.Recursive:
+		return -1
+	}
+	return 0
+}
+
+// Search describes where and how the source files of a group are found.
+type Search struct {
+	Dirs      []SourceDir // the work dir if empty
+	Match     Matcher     // applied to the file names
+	Skip      []string    // dirs never searched, such as the archive dir
+	StableFor time.Duration
+
+	// Files never returned, such as the outputs of all groups
+	SkipFiles []string
+}
+
+// FindFiles returns the paths of the files selected by s, leaving out
+// downloads in progress.
+func (f *FileOperations) FindFiles(s Search) ([]string, error) {
+	s.StableFor = 0
+	files, _, err := f.FindCompleteFiles(s)
+	return files, err
+}
+
+// FindCompleteFiles returns the paths of the files selected by s and of the
+// selected files that are still in progress: browser temp files of selected
+// names, files whose temp file is still next to them and, if s.StableFor is
+// positive, files whose size or modification time changed within it. Files
+// modified less than s.StableFor ago are checked again after waiting. Hidden
+// dirs are never searched, and a file found through several source dirs is
+// returned once.
+func (f *FileOperations) FindCompleteFiles(s Search) ([]string, []InProgress, error) {
+	fd := &finder{fs: f.fs, match: s.Match, skip: make(map[string]bool), seen: make(map[string]bool)}
+	for _, dir := range append(s.Skip, s.SkipFiles...) {
+		resolved, err := f.Resolve(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		fd.skip[resolved] = true
+	}
+
+	dirs := s.Dirs
+	if len(dirs) == 0 {
+		dirs = []SourceDir{{}}
+	}
+	for _, dir := range dirs {
+		root, err := f.Resolve(dir.Dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := fd.find(root, dir.depth()); err != nil {
+			return nil, nil, fmt.Errorf("unable to search %s: %w", root, err)
+		}
+	}
+	if s.StableFor <= 0 {
+		return fd.files, fd.inProgress, nil
+	}
+
+	files, changing, err := f.stableFiles(fd.files, s.StableFor)
+	if err != nil {
+		return nil, nil, err
+	}
+	return files, append(fd.inProgress, changing...), nil
+}
+
+// finder collects the files of a search.
+type finder struct {
+	fs         vfs.FS
+	match      Matcher
+	skip       map[string]bool
+	seen       map[string]bool
+	files      []string
+	inProgress []InProgress
+}
+
+// find collects the files in dir and, up to depth levels deep, in its
+// subdirectories. A negative depth is unlimited.
+func (fd *finder) find(dir string, depth int) error {
+	entries, err := fd.fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		path := filepath.Join(dir, name)
+		if target, ok := downloadTarget(name); ok {
+			if fd.match.Match(target) && !fd.seen[path] {
+				fd.seen[path] = true
+				fd.inProgress = append(fd.inProgress, InProgress{File: path, Reason: "download in progress"})
+			}
+			continue
+		}
+		if e.IsDir() {
+			if depth != 0 && !strings.HasPrefix(name, ".") && !fd.skip[path] {
+				if err := fd.find(path, depth-1); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !fd.match.Match(name) || fd.seen[path] || fd.skip[path] {
+			continue
+		}
+		fd.seen[path] = true
+		if temp, ok := pendingDownload(name, names); ok {
+			fd.inProgress = append(fd.inProgress, InProgress{File: path, Reason: fmt.Sprintf("download in progress (%s)", temp)})
+			continue
+		}
+		fd.files = append(fd.files, path)
+	}
+	return nil
+}
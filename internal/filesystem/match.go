@@ -0,0 +1,59 @@
+package filesystem
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Matcher selects the source files of a group by name. Every condition that
+// is set must hold.
+type Matcher struct {
+	Prefix     string
+	Glob       string // filepath.Match pattern
+	Regex      *regexp.Regexp
+	Extensions []string // allowed extensions such as ".csv", "csv" or ".csv.gz", ignoring case
+	Exclude    []string // filepath.Match patterns of names to leave out
+}
+
+// Validate checks the glob patterns and that the matcher has a condition at
+// all, so that a group never sweeps up a whole directory.
+func (m Matcher) Validate() error {
+	if m.Prefix == "" && m.Glob == "" && m.Regex == nil && len(m.Extensions) == 0 {
+		return fmt.Errorf("no prefix or match pattern")
+	}
+	for _, pattern := range append([]string{m.Glob}, m.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Match reports whether the file name is selected.
+func (m Matcher) Match(name string) bool {
+	if !strings.HasPrefix(name, m.Prefix) {
+		return false
+	}
+	if m.Glob != "" {
+		if ok, _ := filepath.Match(m.Glob, name); !ok {
+			return false
+		}
+	}
+	if m.Regex != nil && !m.Regex.MatchString(name) {
+		return false
+	}
+	if len(m.Extensions) > 0 && !slices.ContainsFunc(m.Extensions, func(ext string) bool {
+		return strings.HasSuffix(strings.ToLower(name), "."+strings.ToLower(strings.TrimPrefix(ext, ".")))
+	}) {
+		return false
+	}
+	for _, pattern := range m.Exclude {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return false
+		}
+	}
+	return true
+}
@@ -1,56 +1,266 @@
 package filesystem
 
 import (
+	"errors"
 	"fmt"
-	"io"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/spossner/ad-reporting-merger/internal/vfs"
+)
+
+// Disposal is what happens to source files once they have been merged.
+type Disposal string
+
+const (
+	DisposalDelete  Disposal = "delete"
+	DisposalArchive Disposal = "archive"
+	DisposalTrash   Disposal = "trash"
+	DisposalKeep    Disposal = "keep"
 )
 
+// ParseDisposal validates a disposal policy; the empty string means delete.
+func ParseDisposal(s string) (Disposal, error) {
+	switch d := Disposal(s); d {
+	case "":
+		return DisposalDelete, nil
+	case DisposalDelete, DisposalArchive, DisposalTrash, DisposalKeep:
+		return d, nil
+	}
+	return "", fmt.Errorf("unknown disposal policy %q", s)
+}
+
+const DefaultArchiveDir = "archive"
+
+// DefaultDuplicatesDir is where duplicate source files are moved aside.
+const DefaultDuplicatesDir = "duplicates"
+
 type FileOperations struct {
 	workDir string
+	fs      vfs.FS
+	sleep   func(time.Duration) // waits for files to settle
 }
 
+// NewFileOperations works off workDir, made absolute. It never changes the
+// working directory of the process, so several can be used at once.
 func NewFileOperations(workDir string) (*FileOperations, error) {
 	expandedDir, err := expandPath(workDir)
 	if err != nil {
 		return nil, err
 	}
-	return &FileOperations{workDir: expandedDir}, nil
+	absDir, err := filepath.Abs(expandedDir)
+	if err != nil {
+		return nil, err
+	}
+	return &FileOperations{workDir: absDir, fs: vfs.OS{}, sleep: time.Sleep}, nil
+}
+
+// WithFS returns a copy of f working on fsys instead of the OS file system.
+func (f *FileOperations) WithFS(fsys vfs.FS) *FileOperations {
+	c := *f
+	c.fs = fsys
+	return &c
 }
 
-func (f *FileOperations) ChangeToWorkDir() error {
-	return os.Chdir(f.workDir)
+// FS returns the file system f works on.
+func (f *FileOperations) FS() vfs.FS {
+	return f.fs
 }
 
-func (f *FileOperations) FindFiles(prefix string) ([]string, error) {
-	var matched []string
-	entries, err := os.ReadDir(".")
+// WorkDir returns the absolute work dir.
+func (f *FileOperations) WorkDir() string {
+	return f.workDir
+}
+
+// RecordMove is called with the destination of a file, and for the trash its
+// .trashinfo file, before the file is moved, so that a journal can record the
+// move first. An error cancels the move.
+type RecordMove func(dst, trashInfo string) error
+
+func (r RecordMove) call(dst, trashInfo string) error {
+	if r == nil {
+		return nil
+	}
+	return r(dst, trashInfo)
+}
+
+// ArchiveFile moves the file into a subfolder of archiveDir named after the
+// current month (e.g. archive/2025-01). Relative archive dirs are resolved
+// against the work dir. The file keeps its name unless that would overwrite an
+// existing file. It returns the new location of the file; record may be nil.
+func (f *FileOperations) ArchiveFile(file, archiveDir string, record RecordMove) (string, error) {
+	archiveDir, err := f.resolveDir(archiveDir, DefaultArchiveDir)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	dir := filepath.Join(archiveDir, time.Now().Format("2006-01"))
+	if err := f.fs.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("unable to create archive dir: %w", err)
+	}
+
+	dst, err := uniquePath(f.fs, dir, filepath.Base(file))
+	if err != nil {
+		return "", err
+	}
+	if err := record.call(dst, ""); err != nil {
+		return "", err
+	}
+	if err := vfs.Move(f.fs, file, dst); err != nil {
+		return "", fmt.Errorf("unable to archive %s: %w", file, err)
+	}
+	return dst, nil
+}
+
+// MoveAside moves a duplicate source file into dir, DefaultDuplicatesDir in
+// the work dir if empty, and returns its new path; record may be nil.
+func (f *FileOperations) MoveAside(file, dir string, record RecordMove) (string, error) {
+	dir, err := f.resolveDir(dir, DefaultDuplicatesDir)
+	if err != nil {
+		return "", err
+	}
+	if err := f.fs.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("unable to create duplicates dir: %w", err)
+	}
+
+	dst, err := uniquePath(f.fs, dir, filepath.Base(file))
+	if err != nil {
+		return "", err
+	}
+	if err := record.call(dst, ""); err != nil {
+		return "", err
+	}
+	if err := vfs.Move(f.fs, file, dst); err != nil {
+		return "", fmt.Errorf("unable to move aside %s: %w", file, err)
+	}
+	return dst, nil
+}
+
+// resolveDir resolves dir, or def if it is empty.
+func (f *FileOperations) resolveDir(dir, def string) (string, error) {
+	if dir == "" {
+		dir = def
+	}
+	return f.Resolve(dir)
+}
+
+// Resolve expands path relative to the work dir into an absolute path; the
+// empty path is the work dir itself.
+func (f *FileOperations) Resolve(path string) (string, error) {
+	path, err := expandPath(path)
+	if err != nil {
+		return "", err
 	}
-	for _, e := range entries {
-		if !e.IsDir() && strings.HasPrefix(e.Name(), prefix) {
-			matched = append(matched, e.Name())
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(f.workDir, path)
+	}
+	return filepath.Clean(path), nil
+}
+
+// TrashFile moves the file into the user's home trash as described by the
+// freedesktop.org Trash specification and returns its location in the trash;
+// record may be nil.
+func (f *FileOperations) TrashFile(file string, record RecordMove) (string, error) {
+	trashDir, err := homeTrash()
+	if err != nil {
+		return "", err
+	}
+	filesDir := filepath.Join(trashDir, "files")
+	infoDir := filepath.Join(trashDir, "info")
+	for _, dir := range []string{filesDir, infoDir} {
+		if err := f.fs.MkdirAll(dir, 0700); err != nil {
+			return "", fmt.Errorf("unable to create trash dir: %w", err)
 		}
 	}
-	return matched, nil
+
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	name, info, err := reserveTrashInfo(f.fs, infoDir, filepath.Base(file))
+	if err != nil {
+		return "", err
+	}
+	_, err = fmt.Fprintf(info, "[Trash Info]\nPath=%s\nDeletionDate=%s\n",
+		(&url.URL{Path: abs}).EscapedPath(), time.Now().Format("2006-01-02T15:04:05"))
+	if closeErr := info.Close(); err == nil {
+		err = closeErr
+	}
+	dst := filepath.Join(filesDir, name)
+	if err == nil {
+		err = record.call(dst, TrashInfoPath(dst))
+	}
+	if err == nil {
+		err = vfs.Move(f.fs, file, dst)
+	}
+	if err != nil {
+		f.fs.Remove(TrashInfoPath(dst))
+		return "", fmt.Errorf("unable to trash %s: %w", file, err)
+	}
+	return dst, nil
+}
+
+// TrashInfoPath returns the .trashinfo file belonging to a file in the trash.
+func TrashInfoPath(trashed string) string {
+	trashDir := filepath.Dir(filepath.Dir(trashed))
+	return filepath.Join(trashDir, "info", filepath.Base(trashed)+".trashinfo")
 }
 
-func (f *FileOperations) DeleteFiles(files []string) error {
-	for _, file := range files {
-		err := os.Remove(file)
+// reserveTrashInfo creates the .trashinfo file exclusively, which is how the
+// spec reserves a name in the trash.
+func reserveTrashInfo(fsys vfs.FS, infoDir, name string) (string, vfs.File, error) {
+	for i := 0; ; i++ {
+		candidate := numberedName(name, i)
+		info, err := fsys.OpenFile(filepath.Join(infoDir, candidate+".trashinfo"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
 		if err != nil {
-			return err
+			return "", nil, fmt.Errorf("unable to create trash info: %w", err)
 		}
+		return candidate, info, nil
 	}
-	return nil
+}
+
+func homeTrash() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "Trash"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share", "Trash"), nil
+}
+
+// uniquePath returns a path in dir for name that does not exist yet, adding
+// " (1)", " (2)", ... before the extension if needed.
+func uniquePath(fsys vfs.FS, dir, name string) (string, error) {
+	for i := 0; ; i++ {
+		candidate := filepath.Join(dir, numberedName(name, i))
+		_, err := fsys.Stat(candidate)
+		if errors.Is(err, os.ErrNotExist) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+func numberedName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
 }
 
 // CopyTestFiles copies test files from source to destination, preserving originals
 func (f *FileOperations) CopyTestFiles(sourceDir, destDir string) error {
-	entries, err := os.ReadDir(sourceDir)
+	entries, err := f.fs.ReadDir(sourceDir)
 	if err != nil {
 		return fmt.Errorf("failed to read source directory: %w", err)
 	}
@@ -63,7 +273,7 @@ func (f *FileOperations) CopyTestFiles(sourceDir, destDir string) error {
 		sourcePath := filepath.Join(sourceDir, entry.Name())
 		destPath := filepath.Join(destDir, entry.Name())
 
-		err := f.copyFile(sourcePath, destPath)
+		err := vfs.Copy(f.fs, sourcePath, destPath)
 		if err != nil {
 			return fmt.Errorf("failed to copy file %s: %w", entry.Name(), err)
 		}
@@ -72,23 +282,6 @@ func (f *FileOperations) CopyTestFiles(sourceDir, destDir string) error {
 	return nil
 }
 
-func (f *FileOperations) copyFile(src, dst string) error {
-	sourceFile, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer sourceFile.Close()
-
-	destFile, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer destFile.Close()
-
-	_, err = io.Copy(destFile, sourceFile)
-	return err
-}
-
 func expandPath(path string) (string, error) {
 	if strings.HasPrefix(path, "~/") {
 		home, err := os.UserHomeDir()
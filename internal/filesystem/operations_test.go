@@ -1,10 +1,13 @@
 package filesystem
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -24,6 +27,17 @@ func TestNewFileOperations(t *testing.T) {
 		expected := filepath.Join(home, "test")
 		assert.Equal(t, expected, ops.workDir)
 	})
+
+	t.Run("with relative path", func(t *testing.T) {
+		ops, err := NewFileOperations("reports")
+		require.NoError(t, err)
+		cwd, _ := os.Getwd()
+		assert.Equal(t, filepath.Join(cwd, "reports"), ops.WorkDir())
+
+		resolved, err := ops.Resolve("raw.csv")
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(cwd, "reports", "raw.csv"), resolved)
+	})
 }
 
 func TestFindFiles(t *testing.T) {
@@ -52,19 +66,13 @@ func TestFindFiles(t *testing.T) {
 	ops, err := NewFileOperations(tmpDir)
 	require.NoError(t, err)
 
-	originalDir, _ := os.Getwd()
-	defer os.Chdir(originalDir)
-
-	err = ops.ChangeToWorkDir()
-	require.NoError(t, err)
-
-	found, err := ops.FindFiles("AdManager Reporting")
+	found, err := ops.FindFiles(Search{Match: Matcher{Prefix: "AdManager Reporting"}})
 	require.NoError(t, err)
 
 	assert.Len(t, found, 2)
 
 	for _, file := range found {
-		assert.True(t, strings.HasPrefix(file, "AdManager Reporting"), "File %s doesn't have expected prefix", file)
+		assert.True(t, strings.HasPrefix(filepath.Base(file), "AdManager Reporting"), "File %s doesn't have expected prefix", file)
 	}
 }
 
@@ -105,4 +113,338 @@ func TestCopyTestFiles(t *testing.T) {
 	// Verify original still exists
 	_, err = os.Stat(testFile)
 	assert.NoError(t, err, "Original file should still exist")
-}
\ No newline at end of file
+}
+
+func TestParseDisposal(t *testing.T) {
+	d, err := ParseDisposal("")
+	require.NoError(t, err)
+	assert.Equal(t, DisposalDelete, d)
+
+	d, err = ParseDisposal("archive")
+	require.NoError(t, err)
+	assert.Equal(t, DisposalArchive, d)
+
+	_, err = ParseDisposal("shred")
+	assert.Error(t, err)
+}
+
+func TestArchiveFile(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "archive_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ops, err := NewFileOperations(tmpDir)
+	require.NoError(t, err)
+
+	monthDir := filepath.Join(tmpDir, "archive", time.Now().Format("2006-01"))
+	require.NoError(t, os.MkdirAll(monthDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(monthDir, "report.csv"), []byte("old"), 0644))
+
+	source := filepath.Join(tmpDir, "report.csv")
+	require.NoError(t, os.WriteFile(source, []byte("new"), 0644))
+
+	moved, err := ops.ArchiveFile(source, "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(monthDir, "report (1).csv"), moved)
+
+	_, err = os.Stat(source)
+	assert.True(t, os.IsNotExist(err), "Source should have been moved")
+
+	content, err := os.ReadFile(filepath.Join(monthDir, "report.csv"))
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(content), "Existing archive file must not be overwritten")
+
+	content, err = os.ReadFile(moved)
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(content))
+
+	// The move is recorded before it happens, and a failure to record it
+	// leaves the file in place
+	require.NoError(t, os.WriteFile(source, []byte("next"), 0644))
+	_, err = ops.ArchiveFile(source, "", func(dst, trashInfo string) error {
+		assert.Equal(t, filepath.Join(monthDir, "report (2).csv"), dst)
+		assert.Empty(t, trashInfo)
+		_, err := os.Stat(source)
+		assert.NoError(t, err, "Source must not be moved before it is recorded")
+		return errors.New("journal full")
+	})
+	assert.ErrorContains(t, err, "journal full")
+	_, err = os.Stat(source)
+	assert.NoError(t, err, "Source must stay when the move could not be recorded")
+}
+
+func TestMoveAside(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "move_aside_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ops, err := NewFileOperations(tmpDir)
+	require.NoError(t, err)
+	source := filepath.Join(tmpDir, "report (1).csv")
+	require.NoError(t, os.WriteFile(source, []byte("copy"), 0644))
+
+	var recorded string
+	moved, err := ops.MoveAside(source, "", func(dst, _ string) error {
+		_, err := os.Stat(source)
+		assert.NoError(t, err, "Source must not be moved before it is recorded")
+		recorded = dst
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(tmpDir, DefaultDuplicatesDir, "report (1).csv"), moved)
+	assert.Equal(t, moved, recorded)
+	_, err = os.Stat(source)
+	assert.True(t, os.IsNotExist(err), "Source should have been moved")
+}
+
+func TestTrashFile(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "trash_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dataHome := filepath.Join(tmpDir, "data")
+	t.Setenv("XDG_DATA_HOME", dataHome)
+
+	ops, err := NewFileOperations(tmpDir)
+	require.NoError(t, err)
+
+	first := filepath.Join(tmpDir, "a", "Revenue per AdUnit.csv")
+	second := filepath.Join(tmpDir, "b", "Revenue per AdUnit.csv")
+	for _, file := range []string{first, second} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(file), 0755))
+		require.NoError(t, os.WriteFile(file, []byte(file), 0644))
+	}
+
+	var moved []string
+	for _, file := range []string{first, second} {
+		dst, err := ops.TrashFile(file, nil)
+		require.NoError(t, err)
+		moved = append(moved, dst)
+	}
+
+	trashDir := filepath.Join(dataHome, "Trash")
+	assert.Equal(t, []string{
+		filepath.Join(trashDir, "files", "Revenue per AdUnit.csv"),
+		filepath.Join(trashDir, "files", "Revenue per AdUnit (1).csv"),
+	}, moved)
+
+	infoPath := TrashInfoPath(moved[1])
+	assert.Equal(t, filepath.Join(trashDir, "info", "Revenue per AdUnit (1).csv.trashinfo"), infoPath)
+	info, err := os.ReadFile(infoPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(info), "[Trash Info]\n")
+	assert.Contains(t, string(info), "Path="+strings.ReplaceAll(second, " ", "%20")+"\n")
+	assert.Contains(t, string(info), "DeletionDate=")
+}
+
+func TestFindCompleteFiles(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "filesystem_downloads_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	path := func(name string) string { return filepath.Join(tmpDir, name) }
+
+	old := time.Now().Add(-time.Hour)
+	for _, file := range []string{
+		"AdManager Reporting_2025-01-01.csv",
+		"AdManager Reporting_2025-01-02.csv.crdownload",
+		"AdManager Reporting_2025-01-03.csv",
+		"AdManager Reporting_2025-01-03.csv.part",
+		"AdManager Reporting_2025-01-05.csv",
+	} {
+		require.NoError(t, os.WriteFile(path(file), []byte("Date,Value\n"), 0644))
+		require.NoError(t, os.Chtimes(path(file), old, old))
+	}
+	require.NoError(t, os.Mkdir(path("AdManager Reporting_2025-01-04.csv.download"), 0755))
+
+	ops, err := NewFileOperations(tmpDir)
+	require.NoError(t, err)
+	search := Search{Match: Matcher{Prefix: "AdManager Reporting"}}
+	waiting := search
+	waiting.StableFor = time.Minute
+
+	t.Run("browser downloads", func(t *testing.T) {
+		files, inProgress, err := ops.FindCompleteFiles(search)
+		require.NoError(t, err)
+		assert.Equal(t, []string{path("AdManager Reporting_2025-01-01.csv"), path("AdManager Reporting_2025-01-05.csv")}, files)
+		var names []string
+		for _, p := range inProgress {
+			names = append(names, p.File)
+		}
+		assert.ElementsMatch(t, []string{
+			path("AdManager Reporting_2025-01-02.csv.crdownload"),
+			path("AdManager Reporting_2025-01-03.csv"),
+			path("AdManager Reporting_2025-01-03.csv.part"),
+			path("AdManager Reporting_2025-01-04.csv.download"),
+		}, names)
+
+		found, err := ops.FindFiles(search)
+		require.NoError(t, err)
+		assert.Equal(t, files, found)
+	})
+
+	t.Run("old files do not wait", func(t *testing.T) {
+		ops.sleep = func(time.Duration) { t.Fatal("unexpected wait") }
+		defer func() { ops.sleep = time.Sleep }()
+		files, _, err := ops.FindCompleteFiles(waiting)
+		require.NoError(t, err)
+		assert.Len(t, files, 2)
+	})
+
+	t.Run("growing file", func(t *testing.T) {
+		growing := path("AdManager Reporting_2025-01-05.csv")
+		require.NoError(t, os.WriteFile(growing, []byte("Date,Value\n"), 0644))
+		var waited time.Duration
+		ops.sleep = func(d time.Duration) {
+			waited = d
+			f, err := os.OpenFile(growing, os.O_APPEND|os.O_WRONLY, 0644)
+			require.NoError(t, err)
+			f.WriteString("2025-01-05,100\n")
+			f.Close()
+		}
+		defer func() { ops.sleep = time.Sleep }()
+
+		files, inProgress, err := ops.FindCompleteFiles(waiting)
+		require.NoError(t, err)
+		assert.Positive(t, waited)
+		assert.LessOrEqual(t, waited, time.Minute)
+		assert.Equal(t, []string{path("AdManager Reporting_2025-01-01.csv")}, files)
+		assert.Contains(t, inProgress, InProgress{File: growing, Reason: "still being written"})
+	})
+
+	t.Run("recent file that settled", func(t *testing.T) {
+		ops.sleep = func(time.Duration) {}
+		defer func() { ops.sleep = time.Sleep }()
+		files, _, err := ops.FindCompleteFiles(waiting)
+		require.NoError(t, err)
+		assert.Len(t, files, 2)
+	})
+}
+
+func TestFindFilesInSourceDirs(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "filesystem_sources_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+	path := func(name string) string { return filepath.Join(tmpDir, name) }
+
+	for _, file := range []string{
+		"downloads/Report_1.csv",
+		"downloads/archive/2025-01/Report_0.csv",
+		"downloads/.hidden/Report_9.csv",
+		"mail/Report_2.csv",
+		"mail/2025/Report_3.csv",
+		"mail/2025/01/Report_4.csv",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path(file)), 0755))
+		require.NoError(t, os.WriteFile(path(file), []byte("Date,Value\n"), 0644))
+	}
+
+	ops, err := NewFileOperations(path("downloads"))
+	require.NoError(t, err)
+	match := Matcher{Prefix: "Report"}
+
+	tests := []struct {
+		name   string
+		search Search
+		files  []string
+	}{
+		{
+			name:   "work dir",
+			search: Search{Match: match},
+			files:  []string{"downloads/Report_1.csv"},
+		},
+		{
+			name:   "recursive without skipped and hidden dirs",
+			search: Search{Dirs: []SourceDir{{Recursive: true}}, Match: match, Skip: []string{"archive"}},
+			files:  []string{"downloads/Report_1.csv"},
+		},
+		{
+			name: "several dirs with depth limit",
+			search: Search{Dirs: []SourceDir{
+				{},
+				{Dir: path("mail"), MaxDepth: 1},
+				{Dir: "../mail"},
+			}, Match: match},
+			files: []string{"downloads/Report_1.csv", "mail/2025/Report_3.csv", "mail/Report_2.csv"},
+		},
+		{
+			name:   "unlimited depth",
+			search: Search{Dirs: []SourceDir{{Dir: "../mail", Recursive: true}}, Match: match},
+			files:  []string{"mail/2025/01/Report_4.csv", "mail/2025/Report_3.csv", "mail/Report_2.csv"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := ops.FindFiles(tt.search)
+			require.NoError(t, err)
+			var want []string
+			for _, file := range tt.files {
+				want = append(want, path(file))
+			}
+			assert.Equal(t, want, found)
+		})
+	}
+
+	_, err = ops.FindFiles(Search{Dirs: []SourceDir{{Dir: "missing"}}, Match: match})
+	assert.Error(t, err, "A missing source dir must not look like one without files")
+}
+
+func TestMatcher(t *testing.T) {
+	tests := []struct {
+		name    string
+		matcher Matcher
+		match   []string
+		skip    []string
+	}{
+		{
+			name:    "prefix",
+			matcher: Matcher{Prefix: "Revenue per AdUnit"},
+			match:   []string{"Revenue per AdUnit.csv", "Revenue per AdUnit (1).csv", "Revenue per AdUnit.xlsx"},
+			skip:    []string{"AdManager Reporting_2025-01-01.csv"},
+		},
+		{
+			name:    "glob",
+			matcher: Matcher{Glob: "AdManager Reporting_*.csv"},
+			match:   []string{"AdManager Reporting_2025-01-01.csv"},
+			skip:    []string{"AdManager Reporting_2025-01-01.xlsx", "Old AdManager Reporting_2025-01-01.csv"},
+		},
+		{
+			name:    "regex",
+			matcher: Matcher{Regex: regexp.MustCompile(`^AdManager Reporting_(?P<date>\d{4}-\d{2}-\d{2})\.csv$`)},
+			match:   []string{"AdManager Reporting_2025-01-01.csv"},
+			skip:    []string{"AdManager Reporting_2025-01-01 (1).csv", "AdManager Reporting_latest.csv"},
+		},
+		{
+			name:    "extensions and excludes",
+			matcher: Matcher{Prefix: "Revenue per AdUnit", Extensions: []string{"csv"}, Exclude: []string{"* (*).csv"}},
+			match:   []string{"Revenue per AdUnit.csv", "Revenue per AdUnit.CSV"},
+			skip:    []string{"Revenue per AdUnit (1).csv", "Revenue per AdUnit.xlsx"},
+		},
+		{
+			name:    "compressed extensions",
+			matcher: Matcher{Extensions: []string{".csv.gz", "ZIP"}},
+			match:   []string{"Revenue per AdUnit.csv.gz", "Revenue per AdUnit.CSV.GZ", "Revenue per AdUnit.zip"},
+			skip:    []string{"Revenue per AdUnit.csv", "Revenue per AdUnit.xlsx.gz", "Revenue per AdUnit.gz"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.matcher.Validate())
+			for _, name := range tt.match {
+				assert.True(t, tt.matcher.Match(name), "%s should match", name)
+			}
+			for _, name := range tt.skip {
+				assert.False(t, tt.matcher.Match(name), "%s should not match", name)
+			}
+		})
+	}
+
+	assert.Error(t, Matcher{}.Validate(), "A matcher without conditions would match every file")
+	assert.Error(t, Matcher{Glob: "Report_[.csv"}.Validate())
+	assert.Error(t, Matcher{Prefix: "Report", Exclude: []string{"[a-"}}.Validate())
+}
@@ -0,0 +1,346 @@
+package journal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spossner/ad-reporting-merger/internal/vfs"
+)
+
+const (
+	stateFile  = "journal.json"
+	backupFile = "output.bak"
+	stagingDir = "staged"
+)
+
+// Move records a source file that was moved away while disposing of it.
+type Move struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	TrashInfo string `json:"trash_info,omitempty"`
+}
+
+// State is the persisted record of a transaction. It is rewritten atomically
+// after every step so that an interrupted run can be rolled back.
+type State struct {
+	ID        string    `json:"id"`
+	Started   time.Time `json:"started"`
+	Output    string    `json:"output"`
+	Temp      string    `json:"temp"`
+	HadOutput bool      `json:"had_output"`
+	Committed bool      `json:"committed"` // the temp file replaced the output
+	Moves     []Move    `json:"moves,omitempty"`
+	Completed bool      `json:"completed"` // all sources disposed; only cleanup left
+}
+
+// Transaction processes a single output: the merge is written to a temp file
+// next to the output and renamed over it, and every source file moved while
+// disposing of it is recorded so the previous output and sources can be
+// restored.
+type Transaction struct {
+	fs    vfs.FS
+	dir   string
+	state State
+}
+
+// Begin starts a transaction for output in fsys, keeping its journal below
+// root.
+func Begin(fsys vfs.FS, root, output string) (*Transaction, error) {
+	output, err := filepath.Abs(output)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	id := fmt.Sprintf("%s-%d", now.Format("20060102T150405"), os.Getpid())
+	if err := fsys.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create journal dir: %w", err)
+	}
+	dir, err := vfs.MkdirTemp(fsys, root, id+"-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create journal dir: %w", err)
+	}
+
+	t := &Transaction{
+		fs:  fsys,
+		dir: dir,
+		state: State{
+			ID:      filepath.Base(dir),
+			Started: now,
+			Output:  output,
+			Temp:    filepath.Join(filepath.Dir(output), "."+filepath.Base(output)+"."+filepath.Base(dir)+".tmp"),
+		},
+	}
+
+	// A hard link keeps the previous output alive once the temp file is
+	// renamed over it; copy where links are not supported.
+	err = vfs.Link(fsys, output, t.backupPath())
+	switch {
+	case err == nil:
+		t.state.HadOutput = true
+	case !errors.Is(err, fs.ErrNotExist):
+		fsys.RemoveAll(dir)
+		return nil, fmt.Errorf("unable to back up output: %w", err)
+	}
+
+	if err := t.save(); err != nil {
+		fsys.RemoveAll(dir)
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Transaction) State() State {
+	return t.state
+}
+
+// Dir is the directory holding the journal and backups of the transaction.
+func (t *Transaction) Dir() string {
+	return t.dir
+}
+
+// CreateTemp creates the temp file the merge is written to.
+func (t *Transaction) CreateTemp() (vfs.File, error) {
+	return t.fs.OpenFile(t.state.Temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+// Commit syncs and closes the temp file and atomically renames it over the
+// output.
+func (t *Transaction) Commit(temp vfs.File) error {
+	err := temp.Sync()
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write temp file: %w", err)
+	}
+
+	// Mark the commit before renaming: restoring the backup over an output
+	// that was not replaced yet is harmless, losing track of a replaced one
+	// is not.
+	t.state.Committed = true
+	if err := t.save(); err != nil {
+		return err
+	}
+	if err := t.fs.Rename(t.state.Temp, t.state.Output); err != nil {
+		return fmt.Errorf("unable to replace output: %w", err)
+	}
+	vfs.SyncDir(t.fs, filepath.Dir(t.state.Output))
+	return nil
+}
+
+// Stage moves a source file into the journal instead of deleting it. Staged
+// files are removed together with the journal when the transaction finishes.
+func (t *Transaction) Stage(file string) error {
+	dir := filepath.Join(t.dir, stagingDir, fmt.Sprint(len(t.state.Moves)))
+	if err := t.fs.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	from, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	move := Move{From: from, To: filepath.Join(dir, filepath.Base(file))}
+
+	// Record the move first: the destination is known up front, and recovery
+	// only moves files back that actually reached it.
+	t.state.Moves = append(t.state.Moves, move)
+	if err := t.save(); err != nil {
+		return err
+	}
+	return vfs.Move(t.fs, move.From, move.To)
+}
+
+// RecordMove adds a source file that was moved to dst, e.g. into the archive
+// or the trash.
+func (t *Transaction) RecordMove(file, dst, trashInfo string) error {
+	from, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	t.state.Moves = append(t.state.Moves, Move{From: from, To: dst, TrashInfo: trashInfo})
+	return t.save()
+}
+
+// Finish marks the transaction as completed and removes its journal, backups
+// and staged files. Once State().Completed is set, an error only means that
+// the journal was left behind, which Recover removes.
+func (t *Transaction) Finish() error {
+	t.state.Completed = true
+	if err := t.save(); err != nil {
+		t.state.Completed = false
+		return err
+	}
+	return t.fs.RemoveAll(t.dir)
+}
+
+// Rollback restores the previous output and moves every recorded source file
+// back. The journal is only removed if everything could be restored. A
+// completed transaction is not rolled back, only its journal is removed.
+func (t *Transaction) Rollback() error {
+	if t.state.Completed {
+		return t.fs.RemoveAll(t.dir)
+	}
+	return rollback(t.fs, t.dir, t.state)
+}
+
+// Recover completes or rolls back every transaction left behind in root of
+// fsys by an interrupted run and returns their states. Transactions of
+// another process that is still running, such as a concurrent merge, are left
+// alone.
+func Recover(fsys vfs.FS, root string) ([]State, error) {
+	entries, err := fsys.ReadDir(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var recovered []State
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if running(entry.Name()) {
+			continue
+		}
+		dir := filepath.Join(root, entry.Name())
+		state, err := load(fsys, dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Interrupted before the journal was written: nothing was touched.
+			if err := fsys.RemoveAll(dir); err != nil {
+				return recovered, err
+			}
+			continue
+		}
+		if err != nil {
+			return recovered, fmt.Errorf("unable to read journal %s: %w", dir, err)
+		}
+		if state.Completed {
+			err = fsys.RemoveAll(dir)
+		} else {
+			err = rollback(fsys, dir, state)
+		}
+		if err != nil {
+			return recovered, fmt.Errorf("unable to recover %s: %w", dir, err)
+		}
+		recovered = append(recovered, state)
+	}
+	return recovered, nil
+}
+
+// running reports whether the journal dir was created by another process
+// that is still alive. The dir is named after the time and the PID of the
+// process that began the transaction. Journals of the current process are
+// left behind by an earlier process with the same PID, as Recover runs before
+// any transaction begins.
+func running(name string) bool {
+	fields := strings.SplitN(name, "-", 3)
+	if len(fields) < 3 {
+		return false
+	}
+	pid, err := strconv.Atoi(fields[1])
+	if err != nil || pid <= 0 || pid == os.Getpid() {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// Signal 0 only checks that the process exists; Windows does not support
+	// it but finds live processes only.
+	return !errors.Is(process.Signal(syscall.Signal(0)), os.ErrProcessDone)
+}
+
+func rollback(fsys vfs.FS, dir string, state State) error {
+	var errs []error
+	for i := len(state.Moves) - 1; i >= 0; i-- {
+		move := state.Moves[i]
+		if _, err := fsys.Stat(move.To); errors.Is(err, fs.ErrNotExist) {
+			// The move never happened, only its trash info may have been written
+			if move.TrashInfo != "" {
+				fsys.Remove(move.TrashInfo)
+			}
+			continue
+		}
+		if err := vfs.Move(fsys, move.To, move.From); err != nil {
+			errs = append(errs, fmt.Errorf("unable to restore %s: %w", move.From, err))
+			continue
+		}
+		if move.TrashInfo != "" {
+			fsys.Remove(move.TrashInfo)
+		}
+	}
+
+	if state.Committed {
+		var err error
+		if state.HadOutput {
+			err = vfs.Move(fsys, filepath.Join(dir, backupFile), state.Output)
+		} else {
+			err = fsys.Remove(state.Output)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("unable to restore output: %w", err))
+		}
+	}
+	if err := fsys.Remove(state.Temp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return fsys.RemoveAll(dir)
+}
+
+func (t *Transaction) backupPath() string {
+	return filepath.Join(t.dir, backupFile)
+}
+
+// save writes the state to a temp file and renames it into place so the
+// journal is never left half-written.
+func (t *Transaction) save() error {
+	data, err := json.MarshalIndent(t.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(t.dir, stateFile)
+	f, err := vfs.Create(t.fs, path+".tmp")
+	if err != nil {
+		return fmt.Errorf("unable to write journal: %w", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = t.fs.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write journal: %w", err)
+	}
+	vfs.SyncDir(t.fs, t.dir)
+	return nil
+}
+
+func load(fsys vfs.FS, dir string) (State, error) {
+	var state State
+	data, err := fs.ReadFile(fsys, filepath.Join(dir, stateFile))
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
@@ -0,0 +1,201 @@
+package journal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spossner/ad-reporting-merger/internal/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setup creates a work dir with an existing output and two source files.
+func setup(t *testing.T) (workDir, root, output string, sources []string) {
+	workDir, err := os.MkdirTemp("", "journal_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(workDir) })
+
+	root = filepath.Join(workDir, ".journal")
+	output = filepath.Join(workDir, "raw.csv")
+	require.NoError(t, os.WriteFile(output, []byte("old\n"), 0644))
+
+	for _, name := range []string{"a.csv", "b.csv"} {
+		source := filepath.Join(workDir, name)
+		require.NoError(t, os.WriteFile(source, []byte(name), 0644))
+		sources = append(sources, source)
+	}
+	return workDir, root, output, sources
+}
+
+func commit(t *testing.T, tx *Transaction, content string) {
+	temp, err := tx.CreateTemp()
+	require.NoError(t, err)
+	_, err = io.WriteString(temp, content)
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit(temp))
+}
+
+func assertContent(t *testing.T, file, expected string) {
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(content))
+}
+
+func TestTransaction(t *testing.T) {
+	t.Run("finish", func(t *testing.T) {
+		_, root, output, sources := setup(t)
+
+		tx, err := Begin(vfs.OS{}, root, output)
+		require.NoError(t, err)
+		assert.True(t, tx.State().HadOutput)
+
+		commit(t, tx, "new\n")
+		for _, source := range sources {
+			require.NoError(t, tx.Stage(source))
+		}
+		require.NoError(t, tx.Finish())
+
+		assertContent(t, output, "new\n")
+		for _, source := range sources {
+			_, err := os.Stat(source)
+			assert.True(t, os.IsNotExist(err), "Staged source should be gone")
+		}
+		_, err = os.Stat(tx.Dir())
+		assert.True(t, os.IsNotExist(err), "Journal should be removed")
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		workDir, root, output, sources := setup(t)
+
+		tx, err := Begin(vfs.OS{}, root, output)
+		require.NoError(t, err)
+		commit(t, tx, "new\n")
+		require.NoError(t, tx.Stage(sources[0]))
+
+		archived := filepath.Join(workDir, "archived-b.csv")
+		require.NoError(t, os.Rename(sources[1], archived))
+		require.NoError(t, tx.RecordMove(sources[1], archived, ""))
+
+		require.NoError(t, tx.Rollback())
+
+		assertContent(t, output, "old\n")
+		assertContent(t, sources[0], "a.csv")
+		assertContent(t, sources[1], "b.csv")
+		_, err = os.Stat(tx.Dir())
+		assert.True(t, os.IsNotExist(err), "Journal should be removed")
+	})
+
+	t.Run("rollback without previous output", func(t *testing.T) {
+		_, root, output, _ := setup(t)
+		require.NoError(t, os.Remove(output))
+
+		tx, err := Begin(vfs.OS{}, root, output)
+		require.NoError(t, err)
+		assert.False(t, tx.State().HadOutput)
+		commit(t, tx, "new\n")
+
+		require.NoError(t, tx.Rollback())
+		_, err = os.Stat(output)
+		assert.True(t, os.IsNotExist(err), "Output should be removed")
+	})
+
+	t.Run("rollback before commit", func(t *testing.T) {
+		_, root, output, _ := setup(t)
+
+		tx, err := Begin(vfs.OS{}, root, output)
+		require.NoError(t, err)
+		temp, err := tx.CreateTemp()
+		require.NoError(t, err)
+		io.WriteString(temp, "partial")
+		temp.Close()
+
+		require.NoError(t, tx.Rollback())
+		assertContent(t, output, "old\n")
+		_, err = os.Stat(tx.State().Temp)
+		assert.True(t, os.IsNotExist(err), "Temp file should be removed")
+	})
+}
+
+func TestRecover(t *testing.T) {
+	t.Run("interrupted transaction", func(t *testing.T) {
+		_, root, output, sources := setup(t)
+
+		tx, err := Begin(vfs.OS{}, root, output)
+		require.NoError(t, err)
+		commit(t, tx, "new\n")
+		require.NoError(t, tx.Stage(sources[0]))
+		// simulate a crash: the transaction is neither finished nor rolled back
+
+		recovered, err := Recover(vfs.OS{}, root)
+		require.NoError(t, err)
+		require.Len(t, recovered, 1)
+		assert.Equal(t, output, recovered[0].Output)
+
+		assertContent(t, output, "old\n")
+		assertContent(t, sources[0], "a.csv")
+
+		recovered, err = Recover(vfs.OS{}, root)
+		require.NoError(t, err)
+		assert.Empty(t, recovered, "Nothing should be left to recover")
+	})
+
+	t.Run("completed transaction", func(t *testing.T) {
+		_, root, output, sources := setup(t)
+
+		tx, err := Begin(vfs.OS{}, root, output)
+		require.NoError(t, err)
+		commit(t, tx, "new\n")
+		require.NoError(t, tx.Stage(sources[0]))
+		tx.state.Completed = true
+		require.NoError(t, tx.save())
+
+		recovered, err := Recover(vfs.OS{}, root)
+		require.NoError(t, err)
+		require.Len(t, recovered, 1)
+
+		assertContent(t, output, "new\n")
+		_, err = os.Stat(sources[0])
+		assert.True(t, os.IsNotExist(err), "Completed transaction must not restore sources")
+	})
+
+	t.Run("transaction of another process", func(t *testing.T) {
+		_, root, output, _ := setup(t)
+
+		tx, err := Begin(vfs.OS{}, root, output)
+		require.NoError(t, err)
+		commit(t, tx, "new\n")
+		// Hand the journal to another process by the PID in its name
+		owned := func(pid int) string {
+			name := strings.Replace(filepath.Base(tx.Dir()), fmt.Sprintf("-%d-", os.Getpid()), fmt.Sprintf("-%d-", pid), 1)
+			return filepath.Join(root, name)
+		}
+		require.NoError(t, os.Rename(tx.Dir(), owned(os.Getppid())))
+
+		recovered, err := Recover(vfs.OS{}, root)
+		require.NoError(t, err)
+		assert.Empty(t, recovered, "The transaction of a running process must be left alone")
+		assertContent(t, output, "new\n")
+
+		exited := exec.Command(os.Args[0], "-test.run=^$")
+		require.NoError(t, exited.Run())
+		require.NoError(t, os.Rename(owned(os.Getppid()), owned(exited.Process.Pid)))
+
+		recovered, err = Recover(vfs.OS{}, root)
+		require.NoError(t, err)
+		assert.Len(t, recovered, 1, "The transaction of an exited process is rolled back")
+		assertContent(t, output, "old\n")
+	})
+
+	t.Run("no journal dir", func(t *testing.T) {
+		recovered, err := Recover(vfs.OS{}, filepath.Join(os.TempDir(), "does-not-exist-journal"))
+		require.NoError(t, err)
+		assert.Empty(t, recovered)
+	})
+}
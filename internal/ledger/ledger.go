@@ -0,0 +1,115 @@
+package ledger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spossner/ad-reporting-merger/internal/vfs"
+)
+
+// FileName is the ledger of an output dir, relative to that dir.
+const FileName = ".ad-reporting-merger/ledger.json"
+
+// Entry records a source file that was merged into an output.
+type Entry struct {
+	Hash      string    `json:"hash"` // MD5 of the file content
+	File      string    `json:"file"`
+	Output    string    `json:"output"`
+	FirstDate string    `json:"first_date,omitempty"`
+	LastDate  string    `json:"last_date,omitempty"`
+	Rows      int       `json:"rows"`
+	RunID     string    `json:"run_id"`
+	Merged    time.Time `json:"merged"`
+}
+
+// Query selects ledger entries; empty fields match every entry.
+type Query struct {
+	Output string
+	File   string // substring of the file name
+	Hash   string
+}
+
+func (q Query) matches(e Entry) bool {
+	return (q.Output == "" || e.Output == q.Output) &&
+		(q.File == "" || strings.Contains(filepath.Base(e.File), q.File)) &&
+		(q.Hash == "" || e.Hash == q.Hash)
+}
+
+// Ledger is the history of merged source files, kept as a JSON file.
+type Ledger struct {
+	fs      vfs.FS
+	path    string
+	entries []Entry
+}
+
+// Path returns the ledger kept next to output.
+func Path(output string) string {
+	return filepath.Join(filepath.Dir(output), FileName)
+}
+
+// Open reads the ledger at path in fsys. A missing ledger is empty.
+func Open(fsys vfs.FS, path string) (*Ledger, error) {
+	l := &Ledger{fs: fsys, path: path}
+	data, err := fs.ReadFile(fsys, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ledger: %w", err)
+	}
+	if err := json.Unmarshal(data, &l.entries); err != nil {
+		return nil, fmt.Errorf("unable to parse ledger %s: %w", path, err)
+	}
+	return l, nil
+}
+
+// Find returns the entries matching q in the order they were added.
+func (l *Ledger) Find(q Query) []Entry {
+	var entries []Entry
+	for _, e := range l.entries {
+		if q.matches(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Lookup returns the first entry of a file with the given content hash that
+// was merged into output.
+func (l *Ledger) Lookup(output, hash string) (Entry, bool) {
+	for _, e := range l.entries {
+		if e.Output == output && e.Hash == hash {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+func (l *Ledger) Add(entries ...Entry) {
+	l.entries = append(l.entries, entries...)
+}
+
+// Save writes the ledger to a temp file and renames it into place so it is
+// never left half-written.
+func (l *Ledger) Save() error {
+	data, err := json.MarshalIndent(l.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := l.fs.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return fmt.Errorf("unable to write ledger: %w", err)
+	}
+	temp := l.path + ".tmp"
+	if err := vfs.WriteFile(l.fs, temp, data, 0644); err != nil {
+		return fmt.Errorf("unable to write ledger: %w", err)
+	}
+	if err := l.fs.Rename(temp, l.path); err != nil {
+		return fmt.Errorf("unable to write ledger: %w", err)
+	}
+	return nil
+}
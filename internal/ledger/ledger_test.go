@@ -0,0 +1,57 @@
+package ledger
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spossner/ad-reporting-merger/internal/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLedger(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "ledger_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	path := Path(filepath.Join(tmpDir, "raw.csv"))
+	assert.Equal(t, filepath.Join(tmpDir, ".ad-reporting-merger", "ledger.json"), path)
+
+	l, err := Open(vfs.OS{}, path)
+	require.NoError(t, err)
+	assert.Empty(t, l.Find(Query{}))
+
+	merged := time.Date(2025, 1, 4, 8, 0, 0, 0, time.UTC)
+	l.Add(
+		Entry{Hash: "a", File: "AdManager Reporting_2025-01-01.csv", Output: "raw.csv", FirstDate: "2025-01-01", LastDate: "2025-01-01", Rows: 3, RunID: "run1", Merged: merged},
+		Entry{Hash: "b", File: "Revenue per AdUnit_2025-01-01.csv", Output: "raw-revenue.csv", Rows: 2, RunID: "run1", Merged: merged},
+	)
+	require.NoError(t, l.Save())
+
+	l, err = Open(vfs.OS{}, path)
+	require.NoError(t, err)
+	assert.Len(t, l.Find(Query{}), 2)
+
+	entries := l.Find(Query{Output: "raw.csv"})
+	require.Len(t, entries, 1)
+	assert.Equal(t, "AdManager Reporting_2025-01-01.csv", entries[0].File)
+	assert.Equal(t, 3, entries[0].Rows)
+	assert.True(t, merged.Equal(entries[0].Merged))
+
+	assert.Len(t, l.Find(Query{File: "Revenue"}), 1)
+	assert.Empty(t, l.Find(Query{Output: "raw.csv", File: "Revenue"}))
+
+	entry, ok := l.Lookup("raw.csv", "a")
+	assert.True(t, ok)
+	assert.Equal(t, "run1", entry.RunID)
+	_, ok = l.Lookup("raw-revenue.csv", "a")
+	assert.False(t, ok, "Lookup must only match entries of the output")
+
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0644))
+	_, err = Open(vfs.OS{}, path)
+	assert.Error(t, err)
+}
@@ -0,0 +1,89 @@
+package merger
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ColumnMode decides how the columns of the files are lined up in the output.
+type ColumnMode string
+
+const (
+	ColumnsPositional ColumnMode = "positional" // copy rows as they are
+	ColumnsUnion      ColumnMode = "union"      // map columns by header name, write the union of all columns
+)
+
+// ParseColumnMode validates a column mode; the empty string means positional.
+func ParseColumnMode(s string) (ColumnMode, error) {
+	switch c := ColumnMode(s); c {
+	case "":
+		return ColumnsPositional, nil
+	case ColumnsPositional, ColumnsUnion:
+		return c, nil
+	}
+	return "", fmt.Errorf("unknown column mode %q", s)
+}
+
+// columnAware reports whether rows are mapped by header name, which is the
+// case in union mode and whenever the output columns are pinned.
+func (m *CSVMerger) columnAware() bool {
+	return m.opts.Columns == ColumnsUnion || len(m.opts.ColumnOrder) > 0
+}
+
+// outputColumns returns the pinned columns, or the union of all headers in
+// order of first appearance so the existing order stays stable.
+func (m *CSVMerger) outputColumns(headers ...[]string) []string {
+	if len(m.opts.ColumnOrder) > 0 {
+		return m.opts.ColumnOrder
+	}
+	var columns []string
+	seen := make(map[string]bool)
+	for _, header := range headers {
+		for _, column := range header {
+			column = strings.TrimSpace(column)
+			if !seen[column] {
+				seen[column] = true
+				columns = append(columns, column)
+			}
+		}
+	}
+	return columns
+}
+
+// readColumns returns the header of every file.
+func (m *CSVMerger) readColumns(files []string) ([][]string, error) {
+	headers := make([][]string, len(files))
+	for i, file := range files {
+		header, err := m.readHeader(file)
+		if err != nil {
+			return nil, err
+		}
+		headers[i] = header
+	}
+	return headers, nil
+}
+
+// columnMapping returns for every output column its index in header, or -1
+// if the file does not have it.
+func columnMapping(header, columns []string) []int {
+	mapping := make([]int, len(columns))
+	for i, column := range columns {
+		mapping[i] = slices.IndexFunc(header, func(h string) bool {
+			return strings.TrimSpace(h) == column
+		})
+	}
+	return mapping
+}
+
+func (m *CSVMerger) remap(record []string, mapping []int) []string {
+	out := make([]string, len(mapping))
+	for i, j := range mapping {
+		if j >= 0 && j < len(record) {
+			out[i] = record[j]
+		} else {
+			out[i] = m.opts.Fill
+		}
+	}
+	return out
+}
@@ -0,0 +1,75 @@
+package merger
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDateLayouts are used when a group does not configure any.
+var DefaultDateLayouts = []string{time.DateOnly}
+
+// row is a data record with its parsed date.
+type row struct {
+	record []string
+	date   time.Time
+	line   int // line of the row in its file, if known
+}
+
+// day identifies the calendar day of a row; restatements and overlaps are
+// decided per day.
+func day(t time.Time) string {
+	return t.Format(time.DateOnly)
+}
+
+// dateIndex returns the index of the date column in header: the configured
+// column, or the first column by default.
+func (m *CSVMerger) dateIndex(header []string) (int, error) {
+	if strings.TrimSpace(m.opts.DateColumn) == "" {
+		return 0, nil
+	}
+	i, err := columnIndex(header, m.opts.DateColumn)
+	if err != nil {
+		return 0, fmt.Errorf("date %w", err)
+	}
+	return i, nil
+}
+
+// columnIndex finds a column in header by name or 1-based position.
+func columnIndex(header []string, column string) (int, error) {
+	column = strings.TrimSpace(column)
+	if i := slices.IndexFunc(header, func(h string) bool {
+		return strings.TrimSpace(h) == column
+	}); i >= 0 {
+		return i, nil
+	}
+	if n, err := strconv.Atoi(column); err == nil && n >= 1 {
+		return n - 1, nil
+	}
+	return 0, fmt.Errorf("column %q not found in header", column)
+}
+
+// dateOf parses the date in the given column of record.
+func (m *CSVMerger) dateOf(record []string, index int) (time.Time, error) {
+	if index >= len(record) {
+		return time.Time{}, fmt.Errorf("row has no date in column %d", index+1)
+	}
+	return m.parseDate(record[index])
+}
+
+// parseDate tries the configured layouts in order.
+func (m *CSVMerger) parseDate(value string) (time.Time, error) {
+	layouts := m.opts.DateLayouts
+	if len(layouts) == 0 {
+		layouts = DefaultDateLayouts
+	}
+	value = strings.TrimSpace(value)
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unable to parse date %q with layouts %s", value, strings.Join(layouts, ", "))
+}
@@ -0,0 +1,136 @@
+package merger
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+)
+
+// Dedupe decides which row is kept when rows of the files share the same
+// dedupe key but differ in their other values.
+type Dedupe string
+
+const (
+	DedupeFirstWins Dedupe = "first-wins"        // keep the row of the earliest file
+	DedupeLastWins  Dedupe = "last-wins"         // keep the row of the latest file
+	DedupeError     Dedupe = "error-on-conflict" // fail the merge
+)
+
+// ParseDedupe validates a dedupe policy; the empty string means first-wins.
+func ParseDedupe(s string) (Dedupe, error) {
+	switch d := Dedupe(s); d {
+	case "":
+		return DedupeFirstWins, nil
+	case DedupeFirstWins, DedupeLastWins, DedupeError:
+		return d, nil
+	}
+	return "", fmt.Errorf("unknown dedupe policy %q", s)
+}
+
+// rowRef identifies a data row by the index of its file in merge order and
+// its index among the data rows of that file.
+type rowRef struct {
+	file, row int
+}
+
+// keyIndexes resolves key columns against header by name or 1-based position.
+func keyIndexes(header, keys []string) ([]int, error) {
+	indexes := make([]int, len(keys))
+	for i, key := range keys {
+		var err error
+		if indexes[i], err = columnIndex(header, key); err != nil {
+			return nil, err
+		}
+	}
+	return indexes, nil
+}
+
+// keptRow is the row currently kept for a dedupe key.
+type keptRow struct {
+	ref  rowRef
+	file string
+	line int
+	sum  string // hash of all values of the row
+}
+
+// dedupe finds the rows of the files that share a dedupe key with a row kept
+// before them, ignoring rows dropped in favour of a restatement. Rows whose
+// values are all equal are duplicates; the others conflict and are resolved by
+// the dedupe policy. It returns the rows to drop and the number of duplicate
+// and conflicting rows among them.
+func (m *CSVMerger) dedupe(files, header, columns []string, winners map[string]string) (map[rowRef]bool, int, int, error) {
+	if len(m.opts.DedupeKeys) == 0 {
+		return nil, 0, 0, nil
+	}
+	keys, err := keyIndexes(header, m.opts.DedupeKeys)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("dedupe key: %w", err)
+	}
+	dateIndex, err := m.dateIndex(header)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	dropped := make(map[rowRef]bool)
+	kept := make(map[string]keptRow)
+	var duplicates, conflicts int
+	for i, file := range files {
+		index := 0
+		_, err := m.eachDataRow(file, columns, func(r row) error {
+			ref := rowRef{file: i, row: index}
+			index++
+			if winner, ok := winners[day(r.date)]; ok && winner != file {
+				return nil
+			}
+
+			key := dedupeKey(r, keys, dateIndex)
+			current := keptRow{ref: ref, file: file, line: r.line, sum: rowSum(r.record)}
+			previous, ok := kept[key]
+			switch {
+			case !ok:
+				kept[key] = current
+			case previous.sum == current.sum:
+				dropped[ref] = true
+				duplicates++
+			case m.opts.Dedupe == DedupeError:
+				return fmt.Errorf("rows for %s conflict: %s:%d and %s:%d",
+					strings.ReplaceAll(key, "\x00", ", "), previous.file, previous.line, file, r.line)
+			case m.opts.Dedupe == DedupeLastWins:
+				dropped[previous.ref] = true
+				kept[key] = current
+				conflicts++
+			default:
+				dropped[ref] = true
+				conflicts++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	return dropped, duplicates, conflicts, nil
+}
+
+// dedupeKey joins the key values of a row. The date column is compared by
+// its parsed date.
+func dedupeKey(r row, keys []int, dateIndex int) string {
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		if key == dateIndex {
+			values[i] = r.date.Format(time.RFC3339Nano)
+		} else {
+			values[i] = strings.TrimSpace(field(r.record, key))
+		}
+	}
+	return strings.Join(values, "\x00")
+}
+
+// rowSum hashes all values of a row so that only the hash has to be kept per
+// key.
+func rowSum(record []string) string {
+	h := fnv.New128a()
+	h.Write([]byte(rowKey(record)))
+	return string(h.Sum(nil))
+}
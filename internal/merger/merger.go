@@ -1,88 +1,1077 @@
 package merger
 
 import (
-	"bufio"
 	"encoding/csv"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/spossner/ad-reporting-merger/internal/decode"
+	"github.com/spossner/ad-reporting-merger/internal/vfs"
 )
 
-type CSVMerger struct{}
+type CSVMerger struct {
+	opts Options
+}
+
+// Options configure a CSVMerger. The zero value concatenates the files and
+// rejects dates already present when appending.
+type Options struct {
+	Header      HeaderPolicy
+	Overlap     Overlap
+	Restatement Restatement
+	Columns     ColumnMode
+	ColumnOrder []string // pinned output columns; implies column-aware merging
+	Fill        string   // value written for columns a file does not have
+	Delimiter   rune     // field delimiter of inputs and output; a comma if zero
+	DateColumn  string   // name or 1-based position of the date column; the first column if empty
+	DateLayouts []string // time layouts tried in order; DefaultDateLayouts if empty
+	SortKeys    []string // columns to sort all rows by; rows keep the order of their files if empty
+	DedupeKeys  []string // columns identifying a row; rows are not deduplicated if empty
+	Dedupe      Dedupe
+
+	// NameDate captures the date of a file from its name in a group named
+	// "date"; it dates files that have no data rows.
+	NameDate *regexp.Regexp
+
+	// ColumnTypes normalises the numbers of metric columns, given by name or
+	// 1-based position, read as written in Locale; English if zero.
+	ColumnTypes map[string]ColumnType
+	Locale      Locale
+
+	// HeaderPattern skips the preamble of every input up to the first line it
+	// matches, FooterPattern the first data row it matches and all after it,
+	// such as a totals row. Lines are matched with their fields joined by
+	// commas.
+	HeaderPattern *regexp.Regexp
+	FooterPattern *regexp.Regexp
+
+	// SniffDelimiter reads every input in the delimiter and quote told from
+	// its first lines, falling back to Delimiter where they cannot be told.
+	SniffDelimiter  bool
+	OutputDelimiter rune // field delimiter of the output; Delimiter if zero
+
+	// Encoding is the character encoding of the output, Fallback that of
+	// inputs without a byte order mark that are not valid UTF-8.
+	Encoding decode.Encoding
+	Fallback decode.Encoding
+
+	SortChunkRows int    // rows sorted in memory before spilling; DefaultSortChunkRows if zero
+	SortTempDir   string // where sorted chunks are spilled; the default temp dir if empty
+
+	// DryRun only computes the result: the rows are not sorted by SortKeys,
+	// so no sorted chunks are spilled.
+	DryRun bool
+
+	// FS holds the files, the output and the sorted chunks; the OS file
+	// system if nil.
+	FS vfs.FS
+}
+
+// FileDate pairs a file with the first date found in its data rows.
+type FileDate struct {
+	File string
+	Date string // day of the first data row, or of the date in the name if it has none
+	Time time.Time
+	Err  error // the file could not be read or its first date not parsed
+}
+
+// ParseDelimiter validates a field delimiter; the empty string means a comma
+// and "tab" a tab.
+func ParseDelimiter(s string) (rune, error) {
+	switch s {
+	case "":
+		return ',', nil
+	case "tab", `\t`:
+		return '\t', nil
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	if size != len(s) || r == utf8.RuneError || r == '"' || r == '\r' || r == '\n' {
+		return 0, fmt.Errorf("invalid delimiter %q", s)
+	}
+	return r, nil
+}
+
+// HeaderPolicy decides whether the output starts with the common header and
+// what happens when the header of a file differs from the first file's.
+type HeaderPolicy string
+
+const (
+	HeaderStrict HeaderPolicy = "strict" // write the header, fail on differing headers
+	HeaderWrite  HeaderPolicy = "write"  // write the header, report differing headers
+	HeaderOmit   HeaderPolicy = "omit"   // no header row, report differing headers
+)
+
+// ParseHeaderPolicy validates a header policy; the empty string means strict.
+func ParseHeaderPolicy(s string) (HeaderPolicy, error) {
+	switch h := HeaderPolicy(s); h {
+	case "":
+		return HeaderStrict, nil
+	case HeaderStrict, HeaderWrite, HeaderOmit:
+		return h, nil
+	}
+	return "", fmt.Errorf("unknown header policy %q", s)
+}
+
+func (h HeaderPolicy) writes() bool {
+	return h != HeaderOmit
+}
+
+func (h HeaderPolicy) strict() bool {
+	return h == HeaderStrict || h == ""
+}
+
+// HeaderMismatch describes a file whose header differs from the first file's.
+type HeaderMismatch struct {
+	File string
+	Diff string
+}
+
+// Skipped counts the lines of a file that are not part of its report: the
+// preamble before the header and the footer from the first totals row.
+type Skipped struct {
+	File     string
+	Preamble int
+	Footer   int
+}
+
+// DialectMismatch describes a file, or member of a zip archive, whose
+// delimiter or quote as told from its first lines differs from the
+// configured one, or when sniffing from the first file's.
+type DialectMismatch struct {
+	File     string
+	Found    decode.Dialect
+	Expected decode.Dialect
+}
+
+// Overlap decides what Append does with dates that are already present in
+// the existing output.
+type Overlap string
+
+const (
+	OverlapReject  Overlap = "reject"
+	OverlapReplace Overlap = "replace"
+)
+
+// ParseOverlap validates an overlap policy; the empty string means reject.
+func ParseOverlap(s string) (Overlap, error) {
+	switch o := Overlap(s); o {
+	case "":
+		return OverlapReject, nil
+	case OverlapReject, OverlapReplace:
+		return o, nil
+	}
+	return "", fmt.Errorf("unknown overlap policy %q", s)
+}
+
+// Restatement decides which file's rows are kept when several files (or a
+// file and the existing output) contain the same date.
+type Restatement string
+
+const (
+	RestatementNone   Restatement = "none"   // keep the rows of every file
+	RestatementMtime  Restatement = "mtime"  // keep the most recently modified file
+	RestatementSuffix Restatement = "suffix" // keep the highest copy suffix, e.g. "(2)"
+)
+
+// ParseRestatement validates a restatement policy; the empty string means none.
+func ParseRestatement(s string) (Restatement, error) {
+	switch r := Restatement(s); r {
+	case "":
+		return RestatementNone, nil
+	case RestatementNone, RestatementMtime, RestatementSuffix:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown restatement policy %q", s)
+}
+
+// RestatedDate records which file won a date that was exported more than
+// once.
+type RestatedDate struct {
+	Date    string
+	Kept    string
+	Dropped []string
+}
+
+// MergeResult describes the outcome of a merge.
+type MergeResult struct {
+	Header        []string // header of the first file
+	Files         []string // merge order
+	Dates         []string // first day of each file as in FileDate
+	LastDates     []string // last day of each file, empty if it has no rows
+	RowsPerFile   []int
+	Rows          int      // data rows taken from the files
+	ExistingRows  int      // rows of the existing output when appending
+	ReplacedRows  int      // existing rows replaced by rows of the files
+	ReplacedDates []string // dates whose existing rows were replaced
+	DroppedRows   int      // rows of the files dropped in favour of a restatement
+	Restated      []RestatedDate
+	// Files whose header differs from the first file's, unless the policy is strict
+	HeaderMismatches []HeaderMismatch
+	// Files that look delimited or quoted differently
+	DialectMismatches []DialectMismatch
+	// Files with a preamble or footer that was skipped
+	Skipped []Skipped
+	// Rows of the files dropped by the dedupe: identical to a kept row, or
+	// sharing its key with different values
+	DuplicateRows   int
+	ConflictingRows int
+}
+
+// Verification summarises how an existing output relates to its sources.
+type Verification struct {
+	OutputRows int
+	Unsorted   []int          // output line numbers whose date is earlier than the previous row's
+	Missing    map[string]int // source file -> data rows not found in the output
+}
+
+func (v *Verification) OK() bool {
+	return len(v.Unsorted) == 0 && len(v.Missing) == 0
+}
 
 func NewCSVMerger() *CSVMerger {
 	return &CSVMerger{}
 }
 
-func (m *CSVMerger) MergeFiles(files []string, output string) ([]string, error) {
+func NewCSVMergerWithOptions(opts Options) *CSVMerger {
+	return &CSVMerger{opts: opts}
+}
+
+// MergeFiles merges the files into the output file, replacing it.
+func (m *CSVMerger) MergeFiles(files []string, output string) (*MergeResult, error) {
 	if len(files) == 0 {
 		return nil, fmt.Errorf("no files to merge")
 	}
 
-	// Sort files by the first date in each file
-	sort.Slice(files, func(i, j int) bool {
-		dateI := m.readFirstDate(files[i])
-		dateJ := m.readFirstDate(files[j])
-		return dateI < dateJ
-	})
-
-	out, err := os.Create(output)
+	out, err := vfs.Create(m.fsys(), output)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create output file: %w", err)
 	}
 	defer out.Close()
 
-	writer := bufio.NewWriter(out)
-	defer writer.Flush()
+	return m.Merge(files, out)
+}
 
-	dates := make([]string, 0, len(files))
+// Merge writes the data rows of all files to w, ordered by the first date of
+// each file. Merging into io.Discard computes the result without writing.
+func (m *CSVMerger) Merge(files []string, w io.Writer) (*MergeResult, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files to merge")
+	}
+	dialects, err := m.checkDialects(files)
+	if err != nil {
+		return nil, err
+	}
+	dates, err := m.sortFiles(files)
+	if err != nil {
+		return nil, dialectHint(err, dialects)
+	}
+	header, columns, mismatches, err := m.layout(files, nil)
+	if err != nil {
+		return nil, dialectHint(err, dialects)
+	}
+	winners, restated, err := m.restate(files, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := m.newWriter(w)
+	if m.opts.Header.writes() {
+		writer.Write(header)
+	}
+	emit := func(r row) error {
+		return writer.Write(r.record)
+	}
+	var sorter *rowSorter
+	if len(m.opts.SortKeys) > 0 && m.opts.DryRun {
+		// Sort keys are checked, but rows that are not written need no order
+		if _, err := m.rowOrder(header); err != nil {
+			return nil, err
+		}
+	} else if len(m.opts.SortKeys) > 0 {
+		if sorter, err = m.newSorter(header); err != nil {
+			return nil, err
+		}
+		defer sorter.close()
+		emit = sorter.add
+	}
+	result, err := m.eachRow(files, header, columns, winners, emit)
+	if err != nil {
+		return nil, err
+	}
+	if sorter != nil {
+		if err := sorter.writeTo(writer); err != nil {
+			return nil, fmt.Errorf("unable to sort rows: %w", err)
+		}
+	}
+	result.Dates = dates
+	result.Header = header
+	result.HeaderMismatches = mismatches
+	result.DialectMismatches = dialects
+	result.Restated = restated
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return nil, fmt.Errorf("unable to write output: %w", err)
+	}
+	return result, nil
+}
+
+// Append merges the files into the rows of the existing output and writes the
+// combined rows to w in chronological order. A missing existing output is
+// treated as empty. Dates of the new files that are already present in the
+// existing output are resolved by the restatement policy if there is one and
+// by the overlap policy otherwise.
+func (m *CSVMerger) Append(files []string, existing string, w io.Writer) (*MergeResult, error) {
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files to merge")
+	}
+	dialects, err := m.checkDialects(files)
+	if err != nil {
+		return nil, err
+	}
+	dates, err := m.sortFiles(files)
+	if err != nil {
+		return nil, dialectHint(err, dialects)
+	}
+	firstHeader, err := m.readHeader(files[0])
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := m.readRecords(existing)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read existing output: %w", err)
+	}
+	// Outputs written without a header start with a data row
+	var existingHeader []string
+	if len(previous) > 0 && looksLikeHeader(previous[0], firstHeader) {
+		existingHeader, previous = previous[0], previous[1:]
+	} else if len(previous) > 0 && m.columnAware() {
+		return nil, fmt.Errorf("existing output %s has no header to map its columns", existing)
+	}
+
+	header, columns, mismatches, err := m.layout(files, existingHeader)
+	if err != nil {
+		return nil, dialectHint(err, dialects)
+	}
+	dateHeader := firstHeader
+	if columns != nil {
+		dateHeader = columns
+	} else if existingHeader != nil {
+		dateHeader = existingHeader
+	}
+	index, err := m.dateIndex(dateHeader)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", existing, err)
+	}
+	compare, err := m.rowOrder(header)
+	if err != nil {
+		return nil, err
+	}
+	if columns != nil && existingHeader != nil {
+		mapping := columnMapping(existingHeader, columns)
+		for i, record := range previous {
+			previous[i] = m.remap(record, mapping)
+		}
+	} else if existingHeader != nil {
+		if diff := diffHeaders(header, existingHeader); diff != "" {
+			if m.opts.Header.strict() {
+				return nil, fmt.Errorf("header of %s differs from %s: %s", existing, files[0], diff)
+			}
+			mismatches = append(mismatches, HeaderMismatch{File: existing, Diff: diff})
+		}
+	}
+
+	existingRows := make([]row, len(previous))
+	existingDates := make(map[string]bool)
+	for i, record := range previous {
+		date, err := m.dateOf(record, index)
+		if err != nil {
+			return nil, fmt.Errorf("%s: row %d: %w", existing, i+1, err)
+		}
+		existingRows[i] = row{record: record, date: date}
+		existingDates[day(date)] = true
+	}
+
+	winners, restated, err := m.restate(files, existing, existingDates)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []row
+	result, err := m.eachRow(files, header, columns, winners, func(r row) error {
+		rows = append(rows, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Dates = dates
+	result.Header = header
+	result.HeaderMismatches = mismatches
+	result.DialectMismatches = dialects
+	result.Restated = restated
+	result.ExistingRows = len(previous)
+
+	newDates := make(map[string]bool)
+	for _, r := range rows {
+		newDates[day(r.date)] = true
+	}
+
+	kept := make([]row, 0, len(previous)+len(rows))
+	replaced := make(map[string]bool)
+	for _, r := range existingRows {
+		date := day(r.date)
+		winner, restatedDate := winners[date]
+		if !newDates[date] || winner == existing {
+			kept = append(kept, r)
+			continue
+		}
+		if !restatedDate && m.opts.Overlap != OverlapReplace {
+			return nil, fmt.Errorf("date %s is already present in %s", date, existing)
+		}
+		if !replaced[date] {
+			replaced[date] = true
+			result.ReplacedDates = append(result.ReplacedDates, date)
+		}
+		result.ReplacedRows++
+	}
+
+	// Existing rows come first so the order within a date is preserved. The
+	// existing output is held in memory anyway, so the rows are sorted there.
+	kept = append(kept, rows...)
+	slices.SortStableFunc(kept, compare)
+	sort.Strings(result.ReplacedDates)
+
+	writer := m.newWriter(w)
+	if m.opts.Header.writes() {
+		writer.Write(header)
+	}
+	for _, r := range kept {
+		writer.Write(r.record)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return nil, fmt.Errorf("unable to write output: %w", err)
+	}
+	return result, nil
+}
+
+// layout determines the header of the output. Column-aware merges write the
+// output columns, starting with those of the existing output if there is one;
+// otherwise the header of the first file is used and the other headers have
+// to match it.
+func (m *CSVMerger) layout(files []string, existingHeader []string) ([]string, []string, []HeaderMismatch, error) {
+	if !m.columnAware() {
+		header, mismatches, err := m.checkHeaders(files)
+		return header, nil, mismatches, err
+	}
+	headers, err := m.readColumns(files)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	columns := m.outputColumns(append([][]string{existingHeader}, headers...)...)
+	return columns, columns, nil, nil
+}
+
+// sortFiles sorts the files in place by the first date in each file and
+// returns these dates.
+func (m *CSVMerger) sortFiles(files []string) ([]string, error) {
+	dates := make([]string, len(files))
+	for i, fd := range m.SortByDate(files) {
+		if fd.Err != nil {
+			return nil, fd.Err
+		}
+		files[i] = fd.File
+		dates[i] = fd.Date
+	}
+	return dates, nil
+}
+
+// checkHeaders returns the header of the first file and compares the headers
+// of all other files with it.
+func (m *CSVMerger) checkHeaders(files []string) ([]string, []HeaderMismatch, error) {
+	var header []string
+	var mismatches []HeaderMismatch
+	for i, file := range files {
+		columns, err := m.readHeader(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		if i == 0 {
+			header = columns
+			continue
+		}
+		diff := diffHeaders(header, columns)
+		if diff == "" {
+			continue
+		}
+		if m.opts.Header.strict() {
+			return nil, nil, fmt.Errorf("header of %s differs from %s: %s", file, files[0], diff)
+		}
+		mismatches = append(mismatches, HeaderMismatch{File: file, Diff: diff})
+	}
+	return header, mismatches, nil
+}
+
+// checkDialects compares the dialect told from the first lines of every CSV
+// part of the files with the configured one, or when sniffing with the first
+// part's.
+func (m *CSVMerger) checkDialects(files []string) ([]DialectMismatch, error) {
+	expected := decode.Dialect{Comma: m.delimiter(), Quote: '"'}
+	first := m.opts.SniffDelimiter
+	var mismatches []DialectMismatch
 	for _, file := range files {
-		f, err := os.Open(file)
+		f, err := decode.Open(m.fsys(), file, m.inputOptions())
 		if err != nil {
 			return nil, fmt.Errorf("unable to open file %s: %w", file, err)
 		}
-
-		scanner := bufio.NewScanner(f)
-		var line int
-		for scanner.Scan() {
-			line++
-			if line == 1 {
-				continue // skip header
+		for {
+			part, r, err := f.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, err
 			}
-			row := scanner.Text()
-			if line == 2 {
-				dates = append(dates, row[:10]) // track first 10 characters of the second row as date
+			if _, err := r.Read(); err != nil && !errors.Is(err, io.EOF) {
+				f.Close()
+				return nil, readError(part, err)
+			}
+			found, ok := r.Sniffed()
+			switch {
+			case !ok:
+			case first:
+				expected, first = found, false
+			case found != expected:
+				mismatches = append(mismatches, DialectMismatch{File: part, Found: found, Expected: expected})
 			}
-			writer.WriteString(row + "\n")
 		}
 		f.Close()
+	}
+	return mismatches, nil
+}
+
+// dialectHint adds the first dialect mismatch to err: a file read with the
+// wrong delimiter usually fails on its header or first date.
+func dialectHint(err error, dialects []DialectMismatch) error {
+	if len(dialects) == 0 {
+		return err
+	}
+	d := dialects[0]
+	return fmt.Errorf("%w (%s looks like %s, expected %s)", err, d.File, d.Found, d.Expected)
+}
 
-		if err := scanner.Err(); err != nil {
-			return nil, fmt.Errorf("error reading file %s: %w", file, err)
+// diffHeaders describes how got differs from expected column by column, or
+// returns the empty string if they are the same.
+func diffHeaders(expected, got []string) string {
+	var diffs []string
+	for i := 0; i < max(len(expected), len(got)); i++ {
+		switch {
+		case i >= len(got):
+			diffs = append(diffs, fmt.Sprintf("column %d %q missing", i+1, expected[i]))
+		case i >= len(expected):
+			diffs = append(diffs, fmt.Sprintf("column %d %q unexpected", i+1, got[i]))
+		case strings.TrimSpace(expected[i]) != strings.TrimSpace(got[i]):
+			diffs = append(diffs, fmt.Sprintf("column %d is %q instead of %q", i+1, got[i], expected[i]))
 		}
 	}
+	return strings.Join(diffs, "; ")
+}
 
-	return dates, nil
+// looksLikeHeader reports whether record is a header rather than a data row,
+// i.e. whether it starts with the same column name as header.
+func looksLikeHeader(record, header []string) bool {
+	return strings.TrimSpace(record[0]) == strings.TrimSpace(header[0])
+}
+
+func (m *CSVMerger) newWriter(w io.Writer) *csv.Writer {
+	writer := csv.NewWriter(decode.NewWriter(w, m.opts.Encoding))
+	writer.Comma = m.outputDelimiter()
+	return writer
 }
 
-func (m *CSVMerger) readFirstDate(file string) string {
-	f, err := os.Open(file)
+func (m *CSVMerger) fsys() vfs.FS {
+	if m.opts.FS == nil {
+		return vfs.OS{}
+	}
+	return m.opts.FS
+}
+
+func (m *CSVMerger) delimiter() rune {
+	if m.opts.Delimiter == 0 {
+		return ','
+	}
+	return m.opts.Delimiter
+}
+
+func (m *CSVMerger) outputDelimiter() rune {
+	if m.opts.OutputDelimiter == 0 {
+		return m.delimiter()
+	}
+	return m.opts.OutputDelimiter
+}
+
+// inputOptions are how the files are read.
+func (m *CSVMerger) inputOptions() decode.Options {
+	return decode.Options{
+		Comma:    m.delimiter(),
+		Sniff:    m.opts.SniffDelimiter,
+		Fallback: m.opts.Fallback,
+		Header:   m.opts.HeaderPattern,
+		Footer:   m.opts.FooterPattern,
+	}
+}
+
+// outputOptions are how an existing output is read: in the delimiter it was
+// written with and, when it is not Unicode, in the output encoding if that is
+// a legacy one.
+func (m *CSVMerger) outputOptions() decode.Options {
+	opts := decode.Options{Comma: m.outputDelimiter(), Fallback: m.opts.Fallback}
+	if m.opts.Encoding.Legacy() {
+		opts.Fallback = m.opts.Encoding
+	}
+	return opts
+}
+
+// eachRecord calls fn with every record of the file, including the header,
+// and the line the record starts on. Gzipped files, the CSV members of zip
+// archives and xlsx worksheets are decoded; the header repeated by every
+// member of a zip archive is only passed once. It returns the lines skipped
+// before the header and after the footer of every part.
+func (m *CSVMerger) eachRecord(file string, opts decode.Options, fn func(line int, record []string) error) (Skipped, error) {
+	skipped := Skipped{File: file}
+	f, err := decode.Open(m.fsys(), file, opts)
 	if err != nil {
-		return ""
+		return skipped, fmt.Errorf("unable to open file %s: %w", file, err)
 	}
 	defer f.Close()
 
-	r := csv.NewReader(f)
+	var header []string
+	for {
+		part, r, err := f.Next()
+		if errors.Is(err, io.EOF) {
+			return skipped, nil
+		}
+		if err != nil {
+			return skipped, err
+		}
+		for first := true; ; first = false {
+			record, err := r.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return skipped, readError(part, err)
+			}
+			if first && header != nil && slices.Equal(record, header) {
+				continue
+			}
+			if header == nil {
+				header = record
+			}
+			if err := fn(r.Line(), record); err != nil {
+				return skipped, err
+			}
+		}
+		preamble, footer := r.Skipped()
+		skipped.Preamble += preamble
+		skipped.Footer += footer
+	}
+}
+
+// readError reports malformed rows with the file and line they start on.
+func readError(file string, err error) error {
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return fmt.Errorf("malformed row at %s:%d: %w", file, parseErr.StartLine, parseErr.Err)
+	}
+	return fmt.Errorf("error reading file %s: %w", file, err)
+}
 
-	// Skip header row
-	_, err = r.Read()
+// readRecords returns all records of an existing output, including the
+// header.
+func (m *CSVMerger) readRecords(file string) ([][]string, error) {
+	var records [][]string
+	_, err := m.eachRecord(file, m.outputOptions(), func(_ int, record []string) error {
+		records = append(records, record)
+		return nil
+	})
+	return records, err
+}
+
+func (m *CSVMerger) readHeader(file string) ([]string, error) {
+	f, err := decode.Open(m.fsys(), file, m.inputOptions())
+	if err != nil {
+		return nil, fmt.Errorf("unable to open file %s: %w", file, err)
+	}
+	defer f.Close()
+
+	part, r, err := f.Next()
+	if err != nil {
+		return nil, err
+	}
+	header, err := r.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("file %s is empty", part)
+	}
 	if err != nil {
-		return ""
+		return nil, readError(part, err)
+	}
+	return header, nil
+}
+
+// eachRow calls fn with every data row of the files in the given order. Rows
+// of a date that was won by another file and duplicate rows are dropped. With
+// columns, rows are mapped onto these output columns by header name.
+func (m *CSVMerger) eachRow(files, header, columns []string, winners map[string]string, fn func(r row) error) (*MergeResult, error) {
+	duplicates, duplicateRows, conflictingRows, err := m.dedupe(files, header, columns, winners)
+	if err != nil {
+		return nil, err
+	}
+	result := &MergeResult{
+		Files:           files,
+		RowsPerFile:     make([]int, 0, len(files)),
+		DuplicateRows:   duplicateRows,
+		ConflictingRows: conflictingRows,
+	}
+	for i, file := range files {
+		var rows, index int
+		var last time.Time
+		var writeErr error
+		skipped, err := m.eachDataRow(file, columns, func(r row) error {
+			ref := rowRef{file: i, row: index}
+			index++
+			if r.date.After(last) {
+				last = r.date
+			}
+			if winner, ok := winners[day(r.date)]; ok && winner != file {
+				result.DroppedRows++
+				return nil
+			}
+			if duplicates[ref] {
+				return nil
+			}
+			if writeErr = fn(r); writeErr != nil {
+				return writeErr
+			}
+			rows++
+			return nil
+		})
+		if writeErr != nil {
+			return nil, fmt.Errorf("unable to write output: %w", writeErr)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		lastDate := ""
+		if index > 0 {
+			lastDate = day(last)
+		}
+		result.LastDates = append(result.LastDates, lastDate)
+		result.RowsPerFile = append(result.RowsPerFile, rows)
+		result.Rows += rows
+		if skipped.Preamble > 0 || skipped.Footer > 0 {
+			result.Skipped = append(result.Skipped, skipped)
+		}
 	}
+	return result, nil
+}
+
+// eachDataRow calls fn with every record of the file but the header and its
+// parsed date. With columns, the records are mapped onto these columns by
+// header name. It returns the lines skipped as by eachRecord.
+func (m *CSVMerger) eachDataRow(file string, columns []string, fn func(r row) error) (Skipped, error) {
+	var mapping []int
+	var header []string
+	var types []ColumnType
+	index := -1
+	return m.eachRecord(file, m.inputOptions(), func(line int, record []string) error {
+		if index < 0 {
+			header = record
+			if columns != nil {
+				mapping = columnMapping(record, columns)
+				header = columns
+			}
+			var err error
+			if index, err = m.dateIndex(header); err != nil {
+				return fmt.Errorf("%s: %w", file, err)
+			}
+			if types, err = m.columnTypes(header); err != nil {
+				return fmt.Errorf("%s: %w", file, err)
+			}
+			return nil
+		}
+		if mapping != nil {
+			record = m.remap(record, mapping)
+		}
+		date, err := m.dateOf(record, index)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", file, line, err)
+		}
+		if err := m.normalise(record, types, header); err != nil {
+			return fmt.Errorf("%s:%d: %w", file, line, err)
+		}
+		return fn(row{record: record, date: date, line: line})
+	})
+}
 
-	row, err := r.Read()
-	if err != nil || len(row) == 0 {
-		return ""
+// candidate is a file competing for a date under a restatement policy.
+type candidate struct {
+	file    string
+	modTime time.Time
+	copy    int // n of a "(n)" suffix added by the browser, 0 if none
+}
+
+var copySuffix = regexp.MustCompile(`\((\d+)\)$`)
+
+func newCandidate(fsys vfs.FS, file string) (candidate, error) {
+	info, err := fsys.Stat(file)
+	if err != nil {
+		return candidate{}, err
+	}
+	c := candidate{file: file, modTime: info.ModTime()}
+	name := strings.TrimSpace(decode.TrimExt(filepath.Base(file)))
+	if match := copySuffix.FindStringSubmatch(name); match != nil {
+		c.copy, _ = strconv.Atoi(match[1])
+	}
+	return c, nil
+}
+
+// newer reports whether a is a more recent export than b. Each policy falls
+// back to the other criterion on a tie.
+func (m *CSVMerger) newer(a, b candidate) bool {
+	if m.opts.Restatement == RestatementSuffix && a.copy != b.copy {
+		return a.copy > b.copy
+	}
+	if !a.modTime.Equal(b.modTime) {
+		return a.modTime.After(b.modTime)
+	}
+	return a.copy > b.copy
+}
+
+// restate finds the dates covered by more than one file, or by a file and the
+// existing output, and picks the file whose rows are kept for each of them.
+func (m *CSVMerger) restate(files []string, existing string, existingDates map[string]bool) (map[string]string, []RestatedDate, error) {
+	if m.opts.Restatement == "" || m.opts.Restatement == RestatementNone {
+		return nil, nil, nil
+	}
+
+	byDate := make(map[string][]candidate)
+	if len(existingDates) > 0 {
+		c, err := newCandidate(m.fsys(), existing)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to stat existing output: %w", err)
+		}
+		for date := range existingDates {
+			byDate[date] = append(byDate[date], c)
+		}
+	}
+	for _, file := range files {
+		c, err := newCandidate(m.fsys(), file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to stat file %s: %w", file, err)
+		}
+		seen := make(map[string]bool)
+		_, err = m.eachDataRow(file, nil, func(r row) error {
+			if date := day(r.date); !seen[date] {
+				seen[date] = true
+				byDate[date] = append(byDate[date], c)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	winners := make(map[string]string)
+	var restated []RestatedDate
+	for date, candidates := range byDate {
+		if len(candidates) < 2 {
+			continue
+		}
+		best := candidates[0]
+		for _, c := range candidates[1:] {
+			if m.newer(c, best) {
+				best = c
+			}
+		}
+		r := RestatedDate{Date: date, Kept: best.file}
+		for _, c := range candidates {
+			if c.file != best.file {
+				r.Dropped = append(r.Dropped, c.file)
+			}
+		}
+		winners[date] = best.file
+		restated = append(restated, r)
+	}
+	sort.Slice(restated, func(i, j int) bool {
+		return restated[i].Date < restated[j].Date
+	})
+	return winners, restated, nil
+}
+
+// SortByDate returns the files ordered by the first date in each file, which
+// is the order MergeFiles concatenates them in. Files without data rows come
+// first.
+func (m *CSVMerger) SortByDate(files []string) []FileDate {
+	sorted := make([]FileDate, len(files))
+	for i, file := range files {
+		sorted[i] = m.readFirstDate(file)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time.Before(sorted[j].Time)
+	})
+	return sorted
+}
+
+// Verify checks that the output is in chronological order and contains every
+// data row of the given source files that a merge keeps.
+func (m *CSVMerger) Verify(files []string, output string) (*Verification, error) {
+	// Restatement and dedupe pick their winners in merge order
+	files = slices.Clone(files)
+	if _, err := m.sortFiles(files); err != nil {
+		return nil, err
+	}
+	var sourceHeader []string
+	if len(files) > 0 {
+		sourceHeader, _ = m.readHeader(files[0])
+	}
+
+	var columns []string
+	var index int
+	first := true
+	v := &Verification{Missing: make(map[string]int)}
+	present := make(map[string]int)
+	var prev time.Time
+	_, err := m.eachRecord(output, m.outputOptions(), func(line int, record []string) error {
+		if first {
+			first = false
+			// Skip the header row unless the output was written without one.
+			// Without sources to compare with, the first row is assumed to be
+			// the header.
+			header := sourceHeader
+			isHeader := m.opts.Header.writes() && (sourceHeader == nil || looksLikeHeader(record, sourceHeader))
+			if isHeader {
+				header = record
+				// Column-aware outputs are compared with the source rows
+				// mapped onto the columns the output was written with.
+				if m.columnAware() {
+					columns = record
+				}
+			}
+			if header != nil {
+				var err error
+				if index, err = m.dateIndex(header); err != nil {
+					return fmt.Errorf("%s: %w", output, err)
+				}
+			}
+			if isHeader {
+				return nil
+			}
+		}
+		date, err := m.dateOf(record, index)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", output, line, err)
+		}
+		v.OutputRows++
+		present[rowKey(record)]++
+		if date.Before(prev) {
+			v.Unsorted = append(v.Unsorted, line)
+		}
+		prev = date
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read output file: %w", err)
+	}
+
+	// Rows of a date won by another file and duplicate rows were left out of
+	// the output
+	winners, _, err := m.restate(files, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	dedupeHeader := sourceHeader
+	if columns != nil {
+		dedupeHeader = columns
+	}
+	duplicates, _, _, err := m.dedupe(files, dedupeHeader, columns, winners)
+	if err != nil {
+		return nil, err
+	}
+	for i, file := range files {
+		index := 0
+		_, err := m.eachDataRow(file, columns, func(r row) error {
+			ref := rowRef{file: i, row: index}
+			index++
+			if winner, ok := winners[day(r.date)]; ok && winner != file {
+				return nil
+			}
+			if duplicates[ref] {
+				return nil
+			}
+			key := rowKey(r.record)
+			if present[key] == 0 {
+				v.Missing[file]++
+				return nil
+			}
+			present[key]--
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// rowKey identifies a record independently of how its fields were quoted.
+func rowKey(record []string) string {
+	return strings.Join(record, "\x00")
+}
+
+// errStop ends a walk over the rows of a file early.
+var errStop = errors.New("stop")
+
+func (m *CSVMerger) readFirstDate(file string) FileDate {
+	fd := FileDate{File: file}
+	_, err := m.eachDataRow(file, nil, func(r row) error {
+		fd.Date, fd.Time = day(r.date), r.date
+		return errStop
+	})
+	if err != nil && !errors.Is(err, errStop) {
+		fd.Err = err
+	}
+	if err == nil && m.opts.NameDate != nil {
+		fd.Date, fd.Time, fd.Err = m.nameDate(file)
+	}
+	return fd
+}
+
+// nameDate parses the date captured from the name of a file, if any.
+func (m *CSVMerger) nameDate(file string) (string, time.Time, error) {
+	i := m.opts.NameDate.SubexpIndex("date")
+	match := m.opts.NameDate.FindStringSubmatch(filepath.Base(file))
+	if i < 0 || match == nil {
+		return "", time.Time{}, nil
+	}
+	t, err := m.parseDate(match[i])
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("%s: date in name: %w", file, err)
 	}
-	return row[0] // date in the first column
+	return day(t), t, nil
 }
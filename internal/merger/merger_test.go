@@ -1,11 +1,20 @@
 package merger
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/spossner/ad-reporting-merger/internal/decode"
+	"github.com/spossner/ad-reporting-merger/internal/vfs"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -40,9 +49,11 @@ func TestMergeFiles(t *testing.T) {
 	merger := NewCSVMerger()
 
 	t.Run("merge files", func(t *testing.T) {
-		dates, err := merger.MergeFiles([]string{file1, file2, file3}, output)
+		result, err := merger.MergeFiles([]string{file1, file2, file3}, output)
 		require.NoError(t, err)
-		require.Len(t, dates, 3)
+		require.Len(t, result.Dates, 3)
+		assert.Equal(t, 6, result.Rows)
+		assert.Equal(t, []int{2, 2, 2}, result.RowsPerFile)
 
 		// Read output file
 		outputContent, err := os.ReadFile(output)
@@ -51,25 +62,38 @@ func TestMergeFiles(t *testing.T) {
 		outputStr := string(outputContent)
 		lines := strings.Split(strings.TrimSpace(outputStr), "\n")
 
-		// Should have 6 lines (2 from each file, headers skipped)
-		assert.Len(t, lines, 6)
+		// Should have 7 lines (common header + 2 from each file)
+		assert.Len(t, lines, 7)
+		assert.Equal(t, "Date,Value", lines[0])
+		assert.Equal(t, []string{"Date", "Value"}, result.Header)
 
 		// Check that data is in chronological order
-		assert.True(t, strings.HasPrefix(lines[0], "2025-01-01"), "Expected first line to start with 2025-01-01, got %s", lines[0])
-		assert.True(t, strings.HasPrefix(lines[4], "2025-01-03"), "Expected fifth line to start with 2025-01-03, got %s", lines[4])
+		assert.True(t, strings.HasPrefix(lines[1], "2025-01-01"), "Expected second line to start with 2025-01-01, got %s", lines[1])
+		assert.True(t, strings.HasPrefix(lines[5], "2025-01-03"), "Expected sixth line to start with 2025-01-03, got %s", lines[5])
 	})
 
 	t.Run("empty file list", func(t *testing.T) {
-		dates, err := merger.MergeFiles([]string{}, output)
+		result, err := merger.MergeFiles([]string{}, output)
 		assert.Error(t, err, "Expected error for empty file list")
-		assert.Nil(t, dates, "Expected nil dates for empty file list")
+		assert.Nil(t, result, "Expected nil result for empty file list")
 
 	})
 
 	t.Run("nonexistent file", func(t *testing.T) {
-		dates, err := merger.MergeFiles([]string{"nonexistent.csv"}, output)
+		result, err := merger.MergeFiles([]string{"nonexistent.csv"}, output)
 		assert.Error(t, err, "Expected error for nonexistent file")
-		assert.Nil(t, dates, "Expected nil dates for nonexistent file")
+		assert.Nil(t, result, "Expected nil result for nonexistent file")
+	})
+
+	t.Run("merge into io.Discard", func(t *testing.T) {
+		require.NoError(t, os.Remove(output))
+		result, err := merger.Merge([]string{file3, file1}, io.Discard)
+		require.NoError(t, err)
+		assert.Equal(t, []string{file1, file3}, result.Files)
+		assert.Equal(t, []string{"2025-01-01", "2025-01-03"}, result.Dates)
+
+		_, err = os.Stat(output)
+		assert.True(t, os.IsNotExist(err), "Merge must not create the output")
 	})
 }
 
@@ -90,12 +114,864 @@ func TestReadFirstDate(t *testing.T) {
 	merger := NewCSVMerger()
 
 	t.Run("read first date", func(t *testing.T) {
-		date := merger.readFirstDate(testFile)
-		assert.Equal(t, "2025-01-01", date)
+		fd := merger.readFirstDate(testFile)
+		require.NoError(t, fd.Err)
+		assert.Equal(t, "2025-01-01", fd.Date)
+		assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), fd.Time)
 	})
 
 	t.Run("nonexistent file", func(t *testing.T) {
-		date := merger.readFirstDate("nonexistent.csv")
-		assert.Empty(t, date, "Expected empty string for nonexistent file")
+		fd := merger.readFirstDate("nonexistent.csv")
+		assert.Error(t, fd.Err)
+		assert.Empty(t, fd.Date)
+	})
+
+	t.Run("unparseable date", func(t *testing.T) {
+		file := filepath.Join(tmpDir, "us.csv")
+		require.NoError(t, os.WriteFile(file, []byte("Date,Value\n01/02/2025,100\n"), 0644))
+		fd := merger.readFirstDate(file)
+		assert.ErrorContains(t, fd.Err, file+":2")
+		assert.ErrorContains(t, fd.Err, `"01/02/2025"`)
+	})
+
+	t.Run("date column and layouts", func(t *testing.T) {
+		file := filepath.Join(tmpDir, "layouts.csv")
+		require.NoError(t, os.WriteFile(file, []byte("Ad Unit,Day\nTop,\"Jan 2, 2025\"\nTop,01/03/2025\n"), 0644))
+
+		for _, column := range []string{"Day", "2"} {
+			m := NewCSVMergerWithOptions(Options{DateColumn: column, DateLayouts: []string{"01/02/2006", "Jan 2, 2006"}})
+			fd := m.readFirstDate(file)
+			require.NoError(t, fd.Err)
+			assert.Equal(t, "2025-01-02", fd.Date)
+		}
+
+		fd := NewCSVMergerWithOptions(Options{DateColumn: "Date"}).readFirstDate(file)
+		assert.ErrorContains(t, fd.Err, `date column "Date" not found`)
+	})
+}
+
+func TestSortByDate(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "merger_sort_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	later := filepath.Join(tmpDir, "later.csv")
+	earlier := filepath.Join(tmpDir, "earlier.csv")
+	require.NoError(t, os.WriteFile(later, []byte("Date,Value\n2025-01-02,200\n"), 0644))
+	require.NoError(t, os.WriteFile(earlier, []byte("Date,Value\n2025-01-01,100\n"), 0644))
+
+	sorted := NewCSVMerger().SortByDate([]string{later, earlier})
+	assert.Equal(t, []FileDate{
+		{File: earlier, Date: "2025-01-01", Time: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{File: later, Date: "2025-01-02", Time: time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)},
+	}, sorted)
+
+	t.Run("parsed dates", func(t *testing.T) {
+		december := filepath.Join(tmpDir, "december.csv")
+		january := filepath.Join(tmpDir, "january.csv")
+		require.NoError(t, os.WriteFile(december, []byte("Date,Value\n12/31/2024,1\n"), 0644))
+		require.NoError(t, os.WriteFile(january, []byte("Date,Value\n01/01/2025,2\n"), 0644))
+
+		var out strings.Builder
+		m := NewCSVMergerWithOptions(Options{DateLayouts: []string{"01/02/2006"}})
+		result, err := m.Merge([]string{january, december}, &out)
+		require.NoError(t, err)
+		assert.Equal(t, []string{december, january}, result.Files)
+		assert.Equal(t, []string{"2024-12-31", "2025-01-01"}, result.Dates)
+		assert.Equal(t, "Date,Value\n12/31/2024,1\n01/01/2025,2\n", out.String())
+	})
+
+	t.Run("date in name", func(t *testing.T) {
+		empty := filepath.Join(tmpDir, "Report_2025-01-03.csv")
+		require.NoError(t, os.WriteFile(empty, []byte("Date,Value\n"), 0644))
+
+		m := NewCSVMergerWithOptions(Options{NameDate: regexp.MustCompile(`_(?P<date>\d{4}-\d{2}-\d{2})\.csv$`)})
+		sorted := m.SortByDate([]string{empty, later, earlier})
+		assert.Equal(t, []string{earlier, later, empty}, []string{sorted[0].File, sorted[1].File, sorted[2].File})
+		assert.Equal(t, "2025-01-03", sorted[2].Date)
+
+		assert.Empty(t, NewCSVMerger().SortByDate([]string{empty})[0].Date, "Without a pattern a file without rows has no date")
+	})
+}
+
+func TestVerify(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "merger_verify_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	source := filepath.Join(tmpDir, "source.csv")
+	output := filepath.Join(tmpDir, "output.csv")
+	require.NoError(t, os.WriteFile(source, []byte("Date,Value\n2025-01-01,100\n2025-01-01,150\n"), 0644))
+
+	merger := NewCSVMerger()
+
+	t.Run("complete output", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(output, []byte("2025-01-01,100\n2025-01-01,150\n2025-01-02,200\n"), 0644))
+		v, err := merger.Verify([]string{source}, output)
+		require.NoError(t, err)
+		assert.True(t, v.OK())
+		assert.Equal(t, 3, v.OutputRows)
+	})
+
+	t.Run("missing and unsorted rows", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(output, []byte("2025-01-02,200\n2025-01-01,100\n"), 0644))
+		v, err := merger.Verify([]string{source}, output)
+		require.NoError(t, err)
+		assert.False(t, v.OK())
+		assert.Equal(t, []int{2}, v.Unsorted)
+		assert.Equal(t, 1, v.Missing[source])
+	})
+
+	t.Run("missing output", func(t *testing.T) {
+		_, err := merger.Verify([]string{source}, filepath.Join(tmpDir, "missing.csv"))
+		assert.Error(t, err)
+	})
+}
+
+func TestAppend(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "merger_append_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	existing := filepath.Join(tmpDir, "raw.csv")
+	file1 := filepath.Join(tmpDir, "file1.csv")
+	file2 := filepath.Join(tmpDir, "file2.csv")
+	require.NoError(t, os.WriteFile(file1, []byte("Date,Value\n2025-01-02,200\n2025-01-02,250\n"), 0644))
+	require.NoError(t, os.WriteFile(file2, []byte("Date,Value\n2025-01-04,400\n"), 0644))
+
+	merger := NewCSVMerger()
+	replacing := NewCSVMergerWithOptions(Options{Overlap: OverlapReplace})
+
+	t.Run("new dates are merged in chronological order", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(existing, []byte("2025-01-01,100\n2025-01-03,300\n"), 0644))
+
+		var out strings.Builder
+		result, err := merger.Append([]string{file2, file1}, existing, &out)
+		require.NoError(t, err)
+		assert.Equal(t, 2, result.ExistingRows)
+		assert.Equal(t, 3, result.Rows)
+		assert.Equal(t, "Date,Value\n2025-01-01,100\n2025-01-02,200\n2025-01-02,250\n2025-01-03,300\n2025-01-04,400\n", out.String())
+	})
+
+	t.Run("overlapping dates are rejected", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(existing, []byte("2025-01-01,100\n2025-01-02,999\n"), 0644))
+
+		var out strings.Builder
+		result, err := merger.Append([]string{file1}, existing, &out)
+		assert.ErrorContains(t, err, "2025-01-02")
+		assert.Nil(t, result)
+		assert.Empty(t, out.String())
+	})
+
+	t.Run("overlapping dates are replaced", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(existing, []byte("2025-01-01,100\n2025-01-02,999\n2025-01-03,300\n"), 0644))
+
+		var out strings.Builder
+		result, err := replacing.Append([]string{file1}, existing, &out)
+		require.NoError(t, err)
+		assert.Equal(t, 1, result.ReplacedRows)
+		assert.Equal(t, []string{"2025-01-02"}, result.ReplacedDates)
+		assert.Equal(t, "Date,Value\n2025-01-01,100\n2025-01-02,200\n2025-01-02,250\n2025-01-03,300\n", out.String())
+	})
+
+	t.Run("missing existing output", func(t *testing.T) {
+		var out strings.Builder
+		result, err := merger.Append([]string{file2}, filepath.Join(tmpDir, "missing.csv"), &out)
+		require.NoError(t, err)
+		assert.Equal(t, 0, result.ExistingRows)
+		assert.Equal(t, "Date,Value\n2025-01-04,400\n", out.String())
+	})
+}
+
+func TestRestatement(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "merger_restatement_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	original := filepath.Join(tmpDir, "Revenue_2025-01-02.csv")
+	restated := filepath.Join(tmpDir, "Revenue_2025-01-02 (1).csv")
+	other := filepath.Join(tmpDir, "Revenue_2025-01-03.csv")
+	require.NoError(t, os.WriteFile(original, []byte("Date,Value\n2025-01-01,100\n2025-01-02,200\n"), 0644))
+	require.NoError(t, os.WriteFile(restated, []byte("Date,Value\n2025-01-02,210\n"), 0644))
+	require.NoError(t, os.WriteFile(other, []byte("Date,Value\n2025-01-03,300\n"), 0644))
+
+	now := time.Now()
+	require.NoError(t, os.Chtimes(original, now, now))
+	require.NoError(t, os.Chtimes(restated, now.Add(-time.Hour), now.Add(-time.Hour)))
+
+	t.Run("no policy keeps every row", func(t *testing.T) {
+		var out strings.Builder
+		result, err := NewCSVMerger().Merge([]string{original, restated, other}, &out)
+		require.NoError(t, err)
+		assert.Equal(t, 4, result.Rows)
+		assert.Empty(t, result.Restated)
+	})
+
+	t.Run("newest mtime wins", func(t *testing.T) {
+		var out strings.Builder
+		merger := NewCSVMergerWithOptions(Options{Restatement: RestatementMtime})
+		result, err := merger.Merge([]string{original, restated, other}, &out)
+		require.NoError(t, err)
+		assert.Equal(t, "Date,Value\n2025-01-01,100\n2025-01-02,200\n2025-01-03,300\n", out.String())
+		assert.Equal(t, 1, result.DroppedRows)
+		assert.Equal(t, []RestatedDate{{Date: "2025-01-02", Kept: original, Dropped: []string{restated}}}, result.Restated)
+	})
+
+	t.Run("highest copy suffix wins", func(t *testing.T) {
+		var out strings.Builder
+		merger := NewCSVMergerWithOptions(Options{Restatement: RestatementSuffix})
+		result, err := merger.Merge([]string{original, restated, other}, &out)
+		require.NoError(t, err)
+		assert.Equal(t, "Date,Value\n2025-01-01,100\n2025-01-02,210\n2025-01-03,300\n", out.String())
+		assert.Equal(t, []RestatedDate{{Date: "2025-01-02", Kept: restated, Dropped: []string{original}}}, result.Restated)
+	})
+
+	t.Run("verify skips rows of dropped dates", func(t *testing.T) {
+		output := filepath.Join(tmpDir, "verified.csv")
+		merger := NewCSVMergerWithOptions(Options{Restatement: RestatementSuffix})
+		_, err := merger.MergeFiles([]string{original, restated, other}, output)
+		require.NoError(t, err)
+		v, err := merger.Verify([]string{original, restated, other}, output)
+		require.NoError(t, err)
+		assert.True(t, v.OK(), "The row of the replaced export is not missing: %v", v.Missing)
+	})
+
+	t.Run("newer export replaces existing output", func(t *testing.T) {
+		existing := filepath.Join(tmpDir, "raw.csv")
+		require.NoError(t, os.WriteFile(existing, []byte("2025-01-03,299\n"), 0644))
+		require.NoError(t, os.Chtimes(existing, now.Add(-2*time.Hour), now.Add(-2*time.Hour)))
+
+		var out strings.Builder
+		merger := NewCSVMergerWithOptions(Options{Restatement: RestatementMtime})
+		result, err := merger.Append([]string{other}, existing, &out)
+		require.NoError(t, err, "Restated dates must not be rejected as overlap")
+		assert.Equal(t, "Date,Value\n2025-01-03,300\n", out.String())
+		assert.Equal(t, []string{"2025-01-03"}, result.ReplacedDates)
+		assert.Equal(t, []RestatedDate{{Date: "2025-01-03", Kept: other, Dropped: []string{existing}}}, result.Restated)
+	})
+
+	t.Run("existing output newer than export", func(t *testing.T) {
+		existing := filepath.Join(tmpDir, "raw.csv")
+		require.NoError(t, os.WriteFile(existing, []byte("2025-01-03,299\n"), 0644))
+		require.NoError(t, os.Chtimes(existing, now.Add(time.Hour), now.Add(time.Hour)))
+
+		var out strings.Builder
+		merger := NewCSVMergerWithOptions(Options{Restatement: RestatementMtime})
+		result, err := merger.Append([]string{other}, existing, &out)
+		require.NoError(t, err)
+		assert.Equal(t, "Date,Value\n2025-01-03,299\n", out.String())
+		assert.Equal(t, 1, result.DroppedRows)
+	})
+
+	t.Run("unknown policy", func(t *testing.T) {
+		_, err := ParseRestatement("latest")
+		assert.Error(t, err)
+	})
+}
+
+func TestHeaderPolicy(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "merger_header_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	file1 := filepath.Join(tmpDir, "file1.csv")
+	file2 := filepath.Join(tmpDir, "file2.csv")
+	require.NoError(t, os.WriteFile(file1, []byte("Date,Ad Unit,Revenue\n2025-01-01,Top,1\n"), 0644))
+	require.NoError(t, os.WriteFile(file2, []byte("Date,Revenue\n2025-01-02,2\n"), 0644))
+
+	t.Run("strict fails with a column diff", func(t *testing.T) {
+		var out strings.Builder
+		_, err := NewCSVMerger().Merge([]string{file1, file2}, &out)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), file2)
+		assert.Contains(t, err.Error(), `column 2 is "Revenue" instead of "Ad Unit"`)
+		assert.Contains(t, err.Error(), `column 3 "Revenue" missing`)
+	})
+
+	t.Run("write reports the mismatch", func(t *testing.T) {
+		var out strings.Builder
+		merger := NewCSVMergerWithOptions(Options{Header: HeaderWrite})
+		result, err := merger.Merge([]string{file1, file2}, &out)
+		require.NoError(t, err)
+		assert.Equal(t, "Date,Ad Unit,Revenue\n2025-01-01,Top,1\n2025-01-02,2\n", out.String())
+		require.Len(t, result.HeaderMismatches, 1)
+		assert.Equal(t, file2, result.HeaderMismatches[0].File)
+	})
+
+	t.Run("omit writes no header", func(t *testing.T) {
+		var out strings.Builder
+		merger := NewCSVMergerWithOptions(Options{Header: HeaderOmit})
+		_, err := merger.Merge([]string{file1}, &out)
+		require.NoError(t, err)
+		assert.Equal(t, "2025-01-01,Top,1\n", out.String())
+	})
+
+	t.Run("append keeps a single header", func(t *testing.T) {
+		existing := filepath.Join(tmpDir, "raw.csv")
+		require.NoError(t, os.WriteFile(existing, []byte("Date,Ad Unit,Revenue\n2024-12-31,Top,0\n"), 0644))
+
+		var out strings.Builder
+		result, err := NewCSVMerger().Append([]string{file1}, existing, &out)
+		require.NoError(t, err)
+		assert.Equal(t, 1, result.ExistingRows)
+		assert.Equal(t, "Date,Ad Unit,Revenue\n2024-12-31,Top,0\n2025-01-01,Top,1\n", out.String())
+	})
+
+	t.Run("append with differing existing header", func(t *testing.T) {
+		existing := filepath.Join(tmpDir, "raw.csv")
+		require.NoError(t, os.WriteFile(existing, []byte("Date,Revenue\n2024-12-31,0\n"), 0644))
+
+		var out strings.Builder
+		_, err := NewCSVMerger().Append([]string{file1}, existing, &out)
+		assert.ErrorContains(t, err, existing)
+	})
+
+	t.Run("verify skips the header", func(t *testing.T) {
+		output := filepath.Join(tmpDir, "verify.csv")
+		require.NoError(t, os.WriteFile(output, []byte("Date,Ad Unit,Revenue\n2025-01-01,Top,1\n"), 0644))
+
+		v, err := NewCSVMerger().Verify([]string{file1}, output)
+		require.NoError(t, err)
+		assert.True(t, v.OK())
+		assert.Equal(t, 1, v.OutputRows)
+	})
+
+	t.Run("unknown policy", func(t *testing.T) {
+		_, err := ParseHeaderPolicy("maybe")
+		assert.Error(t, err)
+	})
+}
+
+func TestColumns(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "merger_columns_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	file1 := filepath.Join(tmpDir, "file1.csv")
+	file2 := filepath.Join(tmpDir, "file2.csv")
+	require.NoError(t, os.WriteFile(file1, []byte("Date,Ad Unit,Revenue\n2025-01-01,Top,1\n"), 0644))
+	require.NoError(t, os.WriteFile(file2, []byte("Date,Revenue,Clicks\n2025-01-02,2,5\n"), 0644))
+
+	t.Run("union maps columns by name", func(t *testing.T) {
+		var out strings.Builder
+		merger := NewCSVMergerWithOptions(Options{Columns: ColumnsUnion, Fill: "0"})
+		result, err := merger.Merge([]string{file2, file1}, &out)
+		require.NoError(t, err)
+		assert.Equal(t, "Date,Ad Unit,Revenue,Clicks\n2025-01-01,Top,1,0\n2025-01-02,0,2,5\n", out.String())
+		assert.Equal(t, []string{"Date", "Ad Unit", "Revenue", "Clicks"}, result.Header)
+		assert.Empty(t, result.HeaderMismatches)
+	})
+
+	t.Run("pinned column order", func(t *testing.T) {
+		var out strings.Builder
+		merger := NewCSVMergerWithOptions(Options{ColumnOrder: []string{"Date", "Revenue"}})
+		_, err := merger.Merge([]string{file1, file2}, &out)
+		require.NoError(t, err)
+		assert.Equal(t, "Date,Revenue\n2025-01-01,1\n2025-01-02,2\n", out.String())
+	})
+
+	t.Run("append maps the existing output", func(t *testing.T) {
+		existing := filepath.Join(tmpDir, "raw.csv")
+		require.NoError(t, os.WriteFile(existing, []byte("Date,Revenue\n2024-12-31,0\n"), 0644))
+
+		var out strings.Builder
+		merger := NewCSVMergerWithOptions(Options{Columns: ColumnsUnion})
+		_, err := merger.Append([]string{file1}, existing, &out)
+		require.NoError(t, err)
+		assert.Equal(t, "Date,Revenue,Ad Unit\n2024-12-31,0,\n2025-01-01,1,Top\n", out.String())
+	})
+
+	t.Run("append needs a header", func(t *testing.T) {
+		existing := filepath.Join(tmpDir, "raw.csv")
+		require.NoError(t, os.WriteFile(existing, []byte("2024-12-31,0\n"), 0644))
+
+		var out strings.Builder
+		merger := NewCSVMergerWithOptions(Options{Columns: ColumnsUnion})
+		_, err := merger.Append([]string{file1}, existing, &out)
+		assert.ErrorContains(t, err, "no header")
+	})
+
+	t.Run("verify maps the sources", func(t *testing.T) {
+		output := filepath.Join(tmpDir, "verify.csv")
+		require.NoError(t, os.WriteFile(output, []byte("Date,Ad Unit,Revenue,Clicks\n2025-01-01,Top,1,\n2025-01-02,,2,5\n"), 0644))
+
+		v, err := NewCSVMergerWithOptions(Options{Columns: ColumnsUnion}).Verify([]string{file1, file2}, output)
+		require.NoError(t, err)
+		assert.True(t, v.OK())
+	})
+
+	t.Run("unknown mode", func(t *testing.T) {
+		_, err := ParseColumnMode("sideways")
+		assert.Error(t, err)
+	})
+}
+
+func TestCSVParsing(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "merger_csv_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	t.Run("quoted fields with newlines and long rows", func(t *testing.T) {
+		long := strings.Repeat("x", 100*1024)
+		file1 := filepath.Join(tmpDir, "quoted1.csv")
+		file2 := filepath.Join(tmpDir, "quoted2.csv")
+		require.NoError(t, os.WriteFile(file1, []byte("Date,Ad Unit,Revenue\n2025-01-02,\"Top,\nBanner\",1\n"), 0644))
+		require.NoError(t, os.WriteFile(file2, []byte("Date,Ad Unit,Revenue\n2025-01-01,"+long+",2\n"), 0644))
+
+		var out strings.Builder
+		result, err := NewCSVMerger().Merge([]string{file1, file2}, &out)
+		require.NoError(t, err)
+		assert.Equal(t, []string{file2, file1}, result.Files)
+		assert.Equal(t, []string{"2025-01-01", "2025-01-02"}, result.Dates)
+		assert.Equal(t, "Date,Ad Unit,Revenue\n2025-01-01,"+long+",2\n2025-01-02,\"Top,\nBanner\",1\n", out.String())
+	})
+
+	t.Run("configurable delimiter", func(t *testing.T) {
+		file := filepath.Join(tmpDir, "semicolon.csv")
+		require.NoError(t, os.WriteFile(file, []byte("Date;Revenue\n2025-01-01;1,5\n"), 0644))
+
+		var out strings.Builder
+		_, err := NewCSVMergerWithOptions(Options{Delimiter: ';'}).Merge([]string{file}, &out)
+		require.NoError(t, err)
+		assert.Equal(t, "Date;Revenue\n2025-01-01;1,5\n", out.String())
+	})
+
+	t.Run("sniffed delimiters", func(t *testing.T) {
+		file1 := filepath.Join(tmpDir, "sniffed1.csv")
+		file2 := filepath.Join(tmpDir, "sniffed2.tsv")
+		require.NoError(t, os.WriteFile(file1, []byte("Date;Ad Unit;Revenue\n2025-01-01;Top;1,5\n"), 0644))
+		require.NoError(t, os.WriteFile(file2, []byte("Date\tAd Unit\tRevenue\n2025-01-02\t'Top, Banner'\t2,25\n"), 0644))
+
+		var out strings.Builder
+		result, err := NewCSVMergerWithOptions(Options{SniffDelimiter: true, OutputDelimiter: ','}).Merge([]string{file1, file2}, &out)
+		require.NoError(t, err)
+		assert.Equal(t, "Date,Ad Unit,Revenue\n2025-01-01,Top,\"1,5\"\n2025-01-02,\"Top, Banner\",\"2,25\"\n", out.String())
+		assert.Empty(t, result.HeaderMismatches)
+		assert.Equal(t, []DialectMismatch{{
+			File:     file2,
+			Found:    decode.Dialect{Comma: '\t', Quote: '\''},
+			Expected: decode.Dialect{Comma: ';', Quote: '"'},
+		}}, result.DialectMismatches, "Files delimited unlike the first are flagged")
+
+		// Without sniffing, files read with the wrong delimiter fail with a hint
+		file3 := filepath.Join(tmpDir, "sniffed3.csv")
+		require.NoError(t, os.WriteFile(file3, []byte("Date,Ad Unit,Revenue\n2025-01-03,Top,3\n"), 0644))
+		_, err = NewCSVMergerWithOptions(Options{Delimiter: ';'}).Merge([]string{file1, file3}, io.Discard)
+		assert.ErrorContains(t, err, file3+` looks like delimiter ',', quote '"', expected delimiter ';'`)
+	})
+
+	t.Run("output delimiter", func(t *testing.T) {
+		fsys := vfs.NewMemFS()
+		require.NoError(t, vfs.WriteFile(fsys, "/report_1.csv", []byte("Date;Revenue\n2025-01-01;1\n"), 0644))
+		require.NoError(t, vfs.WriteFile(fsys, "/report_2.csv", []byte("Date;Revenue\n2025-01-02;2\n"), 0644))
+		merger := NewCSVMergerWithOptions(Options{FS: fsys, Delimiter: ';', OutputDelimiter: '\t'})
+		_, err := merger.MergeFiles([]string{"/report_1.csv"}, "/out.tsv")
+		require.NoError(t, err)
+
+		// The existing output is read with the output delimiter
+		var out strings.Builder
+		result, err := merger.Append([]string{"/report_2.csv"}, "/out.tsv", &out)
+		require.NoError(t, err)
+		assert.Empty(t, result.HeaderMismatches)
+		assert.Equal(t, "Date\tRevenue\n2025-01-01\t1\n2025-01-02\t2\n", out.String())
+	})
+
+	t.Run("short rows are copied", func(t *testing.T) {
+		file := filepath.Join(tmpDir, "short.csv")
+		require.NoError(t, os.WriteFile(file, []byte("Date,Revenue\n2025-01-01\n"), 0644))
+
+		var out strings.Builder
+		result, err := NewCSVMerger().Merge([]string{file}, &out)
+		require.NoError(t, err)
+		assert.Equal(t, "Date,Revenue\n2025-01-01\n", out.String())
+		assert.Equal(t, 1, result.Rows)
+	})
+
+	t.Run("malformed rows report file and line", func(t *testing.T) {
+		file := filepath.Join(tmpDir, "malformed.csv")
+		require.NoError(t, os.WriteFile(file, []byte("Date,Revenue\n2025-01-01,1\n2025-01-02,\"2\n"), 0644))
+
+		var out strings.Builder
+		_, err := NewCSVMerger().Merge([]string{file}, &out)
+		assert.ErrorContains(t, err, file+":3")
+	})
+
+	t.Run("parse delimiter", func(t *testing.T) {
+		for input, expected := range map[string]rune{"": ',', ";": ';', "tab": '\t', "|": '|'} {
+			delimiter, err := ParseDelimiter(input)
+			require.NoError(t, err)
+			assert.Equal(t, expected, delimiter)
+		}
+		for _, input := range []string{`"`, ",;", "\n"} {
+			_, err := ParseDelimiter(input)
+			assert.Error(t, err, input)
+		}
+	})
+}
+
+func TestSortKeys(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "merger_sort_keys_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	weekly := filepath.Join(tmpDir, "weekly.csv")
+	daily := filepath.Join(tmpDir, "daily.csv")
+	require.NoError(t, os.WriteFile(weekly, []byte("Date,Ad Unit,Revenue\n2025-01-01,Top,1\n2025-01-01,Side,2\n2025-01-02,Top,3\n2025-01-03,Top,4\n"), 0644))
+	require.NoError(t, os.WriteFile(daily, []byte("Date,Ad Unit,Revenue\n2025-01-02,Side,5\n"), 0644))
+	expected := "Date,Ad Unit,Revenue\n2025-01-01,Side,2\n2025-01-01,Top,1\n2025-01-02,Side,5\n2025-01-02,Top,3\n2025-01-03,Top,4\n"
+
+	t.Run("in memory", func(t *testing.T) {
+		var out strings.Builder
+		merger := NewCSVMergerWithOptions(Options{SortKeys: []string{"Date", "Ad Unit"}})
+		_, err := merger.Merge([]string{weekly, daily}, &out)
+		require.NoError(t, err)
+		assert.Equal(t, expected, out.String())
+	})
+
+	t.Run("spilled chunks", func(t *testing.T) {
+		chunkDir := filepath.Join(tmpDir, "chunks")
+		require.NoError(t, os.Mkdir(chunkDir, 0755))
+
+		var out strings.Builder
+		merger := NewCSVMergerWithOptions(Options{SortKeys: []string{"1", "2"}, SortChunkRows: 2, SortTempDir: chunkDir})
+		_, err := merger.Merge([]string{weekly, daily}, &out)
+		require.NoError(t, err)
+		assert.Equal(t, expected, out.String())
+
+		entries, err := os.ReadDir(chunkDir)
+		require.NoError(t, err)
+		assert.Empty(t, entries, "sort chunks must be removed")
+	})
+
+	t.Run("stable for equal keys", func(t *testing.T) {
+		var out strings.Builder
+		merger := NewCSVMergerWithOptions(Options{SortKeys: []string{"Date"}, SortChunkRows: 1, SortTempDir: tmpDir})
+		_, err := merger.Merge([]string{weekly, daily}, &out)
+		require.NoError(t, err)
+		assert.Equal(t, "Date,Ad Unit,Revenue\n2025-01-01,Top,1\n2025-01-01,Side,2\n2025-01-02,Top,3\n2025-01-02,Side,5\n2025-01-03,Top,4\n", out.String())
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		var out strings.Builder
+		_, err := NewCSVMergerWithOptions(Options{SortKeys: []string{"Clicks"}}).Merge([]string{weekly}, &out)
+		assert.ErrorContains(t, err, `"Clicks"`)
+	})
+
+	t.Run("dry run is not spilled", func(t *testing.T) {
+		merger := NewCSVMergerWithOptions(Options{SortKeys: []string{"Date"}, SortChunkRows: 1, SortTempDir: filepath.Join(tmpDir, "missing"), DryRun: true})
+		var out strings.Builder
+		result, err := merger.Merge([]string{weekly, daily}, &out)
+		require.NoError(t, err, "A dry run must not write sort chunks")
+		assert.Equal(t, 5, result.Rows)
+
+		_, err = NewCSVMergerWithOptions(Options{SortKeys: []string{"Clicks"}, DryRun: true}).Merge([]string{weekly}, io.Discard)
+		assert.ErrorContains(t, err, `"Clicks"`)
+	})
+}
+
+func TestDedupe(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "merger_dedupe_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	weekly := filepath.Join(tmpDir, "weekly.csv")
+	daily := filepath.Join(tmpDir, "daily.csv")
+	require.NoError(t, os.WriteFile(weekly, []byte("Date,Ad Unit,Revenue\n2025-01-01,Top,1\n2025-01-02,Top,2\n2025-01-02,Side,3\n"), 0644))
+	require.NoError(t, os.WriteFile(daily, []byte("Date,Ad Unit,Revenue\n2025-01-02,Top,2\n2025-01-02,Side,4\n"), 0644))
+	keys := []string{"Date", "Ad Unit"}
+
+	t.Run("first wins", func(t *testing.T) {
+		var out strings.Builder
+		result, err := NewCSVMergerWithOptions(Options{DedupeKeys: keys}).Merge([]string{weekly, daily}, &out)
+		require.NoError(t, err)
+		assert.Equal(t, "Date,Ad Unit,Revenue\n2025-01-01,Top,1\n2025-01-02,Top,2\n2025-01-02,Side,3\n", out.String())
+		assert.Equal(t, 1, result.DuplicateRows)
+		assert.Equal(t, 1, result.ConflictingRows)
+		assert.Equal(t, []int{3, 0}, result.RowsPerFile)
+	})
+
+	t.Run("last wins", func(t *testing.T) {
+		var out strings.Builder
+		result, err := NewCSVMergerWithOptions(Options{DedupeKeys: keys, Dedupe: DedupeLastWins}).Merge([]string{weekly, daily}, &out)
+		require.NoError(t, err)
+		assert.Equal(t, "Date,Ad Unit,Revenue\n2025-01-01,Top,1\n2025-01-02,Top,2\n2025-01-02,Side,4\n", out.String())
+		assert.Equal(t, 1, result.DuplicateRows)
+		assert.Equal(t, 1, result.ConflictingRows)
+	})
+
+	t.Run("verify skips dropped rows", func(t *testing.T) {
+		output := filepath.Join(tmpDir, "output.csv")
+		merger := NewCSVMergerWithOptions(Options{DedupeKeys: keys, Dedupe: DedupeLastWins})
+		_, err := merger.MergeFiles([]string{weekly, daily}, output)
+		require.NoError(t, err)
+		v, err := merger.Verify([]string{weekly, daily}, output)
+		require.NoError(t, err)
+		assert.True(t, v.OK(), "Duplicate and conflicting rows are not missing: %v", v.Missing)
+	})
+
+	t.Run("verify in merge order", func(t *testing.T) {
+		a := filepath.Join(tmpDir, "a.csv")
+		b := filepath.Join(tmpDir, "b.csv")
+		output := filepath.Join(tmpDir, "ordered.csv")
+		require.NoError(t, os.WriteFile(a, []byte("Date,Unit,Value\n2025-01-02,X,1\n"), 0644))
+		require.NoError(t, os.WriteFile(b, []byte("Date,Unit,Value\n2025-01-01,X,5\n2025-01-02,X,2\n"), 0644))
+		merger := NewCSVMergerWithOptions(Options{DedupeKeys: []string{"Date", "Unit"}})
+		_, err := merger.MergeFiles([]string{a, b}, output)
+		require.NoError(t, err)
+		v, err := merger.Verify([]string{a, b}, output)
+		require.NoError(t, err)
+		assert.True(t, v.OK(), "The file merged first wins as in the merge: %v", v.Missing)
+	})
+
+	t.Run("error on conflict", func(t *testing.T) {
+		var out strings.Builder
+		_, err := NewCSVMergerWithOptions(Options{DedupeKeys: keys, Dedupe: DedupeError}).Merge([]string{weekly, daily}, &out)
+		assert.ErrorContains(t, err, weekly+":4")
+		assert.ErrorContains(t, err, daily+":3")
+	})
+
+	t.Run("unknown policy", func(t *testing.T) {
+		_, err := ParseDedupe("most-wins")
+		assert.Error(t, err)
+	})
+}
+
+func TestMergeCompressed(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("/reports", 0755))
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, err := gw.Write([]byte("Date,Value\n2025-01-03,300\n"))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	require.NoError(t, vfs.WriteFile(fsys, "/reports/report_3.csv.gz", gz.Bytes(), 0644))
+
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	for _, member := range []struct{ name, content string }{
+		{"report_2.csv", "Date,Value\n2025-01-02,200\n"},
+		{"report_1.csv", "Date,Value\n2025-01-01,100\n"},
+	} {
+		f, err := zw.Create(member.name)
+		require.NoError(t, err)
+		_, err = f.Write([]byte(member.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, vfs.WriteFile(fsys, "/reports/reports.zip", zipped.Bytes(), 0644))
+
+	merger := NewCSVMergerWithOptions(Options{FS: fsys})
+	result, err := merger.MergeFiles([]string{"/reports/report_3.csv.gz", "/reports/reports.zip"}, "/reports/out.csv")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/reports/reports.zip", "/reports/report_3.csv.gz"}, result.Files)
+	assert.Equal(t, []int{2, 1}, result.RowsPerFile)
+
+	output, err := fs.ReadFile(fsys, "/reports/out.csv")
+	require.NoError(t, err)
+	assert.Equal(t, "Date,Value\n2025-01-02,200\n2025-01-01,100\n2025-01-03,300\n", string(output),
+		"Members keep their order and share one header")
+
+	t.Run("malformed member", func(t *testing.T) {
+		var zipped bytes.Buffer
+		zw := zip.NewWriter(&zipped)
+		f, err := zw.Create("broken.csv")
+		require.NoError(t, err)
+		_, err = f.Write([]byte("Date,Value\n2025-01-04,\"400\n"))
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		require.NoError(t, vfs.WriteFile(fsys, "/reports/broken.zip", zipped.Bytes(), 0644))
+
+		_, err = merger.MergeFiles([]string{"/reports/broken.zip"}, "/reports/out.csv")
+		assert.ErrorContains(t, err, "/reports/broken.zip/broken.csv:2")
 	})
 }
+
+func TestMergeEncodings(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("/reports", 0755))
+
+	// UTF-16LE with a byte order mark, as exported by Excel
+	utf16 := []byte{0xff, 0xfe}
+	for _, r := range "Date,Ad Unit\r\n2025-01-01,Café\r\n" {
+		utf16 = append(utf16, byte(r), 0)
+	}
+	require.NoError(t, vfs.WriteFile(fsys, "/reports/report_1.csv", utf16, 0644))
+	require.NoError(t, vfs.WriteFile(fsys, "/reports/report_2.csv", []byte("\xef\xbb\xbfDate,Ad Unit\n2025-01-02,Crème\n"), 0644))
+	require.NoError(t, vfs.WriteFile(fsys, "/reports/report_3.csv", []byte("Date,Ad Unit\n2025-01-03,Fa\xe7ade \x80\n"), 0644))
+	files := []string{"/reports/report_1.csv", "/reports/report_2.csv", "/reports/report_3.csv"}
+
+	result, err := NewCSVMergerWithOptions(Options{FS: fsys}).MergeFiles(files, "/reports/out.csv")
+	require.NoError(t, err)
+	assert.Empty(t, result.HeaderMismatches, "Byte order marks are not part of the header")
+	output, err := fs.ReadFile(fsys, "/reports/out.csv")
+	require.NoError(t, err)
+	assert.Equal(t, "Date,Ad Unit\n2025-01-01,Café\n2025-01-02,Crème\n2025-01-03,Façade €\n", string(output))
+
+	t.Run("legacy output", func(t *testing.T) {
+		merger := NewCSVMergerWithOptions(Options{FS: fsys, Encoding: decode.EncodingWindows1252})
+		_, err := merger.MergeFiles(files[:2], "/reports/legacy.csv")
+		require.NoError(t, err)
+		output, err := fs.ReadFile(fsys, "/reports/legacy.csv")
+		require.NoError(t, err)
+		assert.Equal(t, "Date,Ad Unit\n2025-01-01,Caf\xe9\n2025-01-02,Cr\xe8me\n", string(output))
+
+		// The existing output is read back in its own encoding
+		var buf bytes.Buffer
+		_, err = merger.Append(files[2:], "/reports/legacy.csv", &buf)
+		require.NoError(t, err)
+		assert.Equal(t, "Date,Ad Unit\n2025-01-01,Caf\xe9\n2025-01-02,Cr\xe8me\n2025-01-03,Fa\xe7ade \x80\n", buf.String())
+	})
+
+	t.Run("unrepresentable", func(t *testing.T) {
+		require.NoError(t, vfs.WriteFile(fsys, "/reports/report_4.csv", []byte("Date,Ad Unit\n2025-01-04,東京\n"), 0644))
+		merger := NewCSVMergerWithOptions(Options{FS: fsys, Encoding: decode.EncodingLatin1})
+		_, err := merger.Merge([]string{"/reports/report_4.csv"}, io.Discard)
+		assert.ErrorContains(t, err, "cannot be encoded in iso-8859-1")
+	})
+}
+
+func TestMergePreamble(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	require.NoError(t, fsys.MkdirAll("/reports", 0755))
+	export := func(day, impressions string) []byte {
+		return []byte("Report name,Revenue per day\nDate range,2025-01-01 - 2025-01-02\n\n" +
+			"Date,Impressions\n" + day + "," + impressions + "\nTotal," + impressions + "\n")
+	}
+	require.NoError(t, vfs.WriteFile(fsys, "/reports/report_2.csv", export("2025-01-02", "200"), 0644))
+	require.NoError(t, vfs.WriteFile(fsys, "/reports/report_1.csv", export("2025-01-01", "100"), 0644))
+	require.NoError(t, vfs.WriteFile(fsys, "/reports/report_3.csv", []byte("Date,Impressions\n2025-01-03,300\n"), 0644))
+	files := []string{"/reports/report_2.csv", "/reports/report_1.csv", "/reports/report_3.csv"}
+
+	merger := NewCSVMergerWithOptions(Options{
+		FS:            fsys,
+		HeaderPattern: regexp.MustCompile(`^Date,`),
+		FooterPattern: regexp.MustCompile(`^Total,`),
+	})
+	var out strings.Builder
+	result, err := merger.Merge(files, &out)
+	require.NoError(t, err)
+	assert.Equal(t, "Date,Impressions\n2025-01-01,100\n2025-01-02,200\n2025-01-03,300\n", out.String())
+	assert.Equal(t, []Skipped{
+		{File: "/reports/report_1.csv", Preamble: 2, Footer: 1},
+		{File: "/reports/report_2.csv", Preamble: 2, Footer: 1},
+	}, result.Skipped, "Files without preamble or footer are not reported")
+
+	_, err = NewCSVMergerWithOptions(Options{FS: fsys}).Merge(files, io.Discard)
+	assert.ErrorContains(t, err, `unable to parse date "Date range"`, "Without patterns the preamble is taken for header and data")
+}
+
+func TestNormaliseNumber(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		t        ColumnType
+		locale   Locale
+		expected string
+	}{
+		{"1,234", TypeInteger, LocaleEnglish, "1234"},
+		{"1.234", TypeInteger, LocaleGerman, "1234"},
+		{"1 234 567", TypeInteger, LocaleFrench, "1234567"},
+		{"-0", TypeInteger, LocaleEnglish, "0"},
+		{"12.00", TypeInteger, LocaleEnglish, "12"},
+		{"1,234.56", TypeDecimal, LocaleEnglish, "1234.56"},
+		{"1.234,56", TypeDecimal, LocaleGerman, "1234.56"},
+		{"1 234,5", TypeDecimal, LocaleFrench, "1234.5"},
+		{"1'234.50", TypeDecimal, LocaleSwiss, "1234.50"},
+		{"007.5", TypeDecimal, LocaleEnglish, "7.5"},
+		{",5", TypeDecimal, LocaleGerman, "0.5"},
+		{"(12.5)", TypeDecimal, LocaleEnglish, "-12.5"},
+		{"12.5-", TypeDecimal, LocaleEnglish, "-12.5"},
+		{"12.5%", TypePercent, LocaleEnglish, "0.125"},
+		{"12,5 %", TypePercent, LocaleGerman, "0.125"},
+		{"5%", TypePercent, LocaleEnglish, "0.05"},
+		{"100 %", TypePercent, LocaleEnglish, "1"},
+		{"-0.5%", TypePercent, LocaleEnglish, "-0.005"},
+		{"€25.50", TypeCurrency, LocaleEnglish, "25.50"},
+		{"25.50 USD", TypeCurrency, LocaleEnglish, "25.50"},
+		{"1.234,56 €", TypeCurrency, LocaleGerman, "1234.56"},
+		{"-$1,000", TypeCurrency, LocaleEnglish, "-1000"},
+		{"€-3.20", TypeCurrency, LocaleEnglish, "-3.20"},
+		{"CHF 1'000.05", TypeCurrency, LocaleSwiss, "1000.05"},
+	} {
+		normalised, ok := normaliseNumber(tc.value, tc.t, tc.locale)
+		if assert.True(t, ok, "%s %q", tc.t, tc.value) {
+			assert.Equal(t, tc.expected, normalised, "%s %q", tc.t, tc.value)
+		}
+	}
+
+	for _, tc := range []struct {
+		value  string
+		t      ColumnType
+		locale Locale
+	}{
+		{"1.5", TypeInteger, LocaleEnglish},
+		{"25.50", TypeDecimal, LocaleGerman},
+		{"1.234,56", TypeDecimal, LocaleEnglish},
+		{"12,34,567", TypeDecimal, LocaleEnglish},
+		{"1234,567", TypeDecimal, LocaleEnglish},
+		{"1,2", TypeInteger, LocaleEnglish},
+		{"12%", TypeDecimal, LocaleEnglish},
+		{"€12", TypeDecimal, LocaleEnglish},
+		{"n/a", TypeCurrency, LocaleEnglish},
+		{"1e5", TypeDecimal, LocaleEnglish},
+		{"(12", TypeDecimal, LocaleEnglish},
+	} {
+		_, ok := normaliseNumber(tc.value, tc.t, tc.locale)
+		assert.False(t, ok, "%s %q", tc.t, tc.value)
+	}
+
+	t.Run("parse", func(t *testing.T) {
+		for input, expected := range map[string]Locale{"": LocaleEnglish, "de-DE": LocaleGerman, "de_CH": LocaleSwiss, "fr": LocaleFrench} {
+			locale, err := ParseLocale(input)
+			require.NoError(t, err)
+			assert.Equal(t, expected, locale, input)
+		}
+		_, err := ParseLocale("xx")
+		assert.ErrorContains(t, err, "unknown locale")
+		_, err = ParseColumnType("money")
+		assert.ErrorContains(t, err, "unknown column type")
+	})
+}
+
+func TestMergeColumnTypes(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	require.NoError(t, vfs.WriteFile(fsys, "/report_1.csv", []byte("Date;Impressions;CTR;Revenue;eCPM\n2025-01-01;1.234;1,5 %;1.234,56 €;0,5\n"), 0644))
+	require.NoError(t, vfs.WriteFile(fsys, "/report_2.csv", []byte("Date;Impressions;CTR;Revenue;eCPM\n2025-01-02;500;2 %;€ 25,50;\n2025-01-03;-;0 %;0;1\n"), 0644))
+
+	merger := NewCSVMergerWithOptions(Options{
+		FS:              fsys,
+		Delimiter:       ';',
+		OutputDelimiter: ',',
+		Locale:          LocaleGerman,
+		ColumnTypes:     map[string]ColumnType{"Impressions": TypeInteger, "CTR": TypePercent, "Revenue": TypeCurrency, "5": TypeDecimal},
+	})
+	var out strings.Builder
+	_, err := merger.Merge([]string{"/report_1.csv"}, &out)
+	require.NoError(t, err)
+	assert.Equal(t, "Date,Impressions,CTR,Revenue,eCPM\n2025-01-01,1234,0.015,1234.56,0.5\n", out.String())
+
+	_, err = merger.Merge([]string{"/report_1.csv", "/report_2.csv"}, io.Discard)
+	assert.ErrorContains(t, err, `/report_2.csv:3: invalid integer "-" in column "Impressions"`)
+
+	merger = NewCSVMergerWithOptions(Options{FS: fsys, Delimiter: ';', ColumnTypes: map[string]ColumnType{"Clicks": TypeInteger}})
+	_, err = merger.Merge([]string{"/report_1.csv"}, io.Discard)
+	assert.ErrorContains(t, err, `typed column "Clicks" not found`)
+}
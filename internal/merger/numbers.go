@@ -0,0 +1,237 @@
+package merger
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// ColumnType is the kind of number in a metric column. Values of typed
+// columns are normalised to a canonical format: no grouping, a point as the
+// decimal separator and a leading minus for negative values.
+type ColumnType string
+
+const (
+	TypeInteger  ColumnType = "integer"  // 1.234 -> 1234
+	TypeDecimal  ColumnType = "decimal"  // 1.234,56 -> 1234.56
+	TypePercent  ColumnType = "percent"  // 12,5 % -> 0.125, as a fraction
+	TypeCurrency ColumnType = "currency" // €25.50 or 25.50 USD -> 25.50, dropping the currency
+)
+
+// ParseColumnType validates a column type.
+func ParseColumnType(s string) (ColumnType, error) {
+	switch t := ColumnType(s); t {
+	case TypeInteger, TypeDecimal, TypePercent, TypeCurrency:
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown column type %q", s)
+}
+
+// Locale is how numbers are written: the decimal separator and the digit
+// grouping separator. Spaces are accepted for grouping in every locale.
+type Locale struct {
+	Decimal rune
+	Group   rune
+}
+
+var (
+	LocaleEnglish = Locale{Decimal: '.', Group: ','}
+	LocaleGerman  = Locale{Decimal: ',', Group: '.'}
+	LocaleFrench  = Locale{Decimal: ',', Group: ' '}
+	LocaleSwiss   = Locale{Decimal: '.', Group: '\''}
+)
+
+// localeLanguages maps languages to their locale; a region of Switzerland or
+// Liechtenstein overrides it.
+var localeLanguages = map[string]Locale{
+	"en": LocaleEnglish, "ja": LocaleEnglish, "zh": LocaleEnglish, "ko": LocaleEnglish, "he": LocaleEnglish, "th": LocaleEnglish,
+	"de": LocaleGerman, "nl": LocaleGerman, "es": LocaleGerman, "it": LocaleGerman, "pt": LocaleGerman, "da": LocaleGerman,
+	"id": LocaleGerman, "tr": LocaleGerman, "el": LocaleGerman, "ro": LocaleGerman,
+	"fr": LocaleFrench, "pl": LocaleFrench, "ru": LocaleFrench, "cs": LocaleFrench, "sk": LocaleFrench, "sv": LocaleFrench,
+	"fi": LocaleFrench, "nb": LocaleFrench, "no": LocaleFrench, "uk": LocaleFrench, "hu": LocaleFrench, "bg": LocaleFrench,
+}
+
+// ParseLocale validates a locale such as "en", "de-DE" or "de_CH"; the empty
+// string means English.
+func ParseLocale(s string) (Locale, error) {
+	if s == "" {
+		return LocaleEnglish, nil
+	}
+	language, region, _ := strings.Cut(strings.ToLower(strings.ReplaceAll(s, "_", "-")), "-")
+	locale, ok := localeLanguages[language]
+	if !ok {
+		return Locale{}, fmt.Errorf("unknown locale %q", s)
+	}
+	if region == "ch" || region == "li" {
+		return LocaleSwiss, nil
+	}
+	return locale, nil
+}
+
+func (l Locale) orDefault() Locale {
+	if l.Decimal == 0 {
+		return LocaleEnglish
+	}
+	return l
+}
+
+// columnTypes returns the type of every column of header, or nil if no
+// column is typed.
+func (m *CSVMerger) columnTypes(header []string) ([]ColumnType, error) {
+	if len(m.opts.ColumnTypes) == 0 {
+		return nil, nil
+	}
+	types := make([]ColumnType, len(header))
+	for column, t := range m.opts.ColumnTypes {
+		i, err := columnIndex(header, column)
+		if err != nil || i >= len(header) {
+			return nil, fmt.Errorf("typed column %q not found in header", column)
+		}
+		types[i] = t
+	}
+	return types, nil
+}
+
+// normalise rewrites the values of the typed columns of record in their
+// canonical format. Empty values and the fill value are kept.
+func (m *CSVMerger) normalise(record []string, types []ColumnType, header []string) error {
+	for i, t := range types {
+		if t == "" || i >= len(record) {
+			continue
+		}
+		value := strings.TrimSpace(record[i])
+		if value == "" || m.opts.Fill != "" && value == m.opts.Fill {
+			continue
+		}
+		normalised, ok := normaliseNumber(value, t, m.opts.Locale.orDefault())
+		if !ok {
+			return fmt.Errorf("invalid %s %q in column %q", t, value, strings.TrimSpace(header[i]))
+		}
+		record[i] = normalised
+	}
+	return nil
+}
+
+// normaliseNumber parses a value of the given type written in the locale
+// and formats it canonically; false if it is not a number of the type.
+func normaliseNumber(value string, t ColumnType, locale Locale) (string, bool) {
+	s := value
+	negative := false
+	if inner, ok := strings.CutPrefix(s, "("); ok {
+		if s, ok = strings.CutSuffix(inner, ")"); !ok {
+			return "", false
+		}
+		negative = true
+	}
+	s, negative = cutSign(s, negative)
+	if t == TypePercent {
+		s = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(s, "%"), "%"))
+	}
+	if t == TypeCurrency {
+		s = trimCurrency(s)
+		s, negative = cutSign(s, negative)
+	}
+
+	var integer, fraction strings.Builder
+	decimal := false
+	digits := 0 // since the last group separator
+	grouped := false
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			if decimal {
+				fraction.WriteRune(r)
+			} else {
+				integer.WriteRune(r)
+				digits++
+			}
+		case r == locale.Decimal && !decimal:
+			decimal = true
+			if grouped && digits != 3 {
+				return "", false
+			}
+		case !decimal && (r == locale.Group || isSpace(r)):
+			if digits == 0 || digits > 3 || grouped && digits != 3 {
+				return "", false
+			}
+			grouped, digits = true, 0
+		default:
+			return "", false
+		}
+	}
+	if integer.Len() == 0 && fraction.Len() == 0 || grouped && !decimal && digits != 3 {
+		return "", false
+	}
+
+	intPart, fracPart := integer.String(), fraction.String()
+	switch t {
+	case TypeInteger:
+		if strings.Trim(fracPart, "0") != "" {
+			return "", false
+		}
+		fracPart = ""
+	case TypePercent:
+		// Move the decimal point two digits to the left
+		all := intPart + fracPart
+		point := len(intPart) - 2
+		if point < 0 {
+			all = strings.Repeat("0", -point) + all
+			point = 0
+		}
+		intPart, fracPart = all[:point], all[point:]
+		fracPart = strings.TrimRight(fracPart, "0")
+	}
+	return formatNumber(negative, intPart, fracPart), true
+}
+
+// cutSign removes a leading plus and a leading or trailing minus, which
+// flips negative.
+func cutSign(s string, negative bool) (string, bool) {
+	s = strings.TrimSpace(s)
+	if rest, ok := strings.CutPrefix(s, "+"); ok {
+		return strings.TrimSpace(rest), negative
+	}
+	for _, minus := range []string{"-", "\u2212"} {
+		if rest, ok := strings.CutPrefix(s, minus); ok {
+			return strings.TrimSpace(rest), !negative
+		}
+		if rest, ok := strings.CutSuffix(s, minus); ok {
+			return strings.TrimSpace(rest), !negative
+		}
+	}
+	return s, negative
+}
+
+// trimCurrency removes a currency symbol or ISO code before or after the
+// amount.
+func trimCurrency(s string) string {
+	isCurrency := func(r rune) bool {
+		return unicode.Is(unicode.Sc, r) || unicode.IsLetter(r)
+	}
+	s = strings.TrimLeftFunc(s, isCurrency)
+	s = strings.TrimRightFunc(s, isCurrency)
+	return strings.TrimSpace(s)
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\u00a0' || r == '\u202f' // no-break and narrow no-break space
+}
+
+// formatNumber writes a number without grouping, with a point as decimal
+// separator, without leading zeros and without the sign of zero.
+func formatNumber(negative bool, intPart, fracPart string) string {
+	intPart = strings.TrimLeft(intPart, "0")
+	if intPart == "" {
+		intPart = "0"
+	}
+	var b strings.Builder
+	if negative && strings.Trim(intPart+fracPart, "0") != "" {
+		b.WriteByte('-')
+	}
+	b.WriteString(intPart)
+	if fracPart != "" {
+		b.WriteByte('.')
+		b.WriteString(fracPart)
+	}
+	return b.String()
+}
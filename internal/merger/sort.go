@@ -0,0 +1,225 @@
+package merger
+
+import (
+	"container/heap"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spossner/ad-reporting-merger/internal/vfs"
+)
+
+// DefaultSortChunkRows is the number of rows sorted in memory before they are
+// spilled to a temp file.
+const DefaultSortChunkRows = 100000
+
+// rowOrder returns the comparison of rows by the sort keys, resolved against
+// the output header, or by date if there are none. A key naming the date
+// column compares the parsed dates.
+func (m *CSVMerger) rowOrder(header []string) (func(a, b row) int, error) {
+	if len(m.opts.SortKeys) == 0 {
+		return func(a, b row) int {
+			return a.date.Compare(b.date)
+		}, nil
+	}
+	dateIndex, err := m.dateIndex(header)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]int, len(m.opts.SortKeys))
+	for i, key := range m.opts.SortKeys {
+		if keys[i], err = columnIndex(header, key); err != nil {
+			return nil, fmt.Errorf("sort key: %w", err)
+		}
+	}
+	return func(a, b row) int {
+		for _, key := range keys {
+			var c int
+			if key == dateIndex {
+				c = a.date.Compare(b.date)
+			} else {
+				c = strings.Compare(field(a.record, key), field(b.record, key))
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	}, nil
+}
+
+func field(record []string, i int) string {
+	if i < len(record) {
+		return record[i]
+	}
+	return ""
+}
+
+// rowSorter is a stable external merge sort: rows are sorted in chunks that
+// are spilled to temp files and merged when the rows are written.
+type rowSorter struct {
+	compare   func(a, b row) int
+	chunkRows int
+	fs        vfs.FS
+	dir       string
+	rows      []row
+	chunks    []string
+}
+
+func (m *CSVMerger) newSorter(header []string) (*rowSorter, error) {
+	compare, err := m.rowOrder(header)
+	if err != nil {
+		return nil, err
+	}
+	s := &rowSorter{compare: compare, chunkRows: m.opts.SortChunkRows, fs: m.fsys(), dir: m.opts.SortTempDir}
+	if s.chunkRows <= 0 {
+		s.chunkRows = DefaultSortChunkRows
+	}
+	return s, nil
+}
+
+func (s *rowSorter) add(r row) error {
+	s.rows = append(s.rows, r)
+	if len(s.rows) < s.chunkRows {
+		return nil
+	}
+	return s.spill()
+}
+
+// spill writes the sorted rows in memory to a temp file. The parsed date is
+// stored in front of each record so it does not have to be parsed again.
+func (s *rowSorter) spill() error {
+	slices.SortStableFunc(s.rows, s.compare)
+	f, err := vfs.CreateTemp(s.fs, s.dir, "ad-reporting-merger-sort-*.csv")
+	if err != nil {
+		return fmt.Errorf("unable to create sort chunk: %w", err)
+	}
+	s.chunks = append(s.chunks, f.Name())
+
+	w := csv.NewWriter(f)
+	for _, r := range s.rows {
+		w.Write(append([]string{r.date.Format(time.RFC3339Nano)}, r.record...))
+	}
+	w.Flush()
+	err = w.Error()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write sort chunk: %w", err)
+	}
+	s.rows = s.rows[:0]
+	return nil
+}
+
+// writeTo writes all rows in order. Without spilled chunks the rows are
+// sorted in memory.
+func (s *rowSorter) writeTo(w *csv.Writer) error {
+	if len(s.chunks) == 0 {
+		slices.SortStableFunc(s.rows, s.compare)
+		for _, r := range s.rows {
+			if err := w.Write(r.record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(s.rows) > 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+
+	h := &chunkHeap{compare: s.compare}
+	for i, name := range s.chunks {
+		f, err := s.fs.Open(name)
+		if err != nil {
+			return fmt.Errorf("unable to open sort chunk: %w", err)
+		}
+		defer f.Close()
+		c := &chunk{index: i, reader: csv.NewReader(f)}
+		c.reader.FieldsPerRecord = -1
+		if err := c.next(); err != nil {
+			if errors.Is(err, io.EOF) {
+				continue
+			}
+			return err
+		}
+		h.chunks = append(h.chunks, c)
+	}
+	heap.Init(h)
+	for h.Len() > 0 {
+		c := h.chunks[0]
+		if err := w.Write(c.row.record); err != nil {
+			return err
+		}
+		if err := c.next(); errors.Is(err, io.EOF) {
+			heap.Pop(h)
+		} else if err != nil {
+			return err
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	return nil
+}
+
+// close removes the spilled chunks.
+func (s *rowSorter) close() {
+	for _, name := range s.chunks {
+		s.fs.Remove(name)
+	}
+}
+
+// chunk is a spilled run of sorted rows being merged.
+type chunk struct {
+	index  int
+	reader *csv.Reader
+	row    row
+}
+
+func (c *chunk) next() error {
+	record, err := c.reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return err
+		}
+		return fmt.Errorf("unable to read sort chunk: %w", err)
+	}
+	date, err := time.Parse(time.RFC3339Nano, record[0])
+	if err != nil {
+		return fmt.Errorf("unable to read sort chunk: %w", err)
+	}
+	c.row = row{record: record[1:], date: date}
+	return nil
+}
+
+// chunkHeap orders chunks by their current row. Ties go to the earlier chunk,
+// which keeps the sort stable.
+type chunkHeap struct {
+	compare func(a, b row) int
+	chunks  []*chunk
+}
+
+func (h *chunkHeap) Len() int { return len(h.chunks) }
+
+func (h *chunkHeap) Less(i, j int) bool {
+	if c := h.compare(h.chunks[i].row, h.chunks[j].row); c != 0 {
+		return c < 0
+	}
+	return h.chunks[i].index < h.chunks[j].index
+}
+
+func (h *chunkHeap) Swap(i, j int) { h.chunks[i], h.chunks[j] = h.chunks[j], h.chunks[i] }
+
+func (h *chunkHeap) Push(x any) { h.chunks = append(h.chunks, x.(*chunk)) }
+
+func (h *chunkHeap) Pop() any {
+	c := h.chunks[len(h.chunks)-1]
+	h.chunks = h.chunks[:len(h.chunks)-1]
+	return c
+}
@@ -2,36 +2,109 @@ package processor
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
 	"time"
 
 	"github.com/spossner/ad-reporting-merger/internal/config"
 	"github.com/spossner/ad-reporting-merger/internal/detector"
 	"github.com/spossner/ad-reporting-merger/internal/filesystem"
+	"github.com/spossner/ad-reporting-merger/internal/journal"
+	"github.com/spossner/ad-reporting-merger/internal/ledger"
 	"github.com/spossner/ad-reporting-merger/internal/merger"
+	"github.com/spossner/ad-reporting-merger/internal/vfs"
 )
 
 type ProcessingResult struct {
-	Group       config.Group
-	FilesFound  int
-	FilesMerged int
-	DatesFound  []string
-	OutputFile  string
-	Duration    time.Duration
-	Error       error
+	Group         config.Group
+	FilesFound    int
+	FilesMerged   int
+	Files         []string // source files in merge order
+	DatesFound    []string
+	RowsPerFile   []int
+	RowsMerged    int
+	ExistingRows  int               // rows of the existing output in append mode
+	ReplacedRows  int               // existing rows replaced in append mode
+	ReplacedDates []string          // dates whose existing rows were replaced
+	DroppedRows   int               // rows dropped in favour of a newer export of the same date
+	DuplicateRows int               // rows dropped as identical to a row with the same dedupe key
+	ConflictRows  int               // rows dropped with the same dedupe key but different values
+	Duplicates    [][]string        // clusters of source files with identical content
+	AlreadyMerged []detector.Merged // source files merged into the output by an earlier run
+	Skipped       []string          // duplicate copies and already merged files that were not merged
+	SkippedTo     []string          // new location of each skipped file when moved aside
+	Restated      []merger.RestatedDate
+	SkippedLines  []merger.Skipped // preamble and footer lines of the source files that were not merged
+	Warnings      []string
+	InProgress    []filesystem.InProgress // matching files still being downloaded or written
+	Disposal      filesystem.Disposal
+	Disposed      []string // source files disposed of, or that would be in a dry run
+	DisposedTo    []string // new location of each disposed file when archived or trashed
+	OutputFile    string
+	DryRun        bool
+	Duration      time.Duration
+	Error         error
 }
 
+type VerificationResult struct {
+	Group        config.Group
+	OutputFile   string
+	Sources      []string
+	Verification *merger.Verification
+	Error        error
+}
+
+// JournalDir holds the journals of running transactions, relative to the work
+// dir.
+const JournalDir = ".ad-reporting-merger/journal"
+
 type Processor struct {
 	fileOps  *filesystem.FileOperations
 	detector *detector.DuplicateDetector
-	merger   *merger.CSVMerger
+	dryRun   bool
+	runID    string   // recorded in the ledger for every merged file
+	outputs  []string // of all configured groups, never merged as sources
+}
+
+type Option func(*Processor)
+
+// WithDryRun makes the processor compute the full result of every group
+// without writing outputs or deleting source files.
+func WithDryRun() Option {
+	return func(p *Processor) {
+		p.dryRun = true
+	}
 }
 
-func NewProcessor(fileOps *filesystem.FileOperations) *Processor {
-	return &Processor{
-		fileOps:  fileOps,
-		detector: detector.NewDuplicateDetector(),
-		merger:   merger.NewCSVMerger(),
+// WithFS makes the processor find, merge and dispose of files in fsys instead
+// of the file system of fileOps, e.g. in memory or in an overlay.
+func WithFS(fsys vfs.FS) Option {
+	return func(p *Processor) {
+		p.fileOps = p.fileOps.WithFS(fsys)
+	}
+}
+
+// WithOutputs keeps the outputs of all configured groups from being found as
+// source files of any group, e.g. by a "*.csv" glob. The output of the group
+// being processed is always left out.
+func WithOutputs(outputs ...string) Option {
+	return func(p *Processor) {
+		p.outputs = append(p.outputs, outputs...)
+	}
+}
+
+func NewProcessor(fileOps *filesystem.FileOperations, opts ...Option) *Processor {
+	p := &Processor{
+		fileOps: fileOps,
+		runID:   fmt.Sprintf("%s-%d", time.Now().Format("20060102T150405"), os.Getpid()),
+	}
+	for _, opt := range opts {
+		opt(p)
 	}
+	p.detector = detector.NewDuplicateDetectorFS(p.fileOps.FS())
+	return p
 }
 
 func (p *Processor) ProcessGroup(group config.Group) *ProcessingResult {
@@ -39,9 +112,19 @@ func (p *Processor) ProcessGroup(group config.Group) *ProcessingResult {
 	result := &ProcessingResult{
 		Group:      group,
 		OutputFile: group.Output,
+		DryRun:     p.dryRun,
 	}
 
-	files, err := p.fileOps.FindFiles(group.Prefix)
+	s, err := p.groupSettings(group)
+	if err != nil {
+		result.Error = err
+		result.Duration = time.Since(start)
+		return result
+	}
+	result.OutputFile = s.output
+	result.Disposal = s.disposal
+
+	files, inProgress, err := p.fileOps.FindCompleteFiles(s.search)
 	if err != nil {
 		result.Error = fmt.Errorf("failed to find files: %w", err)
 		result.Duration = time.Since(start)
@@ -49,52 +132,408 @@ func (p *Processor) ProcessGroup(group config.Group) *ProcessingResult {
 	}
 
 	result.FilesFound = len(files)
+	result.InProgress = inProgress
 
 	if len(files) == 0 {
-		result.Error = fmt.Errorf("no files found for pattern: %s", group.Prefix)
+		if len(inProgress) > 0 {
+			result.Error = fmt.Errorf("no complete files found for pattern: %s (%d in progress)", group.Name(), len(inProgress))
+		} else {
+			result.Error = fmt.Errorf("no files found for pattern: %s", group.Name())
+		}
 		result.Duration = time.Since(start)
 		return result
 	}
 
-	hasDuplicates, err := p.detector.HasDuplicates(files)
+	clusters, err := p.detector.FindDuplicates(files)
 	if err != nil {
 		result.Error = fmt.Errorf("failed to check duplicates: %w", err)
 		result.Duration = time.Since(start)
 		return result
 	}
+	result.Duplicates = clusters
+
+	if len(clusters) > 0 {
+		if s.duplicates == DuplicatesAbort {
+			result.Error = fmt.Errorf("duplicate file content found in group: %s", group.Name())
+			result.Duration = time.Since(start)
+			return result
+		}
+		files, result.Skipped, err = skipDuplicates(p.fileOps.FS(), files, clusters, s.duplicates)
+		if err != nil {
+			result.Error = fmt.Errorf("failed to check duplicates: %w", err)
+			result.Duration = time.Since(start)
+			return result
+		}
+	}
 
-	if hasDuplicates {
-		result.Error = fmt.Errorf("duplicate file content found in group: %s", group.Prefix)
+	l, err := ledger.Open(p.fileOps.FS(), ledger.Path(s.output))
+	if err != nil {
+		result.Error = fmt.Errorf("failed to open ledger: %w", err)
 		result.Duration = time.Since(start)
 		return result
 	}
+	// Only appending merges a file into rows it was merged into before;
+	// replacing rebuilds the output from the current files.
+	if s.mode == ModeAppend {
+		result.AlreadyMerged, err = p.detector.FindMerged(files, l, group.Output)
+		if err != nil {
+			result.Error = fmt.Errorf("failed to check ledger: %w", err)
+			result.Duration = time.Since(start)
+			return result
+		}
+	}
+	if len(result.AlreadyMerged) > 0 {
+		if s.duplicates == DuplicatesAbort {
+			result.Error = fmt.Errorf("%d files were already merged into %s", len(result.AlreadyMerged), group.Output)
+			result.Duration = time.Since(start)
+			return result
+		}
+		files = skipMerged(files, result)
+	}
 
-	dates, err := p.merger.MergeFiles(files, group.Output)
-	if err != nil {
-		result.Error = fmt.Errorf("failed to merge files: %w", err)
+	if p.dryRun {
+		var mergedFiles []string
+		if len(files) > 0 {
+			merged, err := p.merge(group, s, files, io.Discard)
+			if err != nil {
+				result.Error = fmt.Errorf("failed to merge files: %w", err)
+				result.Duration = time.Since(start)
+				return result
+			}
+			result.setMerged(merged)
+			mergedFiles = merged.Files
+		}
+		if s.disposal != filesystem.DisposalKeep {
+			result.Disposed = sources(mergedFiles, s, result.Skipped)
+		}
 		result.Duration = time.Since(start)
 		return result
 	}
 
-	result.FilesMerged = len(files)
-	result.DatesFound = dates
+	tx, err := journal.Begin(p.fileOps.FS(), p.journalDir(), s.output)
+	if err != nil {
+		result.Error = fmt.Errorf("failed to start transaction: %w", err)
+		result.Duration = time.Since(start)
+		return result
+	}
 
-	// Clean up source files
-	err = p.fileOps.DeleteFiles(files)
+	entries, err := p.processTransaction(tx, group, s, files, result)
 	if err != nil {
-		result.Error = fmt.Errorf("failed to delete source files: %w", err)
+		result.Disposed, result.DisposedTo, result.SkippedTo = nil, nil, nil
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			err = fmt.Errorf("%w; rollback failed, journal kept in %s: %v", err, tx.Dir(), rollbackErr)
+		}
+		result.Error = err
 		result.Duration = time.Since(start)
 		return result
 	}
 
+	// The ledger is only updated once the transaction is complete: a merged
+	// file missing from it can be merged again, while one recorded for a
+	// rolled back merge would be skipped for good.
+	l.Add(entries...)
+	if err := l.Save(); err != nil {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("failed to update ledger: %v", err))
+	}
+
 	result.Duration = time.Since(start)
 	return result
 }
 
+// processTransaction writes the merge to a temp file, replaces the output with
+// it and only then disposes of the sources, recording every step in tx. It
+// returns the ledger entries of the merged files. Without files to merge, only
+// skipped files are disposed of.
+func (p *Processor) processTransaction(tx *journal.Transaction, group config.Group, s *settings, files []string, result *ProcessingResult) ([]ledger.Entry, error) {
+	var mergedFiles []string
+	var entries []ledger.Entry
+	if len(files) > 0 {
+		temp, err := tx.CreateTemp()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temp file: %w", err)
+		}
+		merged, err := p.merge(group, s, files, temp)
+		if err != nil {
+			temp.Close()
+			return nil, fmt.Errorf("failed to merge files: %w", err)
+		}
+		if err := tx.Commit(temp); err != nil {
+			return nil, fmt.Errorf("failed to write output: %w", err)
+		}
+		result.setMerged(merged)
+		mergedFiles = merged.Files
+
+		// Hash the sources before they are disposed of
+		if entries, err = p.ledgerEntries(group, merged); err != nil {
+			return nil, err
+		}
+	}
+
+	// Clean up source files
+	for _, file := range sources(mergedFiles, s, result.Skipped) {
+		dst, err := p.dispose(tx, group, s.disposal, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to %s source files: %w", s.disposal, err)
+		}
+		if s.disposal == filesystem.DisposalKeep {
+			continue
+		}
+		result.Disposed = append(result.Disposed, file)
+		if dst != "" {
+			result.DisposedTo = append(result.DisposedTo, dst)
+		}
+	}
+	if s.duplicates == DuplicatesMoveAside {
+		for _, file := range result.Skipped {
+			dst, err := p.fileOps.MoveAside(file, group.DuplicatesDir, func(dst, _ string) error {
+				return tx.RecordMove(file, dst, "")
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to move aside duplicates: %w", err)
+			}
+			result.SkippedTo = append(result.SkippedTo, dst)
+		}
+	}
+
+	if err := tx.Finish(); err != nil {
+		if !tx.State().Completed {
+			return nil, fmt.Errorf("failed to finish transaction: %w", err)
+		}
+		// The merge is complete, only its journal is left for the next run
+		// to remove
+		result.Warnings = append(result.Warnings, fmt.Sprintf("failed to remove journal %s: %v", tx.Dir(), err))
+	}
+	return entries, nil
+}
+
+// ledgerEntries records the merged files for the ledger.
+func (p *Processor) ledgerEntries(group config.Group, merged *merger.MergeResult) ([]ledger.Entry, error) {
+	now := time.Now()
+	entries := make([]ledger.Entry, len(merged.Files))
+	for i, file := range merged.Files {
+		hash, err := detector.HashFile(p.fileOps.FS(), file)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = ledger.Entry{
+			Hash:      hash,
+			File:      file,
+			Output:    group.Output,
+			FirstDate: merged.Dates[i],
+			LastDate:  merged.LastDates[i],
+			Rows:      merged.RowsPerFile[i],
+			RunID:     p.runID,
+			Merged:    now,
+		}
+	}
+	return entries, nil
+}
+
+// sources returns the source files to dispose of: the merged files and the
+// skipped duplicates, unless these are moved aside.
+func sources(merged []string, s *settings, skipped []string) []string {
+	if s.duplicates == DuplicatesMoveAside {
+		return merged
+	}
+	return append(slices.Clone(merged), skipped...)
+}
+
+// skipMerged removes the files merged by an earlier run and adds them to the
+// skipped files of the result.
+func skipMerged(files []string, result *ProcessingResult) []string {
+	skip := make(map[string]bool)
+	for _, m := range result.AlreadyMerged {
+		skip[m.File] = true
+		result.Skipped = append(result.Skipped, m.File)
+	}
+	return slices.DeleteFunc(files, func(file string) bool {
+		return skip[file]
+	})
+}
+
+// skipDuplicates keeps one file of every cluster, the newest for keep-newest
+// and the oldest otherwise, and returns the remaining files and the skipped
+// copies.
+func skipDuplicates(fsys vfs.FS, files []string, clusters [][]string, policy Duplicates) ([]string, []string, error) {
+	skip := make(map[string]bool)
+	var skipped []string
+	for _, cluster := range clusters {
+		var keep string
+		var keepTime time.Time
+		for _, file := range cluster {
+			info, err := fsys.Stat(file)
+			if err != nil {
+				return nil, nil, err
+			}
+			modTime := info.ModTime()
+			if keep == "" ||
+				policy == DuplicatesKeepNewest && modTime.After(keepTime) ||
+				policy != DuplicatesKeepNewest && modTime.Before(keepTime) {
+				keep, keepTime = file, modTime
+			}
+		}
+		for _, file := range cluster {
+			if file != keep {
+				skip[file] = true
+				skipped = append(skipped, file)
+			}
+		}
+	}
+
+	var kept []string
+	for _, file := range files {
+		if !skip[file] {
+			kept = append(kept, file)
+		}
+	}
+	return kept, skipped, nil
+}
+
+// merge writes the merged rows to w, combining them with the existing output
+// in append mode. The existing output is only replaced once the transaction
+// commits, so it can still be read here.
+func (p *Processor) merge(group config.Group, s *settings, files []string, w io.Writer) (*merger.MergeResult, error) {
+	m := merger.NewCSVMergerWithOptions(s.merge)
+	if s.mode == ModeAppend {
+		return m.Append(files, s.output, w)
+	}
+	return m.Merge(files, w)
+}
+
+// dispose applies the disposal policy to a single source file and returns its
+// new location when it was archived or trashed. Deleted files are staged in the
+// transaction and removed when it finishes.
+func (p *Processor) dispose(tx *journal.Transaction, group config.Group, disposal filesystem.Disposal, file string) (string, error) {
+	// Moves are recorded before they happen, so that an interrupted one can
+	// be rolled back
+	record := func(dst, trashInfo string) error {
+		return tx.RecordMove(file, dst, trashInfo)
+	}
+	switch disposal {
+	case filesystem.DisposalArchive:
+		return p.fileOps.ArchiveFile(file, group.ArchiveDir, record)
+	case filesystem.DisposalTrash:
+		return p.fileOps.TrashFile(file, record)
+	case filesystem.DisposalKeep:
+		return "", nil
+	}
+	return "", tx.Stage(file)
+}
+
+// Recover rolls back groups left half-processed by an interrupted run.
+func (p *Processor) Recover() ([]journal.State, error) {
+	return journal.Recover(p.fileOps.FS(), p.journalDir())
+}
+
+func (p *Processor) journalDir() string {
+	return filepath.Join(p.fileOps.WorkDir(), JournalDir)
+}
+
+// groupSettings parses the settings of the group, resolves its output against
+// the work dir and merges in the file system of the processor.
+func (p *Processor) groupSettings(group config.Group) (*settings, error) {
+	s, err := parseSettings(group)
+	if err != nil {
+		return nil, err
+	}
+	if s.output, err = p.fileOps.Resolve(group.Output); err != nil {
+		return nil, err
+	}
+	s.merge.FS = p.fileOps.FS()
+	s.merge.DryRun = p.dryRun
+	s.search.SkipFiles = append([]string{s.output}, p.outputs...)
+	return s, nil
+}
+
+func (r *ProcessingResult) setMerged(merged *merger.MergeResult) {
+	r.FilesMerged = len(merged.Files)
+	r.Files = merged.Files
+	r.DatesFound = merged.Dates
+	r.RowsPerFile = merged.RowsPerFile
+	r.RowsMerged = merged.Rows
+	r.ExistingRows = merged.ExistingRows
+	r.ReplacedRows = merged.ReplacedRows
+	r.ReplacedDates = merged.ReplacedDates
+	r.DroppedRows = merged.DroppedRows
+	r.DuplicateRows = merged.DuplicateRows
+	r.ConflictRows = merged.ConflictingRows
+	r.Restated = merged.Restated
+	r.SkippedLines = merged.Skipped
+	for _, mismatch := range merged.HeaderMismatches {
+		r.Warnings = append(r.Warnings, fmt.Sprintf("header of %s differs: %s", mismatch.File, mismatch.Diff))
+	}
+	for _, mismatch := range merged.DialectMismatches {
+		r.Warnings = append(r.Warnings, fmt.Sprintf("%s looks like %s, expected %s", mismatch.File, mismatch.Found, mismatch.Expected))
+	}
+}
+
+// ListFiles returns the files matching the group with their detected dates.
+func (p *Processor) ListFiles(group config.Group) ([]merger.FileDate, error) {
+	s, err := p.groupSettings(group)
+	if err != nil {
+		return nil, err
+	}
+	files, err := p.fileOps.FindFiles(s.search)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find files: %w", err)
+	}
+	return merger.NewCSVMergerWithOptions(s.merge).SortByDate(files), nil
+}
+
+// History returns the ledger entries of the files merged into the group's
+// output whose name contains file.
+func (p *Processor) History(group config.Group, file string) ([]ledger.Entry, error) {
+	output, err := p.fileOps.Resolve(group.Output)
+	if err != nil {
+		return nil, err
+	}
+	l, err := ledger.Open(p.fileOps.FS(), ledger.Path(output))
+	if err != nil {
+		return nil, err
+	}
+	return l.Find(ledger.Query{Output: group.Output, File: file}), nil
+}
+
+// VerifyGroup checks the group's existing output against the source files
+// that are still present.
+func (p *Processor) VerifyGroup(group config.Group) *VerificationResult {
+	result := &VerificationResult{
+		Group:      group,
+		OutputFile: group.Output,
+	}
+
+	s, err := p.groupSettings(group)
+	if err != nil {
+		result.Error = err
+		return result
+	}
+	result.OutputFile = s.output
+
+	files, err := p.fileOps.FindFiles(s.search)
+	if err != nil {
+		result.Error = fmt.Errorf("failed to find files: %w", err)
+		return result
+	}
+	result.Sources = files
+
+	result.Verification, err = merger.NewCSVMergerWithOptions(s.merge).Verify(files, s.output)
+	if err != nil {
+		result.Error = fmt.Errorf("failed to verify output: %w", err)
+	}
+	return result
+}
+
+// ProcessAllGroups processes the groups in order. No group merges the output
+// of another as a source.
 func (p *Processor) ProcessAllGroups(groups []config.Group) []*ProcessingResult {
+	all := *p
+	all.outputs = slices.Clone(p.outputs)
+	for _, group := range groups {
+		all.outputs = append(all.outputs, group.Output)
+	}
 	results := make([]*ProcessingResult, len(groups))
 	for i, group := range groups {
-		results[i] = p.ProcessGroup(group)
+		results[i] = all.ProcessGroup(group)
 	}
 	return results
 }
@@ -1,12 +1,19 @@
 package processor
 
 import (
+	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/spossner/ad-reporting-merger/internal/config"
 	"github.com/spossner/ad-reporting-merger/internal/filesystem"
+	"github.com/spossner/ad-reporting-merger/internal/merger"
+	"github.com/spossner/ad-reporting-merger/internal/vfs"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -38,14 +45,6 @@ func TestProcessGroup(t *testing.T) {
 
 	processor := NewProcessor(fileOps)
 
-	// Save current directory
-	originalDir, _ := os.Getwd()
-	defer os.Chdir(originalDir)
-
-	// Change to test directory
-	err = fileOps.ChangeToWorkDir()
-	require.NoError(t, err)
-
 	group := config.Group{
 		Prefix: "AdManager Reporting",
 		Output: "test-output.csv",
@@ -98,14 +97,6 @@ func TestProcessGroupNoDuplicates(t *testing.T) {
 
 	processor := NewProcessor(fileOps)
 
-	// Save current directory
-	originalDir, _ := os.Getwd()
-	defer os.Chdir(originalDir)
-
-	// Change to test directory
-	err = fileOps.ChangeToWorkDir()
-	require.NoError(t, err)
-
 	group := config.Group{
 		Prefix: "AdManager Reporting",
 		Output: "test-output.csv",
@@ -134,14 +125,6 @@ func TestProcessAllGroups(t *testing.T) {
 
 	processor := NewProcessor(fileOps)
 
-	// Save current directory
-	originalDir, _ := os.Getwd()
-	defer os.Chdir(originalDir)
-
-	// Change to test directory
-	err = fileOps.ChangeToWorkDir()
-	require.NoError(t, err)
-
 	groups := []config.Group{
 		{Prefix: "AdManager Reporting", Output: "test1.csv"},
 		{Prefix: "Revenue per AdUnit", Output: "test2.csv"},
@@ -157,4 +140,784 @@ func TestProcessAllGroups(t *testing.T) {
 			assert.Error(t, result.Error, "Expected error for group %d (no files)", i)
 		}
 	})
-}
\ No newline at end of file
+}
+
+func TestProcessGroupDryRun(t *testing.T) {
+	// Create temporary directory
+	tmpDir, err := os.MkdirTemp("", "processor_dry_run_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	file1 := filepath.Join(tmpDir, "AdManager Reporting_b.csv")
+	file2 := filepath.Join(tmpDir, "AdManager Reporting_a.csv")
+	require.NoError(t, os.WriteFile(file1, []byte("Date,Value\n2025-01-01,100\n2025-01-01,150\n"), 0644))
+	require.NoError(t, os.WriteFile(file2, []byte("Date,Value\n2025-01-02,200\n"), 0644))
+
+	fileOps, err := filesystem.NewFileOperations(tmpDir)
+	require.NoError(t, err)
+
+	processor := NewProcessor(fileOps, WithDryRun())
+
+	result := processor.ProcessGroup(config.Group{Prefix: "AdManager Reporting", Output: "plan.csv"})
+	require.NoError(t, result.Error)
+	assert.True(t, result.DryRun)
+	assert.Equal(t, 2, result.FilesFound)
+	assert.Equal(t, []string{file1, file2}, result.Files)
+	assert.Equal(t, []string{"2025-01-01", "2025-01-02"}, result.DatesFound)
+	assert.Equal(t, []int{2, 1}, result.RowsPerFile)
+	assert.Equal(t, 3, result.RowsMerged)
+	assert.Equal(t, filesystem.DisposalDelete, result.Disposal)
+	assert.Equal(t, result.Files, result.Disposed)
+
+	_, err = os.Stat(filepath.Join(tmpDir, "plan.csv"))
+	assert.True(t, os.IsNotExist(err), "Dry run must not create the output")
+	_, err = os.Stat(file1)
+	assert.NoError(t, err, "Dry run must not delete sources")
+	_, err = os.Stat(file2)
+	assert.NoError(t, err, "Dry run must not delete sources")
+}
+
+func TestProcessGroupDisposal(t *testing.T) {
+	// Create temporary directory
+	tmpDir, err := os.MkdirTemp("", "processor_disposal_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fileOps, err := filesystem.NewFileOperations(tmpDir)
+	require.NoError(t, err)
+
+	processor := NewProcessor(fileOps)
+
+	source := filepath.Join(tmpDir, "AdManager Reporting_2025-01-01.csv")
+
+	t.Run("archive", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(source, []byte("Date,Value\n2025-01-01,100\n"), 0644))
+
+		result := processor.ProcessGroup(config.Group{Prefix: "AdManager Reporting", Output: "out.csv", Disposal: "archive"})
+		require.NoError(t, result.Error)
+		assert.Equal(t, filesystem.DisposalArchive, result.Disposal)
+		require.Len(t, result.DisposedTo, 1)
+
+		_, err := os.Stat(source)
+		assert.True(t, os.IsNotExist(err), "Source should have been archived")
+		_, err = os.Stat(result.DisposedTo[0])
+		assert.NoError(t, err, "Archived file should exist")
+	})
+
+	t.Run("keep", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(source, []byte("Date,Value\n2025-01-01,100\n"), 0644))
+
+		result := processor.ProcessGroup(config.Group{Prefix: "AdManager Reporting", Output: "out.csv", Disposal: "keep"})
+		require.NoError(t, result.Error)
+		assert.Empty(t, result.Disposed)
+
+		_, err := os.Stat(source)
+		assert.NoError(t, err, "Source should have been kept")
+	})
+
+	t.Run("unknown policy", func(t *testing.T) {
+		result := processor.ProcessGroup(config.Group{Prefix: "AdManager Reporting", Output: "out.csv", Disposal: "shred"})
+		assert.Error(t, result.Error)
+		assert.Equal(t, 0, result.FilesFound)
+	})
+}
+
+func TestProcessGroupRollback(t *testing.T) {
+	// Create temporary directory
+	tmpDir, err := os.MkdirTemp("", "processor_rollback_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	file1 := filepath.Join(tmpDir, "AdManager Reporting_2025-01-01.csv")
+	file2 := filepath.Join(tmpDir, "AdManager Reporting_2025-01-02.csv")
+	output := filepath.Join(tmpDir, "out.csv")
+	require.NoError(t, os.WriteFile(file1, []byte("Date,Value\n2025-01-01,100\n"), 0644))
+	require.NoError(t, os.WriteFile(file2, []byte("Date,Value\n2025-01-02,200\n"), 0644))
+	require.NoError(t, os.WriteFile(output, []byte("previous\n"), 0644))
+
+	// A file where the archive dir should be makes archiving fail
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "blocked"), nil, 0644))
+
+	fileOps, err := filesystem.NewFileOperations(tmpDir)
+	require.NoError(t, err)
+
+	processor := NewProcessor(fileOps)
+
+	result := processor.ProcessGroup(config.Group{
+		Prefix:     "AdManager Reporting",
+		Output:     "out.csv",
+		Disposal:   "archive",
+		ArchiveDir: "blocked",
+	})
+	assert.Error(t, result.Error)
+	assert.Empty(t, result.Disposed)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "previous\n", string(content), "Previous output should be restored")
+
+	_, err = os.Stat(file1)
+	assert.NoError(t, err, "Source file1 should be restored")
+	_, err = os.Stat(file2)
+	assert.NoError(t, err, "Source file2 should be restored")
+
+	entries, err := os.ReadDir(filepath.Join(tmpDir, JournalDir))
+	require.NoError(t, err)
+	assert.Empty(t, entries, "Journal should be removed after rollback")
+}
+
+// journalLeftBehind fails to remove journals, as a file system that keeps a
+// journal dir busy would.
+type journalLeftBehind struct {
+	*vfs.MemFS
+}
+
+func (f journalLeftBehind) RemoveAll(path string) error {
+	if strings.Contains(path, JournalDir) {
+		return fmt.Errorf("remove %s: device or resource busy", path)
+	}
+	return f.MemFS.RemoveAll(path)
+}
+
+func TestProcessGroupJournalLeftBehind(t *testing.T) {
+	fsys := journalLeftBehind{vfs.NewMemFS()}
+	workDir := "/reports"
+	require.NoError(t, fsys.MkdirAll(workDir, 0755))
+	require.NoError(t, vfs.WriteFile(fsys, filepath.Join(workDir, "AdManager Reporting_1.csv"), []byte("Date,Value\n2025-01-01,100\n"), 0644))
+	require.NoError(t, vfs.WriteFile(fsys, filepath.Join(workDir, "out.csv"), []byte("previous\n"), 0644))
+	fileOps, err := filesystem.NewFileOperations(workDir)
+	require.NoError(t, err)
+
+	result := NewProcessor(fileOps, WithFS(fsys)).ProcessGroup(config.Group{Prefix: "AdManager Reporting", Output: "out.csv", Disposal: "delete"})
+	require.NoError(t, result.Error, "A completed merge must not be rolled back")
+	require.Len(t, result.Warnings, 1)
+	assert.Contains(t, result.Warnings[0], "failed to remove journal")
+	assert.Equal(t, []string{filepath.Join(workDir, "AdManager Reporting_1.csv")}, result.Disposed)
+
+	output, err := fs.ReadFile(fsys, filepath.Join(workDir, "out.csv"))
+	require.NoError(t, err)
+	assert.Equal(t, "Date,Value\n2025-01-01,100\n", string(output))
+	_, err = fsys.Stat(filepath.Join(workDir, "AdManager Reporting_1.csv"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestProcessGroupAppend(t *testing.T) {
+	// Create temporary directory
+	tmpDir, err := os.MkdirTemp("", "processor_append_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	output := filepath.Join(tmpDir, "out.csv")
+	source := filepath.Join(tmpDir, "AdManager Reporting_2025-01-02.csv")
+
+	fileOps, err := filesystem.NewFileOperations(tmpDir)
+	require.NoError(t, err)
+
+	processor := NewProcessor(fileOps)
+
+	group := config.Group{Prefix: "AdManager Reporting", Output: "out.csv", Mode: "append"}
+
+	t.Run("append new date", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(output, []byte("2025-01-01,100\n"), 0644))
+		require.NoError(t, os.WriteFile(source, []byte("Date,Value\n2025-01-02,200\n"), 0644))
+
+		result := processor.ProcessGroup(group)
+		require.NoError(t, result.Error)
+		assert.Equal(t, 1, result.ExistingRows)
+
+		content, err := os.ReadFile(output)
+		require.NoError(t, err)
+		assert.Equal(t, "Date,Value\n2025-01-01,100\n2025-01-02,200\n", string(content))
+	})
+
+	t.Run("reject date already present", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(source, []byte("Date,Value\n2025-01-02,222\n"), 0644))
+
+		result := processor.ProcessGroup(group)
+		assert.Error(t, result.Error)
+
+		content, err := os.ReadFile(output)
+		require.NoError(t, err)
+		assert.Equal(t, "Date,Value\n2025-01-01,100\n2025-01-02,200\n", string(content), "Output must be unchanged")
+		_, err = os.Stat(source)
+		assert.NoError(t, err, "Source must be kept")
+	})
+
+	t.Run("replace date already present", func(t *testing.T) {
+		replace := group
+		replace.Overlap = "replace"
+
+		result := processor.ProcessGroup(replace)
+		require.NoError(t, result.Error)
+		assert.Equal(t, []string{"2025-01-02"}, result.ReplacedDates)
+
+		content, err := os.ReadFile(output)
+		require.NoError(t, err)
+		assert.Equal(t, "Date,Value\n2025-01-01,100\n2025-01-02,222\n", string(content))
+	})
+
+	t.Run("unknown mode", func(t *testing.T) {
+		result := processor.ProcessGroup(config.Group{Prefix: "AdManager Reporting", Output: "out.csv", Mode: "upsert"})
+		assert.Error(t, result.Error)
+	})
+}
+
+func TestProcessGroupRestatement(t *testing.T) {
+	// Create temporary directory
+	tmpDir, err := os.MkdirTemp("", "processor_restatement_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	original := filepath.Join(tmpDir, "Revenue per AdUnit_2025-01-02.csv")
+	restated := filepath.Join(tmpDir, "Revenue per AdUnit_2025-01-02 (1).csv")
+	require.NoError(t, os.WriteFile(original, []byte("Date,Value\n2025-01-02,200\n"), 0644))
+	require.NoError(t, os.WriteFile(restated, []byte("Date,Value\n2025-01-02,210\n"), 0644))
+
+	fileOps, err := filesystem.NewFileOperations(tmpDir)
+	require.NoError(t, err)
+
+	processor := NewProcessor(fileOps, WithDryRun())
+
+	result := processor.ProcessGroup(config.Group{Prefix: "Revenue per AdUnit", Output: "out.csv", Restatement: "suffix"})
+	require.NoError(t, result.Error)
+	assert.Equal(t, 1, result.RowsMerged)
+	assert.Equal(t, 1, result.DroppedRows)
+	require.Len(t, result.Restated, 1)
+	assert.Equal(t, restated, result.Restated[0].Kept)
+	assert.Equal(t, []string{original}, result.Restated[0].Dropped)
+}
+
+func TestProcessGroupDedupe(t *testing.T) {
+	// Create temporary directory
+	tmpDir, err := os.MkdirTemp("", "processor_dedupe_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "Revenue per AdUnit_week.csv"), []byte("Date,Ad Unit,Value\n2025-01-01,Top,100\n2025-01-02,Top,200\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "Revenue per AdUnit_2025-01-02.csv"), []byte("Date,Ad Unit,Value\n2025-01-02,Top,210\n"), 0644))
+
+	fileOps, err := filesystem.NewFileOperations(tmpDir)
+	require.NoError(t, err)
+
+	processor := NewProcessor(fileOps, WithDryRun())
+
+	group := config.Group{Prefix: "Revenue per AdUnit", Output: "out.csv", DedupeKeys: []string{"Date", "Ad Unit"}, Dedupe: "last-wins"}
+	result := processor.ProcessGroup(group)
+	require.NoError(t, result.Error)
+	assert.Equal(t, 2, result.RowsMerged)
+	assert.Equal(t, 0, result.DuplicateRows)
+	assert.Equal(t, 1, result.ConflictRows)
+
+	group.Dedupe = "error-on-conflict"
+	result = processor.ProcessGroup(group)
+	assert.ErrorContains(t, result.Error, "conflict")
+}
+
+func TestProcessGroupHeaderMismatch(t *testing.T) {
+	// Create temporary directory
+	tmpDir, err := os.MkdirTemp("", "processor_header_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "AdManager Reporting_1.csv"), []byte("Date,Value\n2025-01-01,100\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "AdManager Reporting_2.csv"), []byte("Date,Amount\n2025-01-02,200\n"), 0644))
+
+	fileOps, err := filesystem.NewFileOperations(tmpDir)
+	require.NoError(t, err)
+
+	processor := NewProcessor(fileOps, WithDryRun())
+
+	result := processor.ProcessGroup(config.Group{Prefix: "AdManager Reporting", Output: "out.csv"})
+	assert.ErrorContains(t, result.Error, `column 2 is "Amount" instead of "Value"`)
+
+	result = processor.ProcessGroup(config.Group{Prefix: "AdManager Reporting", Output: "out.csv", Header: "write"})
+	require.NoError(t, result.Error)
+	require.Len(t, result.Warnings, 1)
+	assert.Contains(t, result.Warnings[0], "AdManager Reporting_2.csv")
+
+	result = processor.ProcessGroup(config.Group{Prefix: "AdManager Reporting", Output: "out.csv", Columns: "union"})
+	require.NoError(t, result.Error)
+	assert.Empty(t, result.Warnings)
+	assert.Equal(t, 2, result.RowsMerged)
+}
+
+func TestProcessGroupDuplicates(t *testing.T) {
+	// Create temporary directory
+	tmpDir, err := os.MkdirTemp("", "processor_duplicates_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	original := filepath.Join(tmpDir, "AdManager Reporting_2025-01-01.csv")
+	duplicate := filepath.Join(tmpDir, "AdManager Reporting_2025-01-01 (1).csv")
+	other := filepath.Join(tmpDir, "AdManager Reporting_2025-01-02.csv")
+	writeSources := func() {
+		content := "Date,Value\n2025-01-01,100\n"
+		require.NoError(t, os.WriteFile(original, []byte(content), 0644))
+		require.NoError(t, os.WriteFile(duplicate, []byte(content), 0644))
+		require.NoError(t, os.WriteFile(other, []byte("Date,Value\n2025-01-02,200\n"), 0644))
+		now := time.Now()
+		require.NoError(t, os.Chtimes(original, now, now.Add(-time.Hour)))
+		require.NoError(t, os.Chtimes(duplicate, now, now))
+	}
+
+	fileOps, err := filesystem.NewFileOperations(tmpDir)
+	require.NoError(t, err)
+
+	group := config.Group{Prefix: "AdManager Reporting", Output: "out.csv"}
+
+	t.Run("abort reports the clusters", func(t *testing.T) {
+		writeSources()
+		result := NewProcessor(fileOps, WithDryRun()).ProcessGroup(group)
+		assert.Error(t, result.Error)
+		assert.Len(t, result.Duplicates, 1)
+	})
+
+	t.Run("keep newest", func(t *testing.T) {
+		writeSources()
+		group := group
+		group.Duplicates = "keep-newest"
+		result := NewProcessor(fileOps, WithDryRun()).ProcessGroup(group)
+		require.NoError(t, result.Error)
+		assert.Equal(t, 2, result.RowsMerged)
+		assert.Contains(t, result.Files, duplicate)
+		assert.Equal(t, []string{original}, result.Skipped)
+		assert.ElementsMatch(t, []string{original, duplicate, other}, result.Disposed)
+	})
+
+	t.Run("move aside", func(t *testing.T) {
+		writeSources()
+		group := group
+		group.Duplicates = "move-aside"
+		result := NewProcessor(fileOps).ProcessGroup(group)
+		require.NoError(t, result.Error)
+		assert.Equal(t, 2, result.RowsMerged)
+		assert.Equal(t, []string{duplicate}, result.Skipped)
+		require.Len(t, result.SkippedTo, 1)
+		assert.Equal(t, filepath.Join(tmpDir, "duplicates", filepath.Base(duplicate)), result.SkippedTo[0])
+		assert.FileExists(t, result.SkippedTo[0])
+		assert.NoFileExists(t, duplicate)
+		assert.NoFileExists(t, original)
+	})
+}
+
+func TestProcessGroupLedger(t *testing.T) {
+	// Create temporary directory
+	tmpDir, err := os.MkdirTemp("", "processor_ledger_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	source := filepath.Join(tmpDir, "AdManager Reporting_2025-01-01.csv")
+	content := []byte("Date,Value\n2025-01-01,100\n2025-01-02,150\n")
+
+	fileOps, err := filesystem.NewFileOperations(tmpDir)
+	require.NoError(t, err)
+
+	processor := NewProcessor(fileOps)
+
+	group := config.Group{Prefix: "AdManager Reporting", Output: "out.csv", Mode: "append"}
+
+	require.NoError(t, os.WriteFile(source, content, 0644))
+	result := processor.ProcessGroup(group)
+	require.NoError(t, result.Error)
+
+	entries, err := processor.History(group, "")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, source, entries[0].File)
+	assert.Equal(t, "2025-01-01", entries[0].FirstDate)
+	assert.Equal(t, "2025-01-02", entries[0].LastDate)
+	assert.Equal(t, 2, entries[0].Rows)
+	assert.Equal(t, processor.runID, entries[0].RunID)
+
+	t.Run("re-downloaded export is rejected", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(source, content, 0644))
+		result := processor.ProcessGroup(group)
+		assert.ErrorContains(t, result.Error, "already merged")
+		require.Len(t, result.AlreadyMerged, 1)
+		assert.FileExists(t, source)
+	})
+
+	t.Run("re-downloaded export is skipped", func(t *testing.T) {
+		skip := group
+		skip.Duplicates = "keep-oldest"
+		result := processor.ProcessGroup(skip)
+		require.NoError(t, result.Error)
+		assert.Equal(t, 0, result.FilesMerged)
+		assert.Equal(t, []string{source}, result.Skipped)
+		assert.NoFileExists(t, source)
+
+		output, err := os.ReadFile(filepath.Join(tmpDir, "out.csv"))
+		require.NoError(t, err)
+		assert.Equal(t, string(content), string(output), "Output must be unchanged")
+	})
+}
+
+func TestProcessGroupInProgress(t *testing.T) {
+	// Create temporary directory
+	tmpDir, err := os.MkdirTemp("", "processor_in_progress_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	complete := filepath.Join(tmpDir, "AdManager Reporting_2025-01-01.csv")
+	download := filepath.Join(tmpDir, "AdManager Reporting_2025-01-02.csv.crdownload")
+	require.NoError(t, os.WriteFile(complete, []byte("Date,Value\n2025-01-01,100\n"), 0644))
+	require.NoError(t, os.WriteFile(download, []byte("Date,Value\n2025-01-02,2"), 0644))
+
+	fileOps, err := filesystem.NewFileOperations(tmpDir)
+	require.NoError(t, err)
+
+	group := config.Group{Prefix: "AdManager Reporting", Output: "out.csv"}
+
+	result := NewProcessor(fileOps).ProcessGroup(group)
+	require.NoError(t, result.Error)
+	assert.Equal(t, []string{complete}, result.Files)
+	assert.Equal(t, []filesystem.InProgress{{File: download, Reason: "download in progress"}}, result.InProgress)
+	assert.NoFileExists(t, complete)
+	assert.FileExists(t, download, "In-progress download must not be disposed of")
+
+	t.Run("only downloads in progress", func(t *testing.T) {
+		result := NewProcessor(fileOps).ProcessGroup(group)
+		assert.ErrorContains(t, result.Error, "1 in progress")
+		assert.Len(t, result.InProgress, 1)
+	})
+
+	t.Run("invalid interval", func(t *testing.T) {
+		invalid := group
+		invalid.StableFor = "soon"
+		result := NewProcessor(fileOps).ProcessGroup(invalid)
+		assert.ErrorContains(t, result.Error, "stable_for")
+	})
+}
+
+func TestProcessGroupMatch(t *testing.T) {
+	// Create temporary directory
+	tmpDir, err := os.MkdirTemp("", "processor_match_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for name, content := range map[string]string{
+		"Revenue per AdUnit_2025-01-02.csv":     "Date,Value\n2025-01-02,200\n",
+		"Revenue per AdUnit_2025-01-01.csv":     "Date,Value\n2025-01-01,100\n",
+		"Revenue per AdUnit_2025-01-01 (1).csv": "Date,Value\n2025-01-01,999\n",
+		"Revenue per AdUnit_2025-01-03.xlsx":    "not a csv",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644))
+	}
+
+	fileOps, err := filesystem.NewFileOperations(tmpDir)
+	require.NoError(t, err)
+
+	group := config.Group{
+		Output: "revenue.csv",
+		Match: &config.Match{
+			Regex:      `^Revenue per AdUnit_(?P<date>\d{4}-\d{2}-\d{2})`,
+			Extensions: []string{".csv"},
+			Exclude:    []string{"* (*).csv"},
+		},
+	}
+
+	result := NewProcessor(fileOps, WithDryRun()).ProcessGroup(group)
+	require.NoError(t, result.Error)
+	assert.Equal(t, []string{
+		filepath.Join(tmpDir, "Revenue per AdUnit_2025-01-01.csv"),
+		filepath.Join(tmpDir, "Revenue per AdUnit_2025-01-02.csv"),
+	}, result.Files)
+	assert.Equal(t, 2, result.RowsMerged)
+
+	t.Run("invalid regex", func(t *testing.T) {
+		invalid := group
+		invalid.Match = &config.Match{Regex: "(unclosed"}
+		result := NewProcessor(fileOps, WithDryRun()).ProcessGroup(invalid)
+		assert.ErrorContains(t, result.Error, "invalid match regex")
+	})
+
+	t.Run("no prefix or match", func(t *testing.T) {
+		result := NewProcessor(fileOps, WithDryRun()).ProcessGroup(config.Group{Output: "all.csv"})
+		assert.ErrorContains(t, result.Error, "no prefix or match pattern")
+	})
+}
+
+func TestProcessGroupSources(t *testing.T) {
+	// Create temporary directory
+	tmpDir, err := os.MkdirTemp("", "processor_sources_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	downloads := filepath.Join(tmpDir, "downloads")
+	mail := filepath.Join(tmpDir, "mail", "2025-01")
+	require.NoError(t, os.MkdirAll(downloads, 0755))
+	require.NoError(t, os.MkdirAll(mail, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(downloads, "Report_2025-01-02.csv"), []byte("Date,Value\n2025-01-02,200\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(mail, "Report_2025-01-01.csv"), []byte("Date,Value\n2025-01-01,100\n"), 0644))
+
+	fileOps, err := filesystem.NewFileOperations(downloads)
+	require.NoError(t, err)
+
+	group := config.Group{
+		Prefix:   "Report",
+		Output:   filepath.Join(tmpDir, "reports", "report.csv"),
+		Disposal: "archive",
+		Sources: []config.SourceDir{
+			{Dir: downloads, Recursive: true},
+			{Dir: "../mail", Recursive: true},
+		},
+	}
+	require.NoError(t, os.MkdirAll(filepath.Dir(group.Output), 0755))
+
+	result := NewProcessor(fileOps).ProcessGroup(group)
+	require.NoError(t, result.Error)
+	assert.Equal(t, []string{"2025-01-01", "2025-01-02"}, result.DatesFound)
+	output, err := os.ReadFile(group.Output)
+	require.NoError(t, err)
+	assert.Equal(t, "Date,Value\n2025-01-01,100\n2025-01-02,200\n", string(output))
+
+	t.Run("archived files are not found again", func(t *testing.T) {
+		result := NewProcessor(fileOps).ProcessGroup(group)
+		assert.ErrorContains(t, result.Error, "no files found")
+	})
+
+	t.Run("invalid depth", func(t *testing.T) {
+		invalid := group
+		invalid.Sources = []config.SourceDir{{Dir: downloads, MaxDepth: -1}}
+		result := NewProcessor(fileOps).ProcessGroup(invalid)
+		assert.ErrorContains(t, result.Error, "max_depth")
+	})
+}
+
+func TestProcessorsConcurrently(t *testing.T) {
+	// Create temporary directory
+	tmpDir, err := os.MkdirTemp("", "processor_concurrent_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	const n = 4
+	results := make([]*ProcessingResult, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		workDir := filepath.Join(tmpDir, fmt.Sprintf("work%d", i))
+		require.NoError(t, os.Mkdir(workDir, 0755))
+		for day := 1; day <= 3; day++ {
+			content := fmt.Sprintf("Date,Value\n2025-01-0%d,%d\n", day, i)
+			require.NoError(t, os.WriteFile(filepath.Join(workDir, fmt.Sprintf("AdManager Reporting_2025-01-0%d.csv", day)), []byte(content), 0644))
+		}
+		fileOps, err := filesystem.NewFileOperations(workDir)
+		require.NoError(t, err)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = NewProcessor(fileOps).ProcessGroup(config.Group{Prefix: "AdManager Reporting", Output: "out.csv"})
+		}()
+	}
+	wg.Wait()
+
+	for i, result := range results {
+		require.NoError(t, result.Error)
+		assert.Equal(t, filepath.Join(tmpDir, fmt.Sprintf("work%d", i), "out.csv"), result.OutputFile)
+		output, err := os.ReadFile(result.OutputFile)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("Date,Value\n2025-01-01,%d\n2025-01-02,%d\n2025-01-03,%d\n", i, i, i), string(output))
+	}
+
+	after, err := os.Getwd()
+	require.NoError(t, err)
+	assert.Equal(t, cwd, after, "Processing must not change the working directory")
+}
+
+func TestProcessGroupInMemory(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	workDir := "/reports"
+	require.NoError(t, fsys.MkdirAll(workDir, 0755))
+	for day := 1; day <= 3; day++ {
+		content := fmt.Sprintf("Date,Value\n2025-01-0%d,%d\n", day, day*100)
+		require.NoError(t, vfs.WriteFile(fsys, filepath.Join(workDir, fmt.Sprintf("AdManager Reporting_2025-01-0%d.csv", day)), []byte(content), 0644))
+	}
+	fileOps, err := filesystem.NewFileOperations(workDir)
+	require.NoError(t, err)
+
+	processor := NewProcessor(fileOps, WithFS(fsys))
+	result := processor.ProcessGroup(config.Group{Prefix: "AdManager Reporting", Output: "out.csv", Disposal: "archive"})
+	require.NoError(t, result.Error)
+	assert.Equal(t, 3, result.FilesMerged)
+
+	output, err := fs.ReadFile(fsys, filepath.Join(workDir, "out.csv"))
+	require.NoError(t, err)
+	assert.Equal(t, "Date,Value\n2025-01-01,100\n2025-01-02,200\n2025-01-03,300\n", string(output))
+
+	archived, err := fsys.ReadDir(filepath.Join(workDir, "archive", time.Now().Format("2006-01")))
+	require.NoError(t, err)
+	assert.Len(t, archived, 3)
+
+	history, err := processor.History(result.Group, "")
+	require.NoError(t, err)
+	assert.Len(t, history, 3)
+
+	_, err = os.Stat(workDir)
+	assert.ErrorIs(t, err, os.ErrNotExist, "Nothing should be written to disk")
+}
+
+func TestProcessGroupOverlay(t *testing.T) {
+	source := filepath.Join("..", "..", "testdata", "source")
+	before, err := os.ReadDir(source)
+	require.NoError(t, err)
+
+	workDir := "/reports"
+	fsys := vfs.NewOverlay(workDir, os.DirFS(source), vfs.NewMemFS())
+	fileOps, err := filesystem.NewFileOperations(workDir)
+	require.NoError(t, err)
+
+	result := NewProcessor(fileOps, WithFS(fsys)).ProcessGroup(config.Group{Prefix: "Revenue per AdUnit", Output: "raw-revenue.csv"})
+	require.NoError(t, result.Error)
+	assert.Equal(t, 3, result.FilesMerged)
+
+	output, err := fs.ReadFile(fsys, result.OutputFile)
+	require.NoError(t, err)
+	expected, err := os.ReadFile(filepath.Join("..", "..", "testdata", "expected", "raw-revenue.csv"))
+	require.NoError(t, err)
+	assert.Equal(t, strings.TrimSpace(string(expected)), strings.TrimSpace(string(output)))
+
+	files, err := fileOps.WithFS(fsys).FindFiles(filesystem.Search{Match: filesystem.Matcher{Prefix: "Revenue per AdUnit"}})
+	require.NoError(t, err)
+	assert.Empty(t, files, "Merged files should be gone from the overlay")
+
+	after, err := os.ReadDir(source)
+	require.NoError(t, err)
+	assert.Equal(t, len(before), len(after), "The source dir must not be changed")
+}
+
+func TestProcessGroupDelimiters(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	workDir := "/reports"
+	require.NoError(t, fsys.MkdirAll(workDir, 0755))
+	require.NoError(t, vfs.WriteFile(fsys, filepath.Join(workDir, "AdManager Reporting_1.csv"), []byte("Date;Revenue\n2025-01-01;1,5\n"), 0644))
+	require.NoError(t, vfs.WriteFile(fsys, filepath.Join(workDir, "AdManager Reporting_2.tsv"), []byte("Date\tRevenue\n2025-01-02\t2,25\n"), 0644))
+	fileOps, err := filesystem.NewFileOperations(workDir)
+	require.NoError(t, err)
+
+	processor := NewProcessor(fileOps, WithFS(fsys))
+	result := processor.ProcessGroup(config.Group{Prefix: "AdManager Reporting", Output: "out.csv", InputDelimiter: "auto", OutputDelimiter: "tab", Disposal: "keep"})
+	require.NoError(t, result.Error)
+	require.Len(t, result.Warnings, 1)
+	assert.Contains(t, result.Warnings[0], `AdManager Reporting_2.tsv looks like delimiter '\t'`)
+
+	output, err := fs.ReadFile(fsys, filepath.Join(workDir, "out.csv"))
+	require.NoError(t, err)
+	assert.Equal(t, "Date\tRevenue\n2025-01-01\t1,5\n2025-01-02\t2,25\n", string(output))
+
+	result = processor.ProcessGroup(config.Group{Prefix: "AdManager Reporting", Output: "out.csv", InputDelimiter: "auto", OutputDelimiter: `"`})
+	assert.ErrorContains(t, result.Error, "invalid delimiter")
+}
+
+func TestProcessGroupPreamble(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	workDir := "/reports"
+	require.NoError(t, fsys.MkdirAll(workDir, 0755))
+	export := "Report name,Revenue per day\nNetwork,12345\n\nDate,Value\n2025-01-01,100\nTotal,100\n"
+	require.NoError(t, vfs.WriteFile(fsys, filepath.Join(workDir, "AdManager Reporting_1.csv"), []byte(export), 0644))
+	fileOps, err := filesystem.NewFileOperations(workDir)
+	require.NoError(t, err)
+
+	processor := NewProcessor(fileOps, WithFS(fsys), WithDryRun())
+	group := config.Group{Prefix: "AdManager Reporting", Output: "out.csv", HeaderPattern: "^Date,", FooterPattern: "^Total,"}
+	result := processor.ProcessGroup(group)
+	require.NoError(t, result.Error)
+	assert.Equal(t, 1, result.RowsMerged)
+	assert.Equal(t, []merger.Skipped{{File: filepath.Join(workDir, "AdManager Reporting_1.csv"), Preamble: 2, Footer: 1}}, result.SkippedLines)
+
+	group.FooterPattern = "(Total"
+	result = processor.ProcessGroup(group)
+	assert.ErrorContains(t, result.Error, "invalid footer_pattern")
+
+	// A German export whose comma separated preamble must not be sniffed
+	export = "Bericht,Umsatz pro Tag\nNetzwerk,12345\n\nDate;Umsatz\n2025-01-01;1,5\n2025-01-02;2,25\n"
+	require.NoError(t, vfs.WriteFile(fsys, filepath.Join(workDir, "AdManager Reporting_1.csv"), []byte(export), 0644))
+	result = processor.ProcessGroup(config.Group{Prefix: "AdManager Reporting", Output: "out.csv", InputDelimiter: "auto", HeaderPattern: "^Date"})
+	require.NoError(t, result.Error)
+	assert.Equal(t, 2, result.RowsMerged)
+	assert.Empty(t, result.Warnings)
+}
+
+func TestProcessGroupColumnTypes(t *testing.T) {
+	fsys := vfs.NewMemFS()
+	workDir := "/reports"
+	require.NoError(t, fsys.MkdirAll(workDir, 0755))
+	require.NoError(t, vfs.WriteFile(fsys, filepath.Join(workDir, "AdManager Reporting_1.csv"), []byte("Date;Revenue\n2025-01-01;1.234,50 €\n"), 0644))
+	fileOps, err := filesystem.NewFileOperations(workDir)
+	require.NoError(t, err)
+
+	processor := NewProcessor(fileOps, WithFS(fsys))
+	group := config.Group{Prefix: "AdManager Reporting", Output: "out.csv", Delimiter: ";", ColumnTypes: map[string]string{"Revenue": "currency"}, NumberLocale: "de-DE", Disposal: "keep"}
+	result := processor.ProcessGroup(group)
+	require.NoError(t, result.Error)
+	output, err := fs.ReadFile(fsys, filepath.Join(workDir, "out.csv"))
+	require.NoError(t, err)
+	assert.Equal(t, "Date;Revenue\n2025-01-01;1234.50\n", string(output))
+
+	group.ColumnTypes = map[string]string{"Revenue": "money"}
+	result = processor.ProcessGroup(group)
+	assert.ErrorContains(t, result.Error, `column "Revenue": unknown column type "money"`)
+
+	group.ColumnTypes, group.NumberLocale = nil, "klingon"
+	result = processor.ProcessGroup(group)
+	assert.ErrorContains(t, result.Error, "unknown locale")
+}
+
+func TestProcessGroupSkipsOutputs(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "processor_outputs_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "report_1.csv"), []byte("Date,Value\n2025-01-01,100\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "other.csv"), []byte("Date,Value\n2024-12-31,1\n"), 0644))
+	fileOps, err := filesystem.NewFileOperations(tmpDir)
+	require.NoError(t, err)
+
+	groups := []config.Group{
+		{Match: &config.Match{Glob: "*.csv"}, Output: "raw.csv", Disposal: "keep"},
+		{Prefix: "nothing", Output: "other.csv"},
+	}
+	processor := NewProcessor(fileOps, WithOutputs("other.csv"))
+	for run := 1; run <= 2; run++ {
+		result := processor.ProcessGroup(groups[0])
+		require.NoError(t, result.Error, "run %d", run)
+		assert.Equal(t, []string{filepath.Join(tmpDir, "report_1.csv")}, result.Files, "run %d", run)
+	}
+	output, err := os.ReadFile(filepath.Join(tmpDir, "raw.csv"))
+	require.NoError(t, err)
+	assert.Equal(t, "Date,Value\n2025-01-01,100\n", string(output), "The output is never merged into itself")
+
+	results := NewProcessor(fileOps, WithDryRun()).ProcessAllGroups(groups)
+	require.NoError(t, results[0].Error)
+	assert.Equal(t, []string{filepath.Join(tmpDir, "report_1.csv")}, results[0].Files, "Outputs of other groups are no sources")
+}
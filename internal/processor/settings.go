@@ -0,0 +1,207 @@
+package processor
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/spossner/ad-reporting-merger/internal/config"
+	"github.com/spossner/ad-reporting-merger/internal/decode"
+	"github.com/spossner/ad-reporting-merger/internal/filesystem"
+	"github.com/spossner/ad-reporting-merger/internal/merger"
+)
+
+// Mode decides whether a group replaces its output or appends to it.
+type Mode string
+
+const (
+	ModeReplace Mode = "replace"
+	ModeAppend  Mode = "append"
+)
+
+// ParseMode validates a mode; the empty string means replace.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case "":
+		return ModeReplace, nil
+	case ModeReplace, ModeAppend:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown mode %q", s)
+}
+
+// Duplicates decides what happens when source files have identical content.
+type Duplicates string
+
+const (
+	DuplicatesAbort      Duplicates = "abort"       // fail the group
+	DuplicatesKeepOldest Duplicates = "keep-oldest" // merge the oldest copy, dispose of the others with it
+	DuplicatesKeepNewest Duplicates = "keep-newest" // merge the newest copy, dispose of the others with it
+	DuplicatesMoveAside  Duplicates = "move-aside"  // merge the oldest copy, move the others to the duplicates dir
+)
+
+// ParseDuplicates validates a duplicates policy; the empty string means abort.
+func ParseDuplicates(s string) (Duplicates, error) {
+	switch d := Duplicates(s); d {
+	case "":
+		return DuplicatesAbort, nil
+	case DuplicatesAbort, DuplicatesKeepOldest, DuplicatesKeepNewest, DuplicatesMoveAside:
+		return d, nil
+	}
+	return "", fmt.Errorf("unknown duplicates policy %q", s)
+}
+
+// settings are the validated options of a group.
+type settings struct {
+	disposal   filesystem.Disposal
+	mode       Mode
+	duplicates Duplicates
+	search     filesystem.Search
+	output     string // the group's output resolved against the work dir
+	merge      merger.Options
+}
+
+func parseSettings(group config.Group) (*settings, error) {
+	var s settings
+	var err error
+	if s.disposal, err = filesystem.ParseDisposal(group.Disposal); err != nil {
+		return nil, err
+	}
+	if s.mode, err = ParseMode(group.Mode); err != nil {
+		return nil, err
+	}
+	if s.duplicates, err = ParseDuplicates(group.Duplicates); err != nil {
+		return nil, err
+	}
+	if s.search, err = parseSearch(group); err != nil {
+		return nil, err
+	}
+	if s.merge.Header, err = merger.ParseHeaderPolicy(group.Header); err != nil {
+		return nil, err
+	}
+	if s.merge.Overlap, err = merger.ParseOverlap(group.Overlap); err != nil {
+		return nil, err
+	}
+	if s.merge.Restatement, err = merger.ParseRestatement(group.Restatement); err != nil {
+		return nil, err
+	}
+	if s.merge.Columns, err = merger.ParseColumnMode(group.Columns); err != nil {
+		return nil, err
+	}
+	s.merge.ColumnOrder = group.ColumnOrder
+	s.merge.Fill = group.Fill
+	if err = parseDelimiters(group, &s.merge); err != nil {
+		return nil, err
+	}
+	for column, name := range group.ColumnTypes {
+		t, err := merger.ParseColumnType(name)
+		if err != nil {
+			return nil, fmt.Errorf("column %q: %w", column, err)
+		}
+		if s.merge.ColumnTypes == nil {
+			s.merge.ColumnTypes = make(map[string]merger.ColumnType)
+		}
+		s.merge.ColumnTypes[column] = t
+	}
+	if s.merge.Locale, err = merger.ParseLocale(group.NumberLocale); err != nil {
+		return nil, err
+	}
+	if group.HeaderPattern != "" {
+		if s.merge.HeaderPattern, err = regexp.Compile(group.HeaderPattern); err != nil {
+			return nil, fmt.Errorf("invalid header_pattern: %w", err)
+		}
+	}
+	if group.FooterPattern != "" {
+		if s.merge.FooterPattern, err = regexp.Compile(group.FooterPattern); err != nil {
+			return nil, fmt.Errorf("invalid footer_pattern: %w", err)
+		}
+	}
+	if s.merge.Fallback, err = decode.ParseFallback(group.FallbackEncoding); err != nil {
+		return nil, err
+	}
+	if s.merge.Encoding, err = decode.ParseEncoding(group.OutputEncoding); err != nil {
+		return nil, err
+	}
+	s.merge.DateColumn = group.DateColumn
+	s.merge.DateLayouts = group.DateLayouts
+	s.merge.NameDate = s.search.Match.Regex
+	s.merge.SortKeys = group.SortKeys
+	s.merge.DedupeKeys = group.DedupeKeys
+	if s.merge.Dedupe, err = merger.ParseDedupe(group.Dedupe); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// autoDelimiter sniffs the delimiter of every input.
+const autoDelimiter = "auto"
+
+// parseDelimiters sets the delimiters of the inputs and the output, which
+// share the group's delimiter unless configured apart.
+func parseDelimiters(group config.Group, opts *merger.Options) error {
+	input := cmp.Or(group.InputDelimiter, group.Delimiter)
+	output := cmp.Or(group.OutputDelimiter, group.Delimiter)
+	if input == autoDelimiter {
+		opts.SniffDelimiter, input = true, ""
+	}
+	if output == autoDelimiter {
+		output = ""
+	}
+	var err error
+	if opts.Delimiter, err = merger.ParseDelimiter(input); err != nil {
+		return err
+	}
+	if opts.OutputDelimiter, err = merger.ParseDelimiter(output); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseSearch describes where the group's source files are found. The archive
+// and duplicates dirs are never searched, so that recursive searches do not
+// pick up files disposed of before.
+func parseSearch(group config.Group) (filesystem.Search, error) {
+	var search filesystem.Search
+	var err error
+	if search.Match, err = parseMatch(group); err != nil {
+		return search, err
+	}
+	if group.StableFor != "" {
+		if search.StableFor, err = time.ParseDuration(group.StableFor); err != nil || search.StableFor < 0 {
+			return search, fmt.Errorf("invalid stable_for %q", group.StableFor)
+		}
+	}
+	for _, dir := range group.Sources {
+		if dir.MaxDepth < 0 {
+			return search, fmt.Errorf("invalid max_depth %d of source %s", dir.MaxDepth, dir.Dir)
+		}
+		search.Dirs = append(search.Dirs, filesystem.SourceDir{Dir: dir.Dir, Recursive: dir.Recursive, MaxDepth: dir.MaxDepth})
+	}
+	search.Skip = []string{
+		cmp.Or(group.ArchiveDir, filesystem.DefaultArchiveDir),
+		cmp.Or(group.DuplicatesDir, filesystem.DefaultDuplicatesDir),
+	}
+	return search, nil
+}
+
+// parseMatch builds the matcher of the group's source files from its prefix
+// and match block.
+func parseMatch(group config.Group) (filesystem.Matcher, error) {
+	m := filesystem.Matcher{Prefix: group.Prefix}
+	if group.Match != nil {
+		m.Glob = group.Match.Glob
+		m.Extensions = group.Match.Extensions
+		m.Exclude = group.Match.Exclude
+		if group.Match.Regex != "" {
+			var err error
+			if m.Regex, err = regexp.Compile(group.Match.Regex); err != nil {
+				return m, fmt.Errorf("invalid match regex: %w", err)
+			}
+		}
+	}
+	if err := m.Validate(); err != nil {
+		return m, fmt.Errorf("invalid match: %w", err)
+	}
+	return m, nil
+}
@@ -0,0 +1,340 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MemFS is a file system held in memory. Relative paths are resolved against
+// the root. It starts out with an empty temp dir, like a fresh machine.
+type MemFS struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	dir     bool
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	m := &MemFS{nodes: map[string]*memNode{
+		string(filepath.Separator): {dir: true, mode: fs.ModeDir | 0755, modTime: time.Now()},
+	}}
+	m.MkdirAll(os.TempDir(), 0755)
+	return m
+}
+
+func memPath(name string) string {
+	return filepath.Join(string(filepath.Separator), name)
+}
+
+func (n *memNode) info(name string) fs.FileInfo {
+	return &memInfo{name: filepath.Base(name), size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+// lookup returns the node at path; m.mu must be held.
+func (m *MemFS) lookup(op, path string) (*memNode, error) {
+	n, ok := m.nodes[path]
+	if !ok {
+		return nil, pathError(op, path, fs.ErrNotExist)
+	}
+	return n, nil
+}
+
+// parent checks that the parent of path is a directory; m.mu must be held.
+func (m *MemFS) parent(op, path string) error {
+	n, ok := m.nodes[filepath.Dir(path)]
+	if !ok {
+		return pathError(op, path, fs.ErrNotExist)
+	}
+	if !n.dir {
+		return pathError(op, path, syscall.ENOTDIR)
+	}
+	return nil
+}
+
+// children returns the entries of the directory at path sorted by name; m.mu
+// must be held.
+func (m *MemFS) children(path string) []fs.DirEntry {
+	var entries []fs.DirEntry
+	for name, n := range m.nodes {
+		if name != path && filepath.Dir(name) == path {
+			entries = append(entries, fs.FileInfoToDirEntry(n.info(name)))
+		}
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries
+}
+
+func (m *MemFS) Open(name string) (fs.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path := memPath(name)
+	n, err := m.lookup("open", path)
+	if err != nil {
+		return nil, err
+	}
+	if n.dir {
+		return &dirFile{info: n.info(path), entries: m.children(path)}, nil
+	}
+	return &memReader{Reader: bytes.NewReader(slices.Clone(n.data)), info: n.info(path)}, nil
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path := memPath(name)
+	n, err := m.lookup("stat", path)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(path), nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path := memPath(name)
+	n, err := m.lookup("readdir", path)
+	if err != nil {
+		return nil, err
+	}
+	if !n.dir {
+		return nil, pathError("readdir", path, syscall.ENOTDIR)
+	}
+	return m.children(path), nil
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path := memPath(name)
+	n, ok := m.nodes[path]
+	switch {
+	case ok && n.dir:
+		return nil, pathError("open", path, syscall.EISDIR)
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, pathError("open", path, fs.ErrExist)
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, pathError("open", path, fs.ErrNotExist)
+	case !ok:
+		if err := m.parent("open", path); err != nil {
+			return nil, err
+		}
+		n = &memNode{mode: perm &^ fs.ModeType, modTime: time.Now()}
+		m.nodes[path] = n
+	case flag&os.O_TRUNC != 0:
+		n.data, n.modTime = nil, time.Now()
+	}
+	w := &memWriter{fs: m, node: n, name: name}
+	if flag&os.O_APPEND != 0 {
+		w.offset = len(n.data)
+	}
+	return w, nil
+}
+
+func (m *MemFS) Mkdir(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path := memPath(name)
+	if _, ok := m.nodes[path]; ok {
+		return pathError("mkdir", path, fs.ErrExist)
+	}
+	if err := m.parent("mkdir", path); err != nil {
+		return err
+	}
+	m.nodes[path] = &memNode{dir: true, mode: fs.ModeDir | perm&fs.ModePerm, modTime: time.Now()}
+	return nil
+}
+
+func (m *MemFS) MkdirAll(path string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mkdirAll(memPath(path), perm)
+}
+
+func (m *MemFS) mkdirAll(path string, perm fs.FileMode) error {
+	if n, ok := m.nodes[path]; ok {
+		if !n.dir {
+			return pathError("mkdir", path, syscall.ENOTDIR)
+		}
+		return nil
+	}
+	if err := m.mkdirAll(filepath.Dir(path), perm); err != nil {
+		return err
+	}
+	m.nodes[path] = &memNode{dir: true, mode: fs.ModeDir | perm&fs.ModePerm, modTime: time.Now()}
+	return nil
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	from, to := memPath(oldpath), memPath(newpath)
+	n, err := m.lookup("rename", from)
+	if err != nil {
+		return err
+	}
+	if err := m.parent("rename", to); err != nil {
+		return err
+	}
+	if existing, ok := m.nodes[to]; ok && existing.dir {
+		return pathError("rename", to, fs.ErrExist)
+	}
+	if from == to {
+		return nil
+	}
+	if n.dir {
+		for name, child := range m.nodes {
+			if rel, ok := strings.CutPrefix(name, from+string(filepath.Separator)); ok {
+				delete(m.nodes, name)
+				m.nodes[filepath.Join(to, rel)] = child
+			}
+		}
+	}
+	delete(m.nodes, from)
+	m.nodes[to] = n
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path := memPath(name)
+	n, err := m.lookup("remove", path)
+	if err != nil {
+		return err
+	}
+	if n.dir && len(m.children(path)) > 0 {
+		return pathError("remove", path, syscall.ENOTEMPTY)
+	}
+	delete(m.nodes, path)
+	return nil
+}
+
+func (m *MemFS) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path = memPath(path)
+	for name := range m.nodes {
+		if name == path || strings.HasPrefix(name, path+string(filepath.Separator)) {
+			delete(m.nodes, name)
+		}
+	}
+	return nil
+}
+
+// Chtimes sets the modification time of the named file.
+func (m *MemFS) Chtimes(name string, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path := memPath(name)
+	n, err := m.lookup("chtimes", path)
+	if err != nil {
+		return err
+	}
+	n.modTime = mtime
+	return nil
+}
+
+// memWriter writes to a file of a MemFS. Writes are visible immediately.
+type memWriter struct {
+	fs     *MemFS
+	node   *memNode
+	name   string
+	offset int
+	closed bool
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, pathError("write", w.name, fs.ErrClosed)
+	}
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+	n := w.node
+	if end := w.offset + len(p); end > len(n.data) {
+		n.data = append(n.data, make([]byte, end-len(n.data))...)
+	}
+	copy(n.data[w.offset:], p)
+	w.offset += len(p)
+	n.modTime = time.Now()
+	return len(p), nil
+}
+
+func (w *memWriter) Close() error {
+	if w.closed {
+		return pathError("close", w.name, fs.ErrClosed)
+	}
+	w.closed = true
+	return nil
+}
+
+func (w *memWriter) Name() string { return w.name }
+
+func (w *memWriter) Sync() error { return nil }
+
+type memReader struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (r *memReader) Stat() (fs.FileInfo, error) { return r.info, nil }
+
+func (r *memReader) Close() error { return nil }
+
+// dirFile is an open directory listing a snapshot of its entries.
+type dirFile struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, pathError("read", d.info.Name(), syscall.EISDIR)
+}
+
+func (d *dirFile) Close() error { return nil }
+
+func (d *dirFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+type memInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) Mode() fs.FileMode  { return i.mode }
+func (i *memInfo) ModTime() time.Time { return i.modTime }
+func (i *memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memInfo) Sys() any           { return nil }
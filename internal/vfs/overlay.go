@@ -0,0 +1,283 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Overlay mounts a read-only base file system at root and sends all writes
+// to upper, so a run can work on real reports without changing them. Files
+// removed from the base are hidden by whiteouts.
+type Overlay struct {
+	root  string
+	base  fs.FS
+	upper FS
+
+	mu      sync.Mutex
+	removed map[string]bool
+}
+
+func NewOverlay(root string, base fs.FS, upper FS) *Overlay {
+	return &Overlay{root: memPath(root), base: base, upper: upper, removed: make(map[string]bool)}
+}
+
+// baseName returns the name of path in the base, unless path is outside root
+// or it or one of its parents has been removed.
+func (o *Overlay) baseName(path string) (string, bool) {
+	rel, err := filepath.Rel(o.root, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for p := path; ; p = filepath.Dir(p) {
+		if o.removed[p] {
+			return "", false
+		}
+		if p == o.root {
+			break
+		}
+	}
+	return filepath.ToSlash(rel), true
+}
+
+func (o *Overlay) whiteout(path string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.removed[path] = true
+}
+
+// baseStat returns the info of path in the base.
+func (o *Overlay) baseStat(path string) (fs.FileInfo, bool) {
+	name, ok := o.baseName(path)
+	if !ok {
+		return nil, false
+	}
+	info, err := fs.Stat(o.base, name)
+	return info, err == nil
+}
+
+func (o *Overlay) Open(name string) (fs.File, error) {
+	path := memPath(name)
+	info, err := o.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		entries, err := o.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		return &dirFile{info: info, entries: entries}, nil
+	}
+	if _, err := o.upper.Stat(path); err == nil {
+		return o.upper.Open(path)
+	}
+	baseName, _ := o.baseName(path)
+	return o.base.Open(baseName)
+}
+
+func (o *Overlay) Stat(name string) (fs.FileInfo, error) {
+	path := memPath(name)
+	info, err := o.upper.Stat(path)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return info, err
+	}
+	if info, ok := o.baseStat(path); ok {
+		return info, nil
+	}
+	return nil, pathError("stat", path, fs.ErrNotExist)
+}
+
+func (o *Overlay) ReadDir(name string) ([]fs.DirEntry, error) {
+	path := memPath(name)
+	info, err := o.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, pathError("readdir", path, syscall.ENOTDIR)
+	}
+
+	seen := make(map[string]bool)
+	var entries []fs.DirEntry
+	if upper, err := o.upper.ReadDir(path); err == nil {
+		for _, entry := range upper {
+			seen[entry.Name()] = true
+			entries = append(entries, entry)
+		}
+	}
+	if baseName, ok := o.baseName(path); ok {
+		base, _ := fs.ReadDir(o.base, baseName)
+		for _, entry := range base {
+			if seen[entry.Name()] {
+				continue
+			}
+			if _, ok := o.baseName(filepath.Join(path, entry.Name())); ok {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+	return entries, nil
+}
+
+// prepare makes the parent of path in upper, which must exist in the overlay.
+func (o *Overlay) prepare(op, path string) error {
+	parent, err := o.Stat(filepath.Dir(path))
+	if err != nil {
+		return pathError(op, path, fs.ErrNotExist)
+	}
+	if !parent.IsDir() {
+		return pathError(op, path, syscall.ENOTDIR)
+	}
+	return o.upper.MkdirAll(filepath.Dir(path), 0755)
+}
+
+// copyUp copies a file of the base to upper at dst.
+func (o *Overlay) copyUp(path, dst string, perm fs.FileMode) error {
+	baseName, _ := o.baseName(path)
+	src, err := o.base.Open(baseName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	f, err := o.upper.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, src)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (o *Overlay) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	path := memPath(name)
+	if _, err := o.upper.Stat(path); err == nil {
+		return o.upper.OpenFile(path, flag, perm)
+	}
+
+	info, inBase := o.baseStat(path)
+	switch {
+	case inBase && info.IsDir():
+		return nil, pathError("open", path, syscall.EISDIR)
+	case inBase && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, pathError("open", path, fs.ErrExist)
+	case !inBase && flag&os.O_CREATE == 0:
+		return nil, pathError("open", path, fs.ErrNotExist)
+	}
+	if err := o.prepare("open", path); err != nil {
+		return nil, err
+	}
+	if inBase && flag&os.O_TRUNC == 0 {
+		if err := o.copyUp(path, path, info.Mode().Perm()); err != nil {
+			return nil, err
+		}
+	}
+	return o.upper.OpenFile(path, flag, perm)
+}
+
+func (o *Overlay) Mkdir(name string, perm fs.FileMode) error {
+	path := memPath(name)
+	if _, err := o.Stat(path); err == nil {
+		return pathError("mkdir", path, fs.ErrExist)
+	}
+	if err := o.prepare("mkdir", path); err != nil {
+		return err
+	}
+	return o.upper.Mkdir(path, perm)
+}
+
+func (o *Overlay) MkdirAll(path string, perm fs.FileMode) error {
+	path = memPath(path)
+	if info, err := o.Stat(path); err == nil {
+		if !info.IsDir() {
+			return pathError("mkdir", path, syscall.ENOTDIR)
+		}
+		return o.upper.MkdirAll(path, perm)
+	}
+	if err := o.MkdirAll(filepath.Dir(path), perm); err != nil {
+		return err
+	}
+	return o.upper.Mkdir(path, perm)
+}
+
+// Rename moves files within upper and copies files of the base up to the
+// new path. Directories of the base cannot be renamed.
+func (o *Overlay) Rename(oldpath, newpath string) error {
+	from, to := memPath(oldpath), memPath(newpath)
+	info, err := o.Stat(from)
+	if err != nil {
+		return err
+	}
+	_, inBase := o.baseStat(from)
+	if inBase && info.IsDir() {
+		return pathError("rename", from, errors.ErrUnsupported)
+	}
+	if target, err := o.Stat(to); err == nil && target.IsDir() {
+		return pathError("rename", to, fs.ErrExist)
+	}
+	if from == to {
+		return nil
+	}
+	if err := o.prepare("rename", to); err != nil {
+		return err
+	}
+	if _, err := o.upper.Stat(from); err == nil {
+		err = o.upper.Rename(from, to)
+		if err != nil {
+			return err
+		}
+	} else if err := o.copyUp(from, to, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if inBase {
+		o.whiteout(from)
+	}
+	return nil
+}
+
+func (o *Overlay) Remove(name string) error {
+	path := memPath(name)
+	info, err := o.Stat(path)
+	if err != nil {
+		return pathError("remove", path, fs.ErrNotExist)
+	}
+	if info.IsDir() {
+		if entries, _ := o.ReadDir(path); len(entries) > 0 {
+			return pathError("remove", path, syscall.ENOTEMPTY)
+		}
+	}
+	if _, err := o.upper.Stat(path); err == nil {
+		if err := o.upper.Remove(path); err != nil {
+			return err
+		}
+	}
+	if _, ok := o.baseStat(path); ok {
+		o.whiteout(path)
+	}
+	return nil
+}
+
+func (o *Overlay) RemoveAll(path string) error {
+	path = memPath(path)
+	if err := o.upper.RemoveAll(path); err != nil {
+		return err
+	}
+	if _, ok := o.baseStat(path); ok {
+		o.whiteout(path)
+	}
+	return nil
+}
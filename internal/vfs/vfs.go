@@ -0,0 +1,197 @@
+// Package vfs is the writable file system the pipeline works on. It builds on
+// io/fs, but is addressed by OS paths rather than slash-separated names, so
+// the same absolute paths work on the OS, in memory and in an overlay.
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// FS is a file system that can be read through io/fs and written to.
+type FS interface {
+	fs.StatFS
+	fs.ReadDirFS
+	// OpenFile opens a file for writing with the os.O_* flags.
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	Mkdir(name string, perm fs.FileMode) error
+	MkdirAll(path string, perm fs.FileMode) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	RemoveAll(path string) error
+}
+
+// File is a file opened for writing.
+type File interface {
+	io.WriteCloser
+	Name() string
+	Sync() error
+}
+
+// Linker is implemented by file systems that support hard links.
+type Linker interface {
+	Link(oldname, newname string) error
+}
+
+// OS is the file system of the operating system.
+type OS struct{}
+
+func (OS) Open(name string) (fs.File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OS) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+
+func (OS) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+
+func (OS) ReadFile(name string) ([]byte, error) { return os.ReadFile(name) }
+
+func (OS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (OS) Mkdir(name string, perm fs.FileMode) error { return os.Mkdir(name, perm) }
+
+func (OS) MkdirAll(path string, perm fs.FileMode) error { return os.MkdirAll(path, perm) }
+
+func (OS) Rename(oldpath, newpath string) error { return os.Rename(oldpath, newpath) }
+
+func (OS) Remove(name string) error { return os.Remove(name) }
+
+func (OS) RemoveAll(path string) error { return os.RemoveAll(path) }
+
+func (OS) Link(oldname, newname string) error { return os.Link(oldname, newname) }
+
+// Create creates or truncates the named file.
+func Create(fsys FS, name string) (File, error) {
+	return fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// WriteFile writes data to the named file, replacing it.
+func WriteFile(fsys FS, name string, data []byte, perm fs.FileMode) error {
+	f, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// CreateTemp creates a new file in dir like os.CreateTemp: the last "*" in
+// pattern is replaced by a random string.
+func CreateTemp(fsys FS, dir, pattern string) (File, error) {
+	for range 10000 {
+		f, err := fsys.OpenFile(tempName(dir, pattern), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if !errors.Is(err, fs.ErrExist) {
+			return f, err
+		}
+	}
+	return nil, &fs.PathError{Op: "createtemp", Path: filepath.Join(dir, pattern), Err: fs.ErrExist}
+}
+
+// MkdirTemp creates a new directory in dir like os.MkdirTemp and returns its
+// path.
+func MkdirTemp(fsys FS, dir, pattern string) (string, error) {
+	for range 10000 {
+		name := tempName(dir, pattern)
+		err := fsys.Mkdir(name, 0700)
+		if err == nil {
+			return name, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+	}
+	return "", &fs.PathError{Op: "mkdirtemp", Path: filepath.Join(dir, pattern), Err: fs.ErrExist}
+}
+
+func tempName(dir, pattern string) string {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	random := strconv.FormatUint(uint64(rand.Uint32()), 10)
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		return filepath.Join(dir, pattern[:i]+random+pattern[i+1:])
+	}
+	return filepath.Join(dir, pattern+random)
+}
+
+// Move renames src to dst, falling back to copy and remove when they are on
+// different devices.
+func Move(fsys FS, src, dst string) error {
+	err := fsys.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := Copy(fsys, src, dst); err != nil {
+		fsys.Remove(dst)
+		return err
+	}
+	return fsys.Remove(src)
+}
+
+// Copy copies the content of src to dst, replacing dst.
+func Copy(fsys FS, src, dst string) error {
+	source, err := fsys.Open(src)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	dest, err := Create(fsys, dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dest, source)
+	if closeErr := dest.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Link hard links oldname to newname, or copies it if the file system does
+// not support links.
+func Link(fsys FS, oldname, newname string) error {
+	if l, ok := fsys.(Linker); ok {
+		err := l.Link(oldname, newname)
+		if err == nil || errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return Copy(fsys, oldname, newname)
+}
+
+// SyncDir flushes directory entries to disk. Not every platform or file
+// system supports syncing directories, so errors are ignored.
+func SyncDir(fsys FS, dir string) {
+	d, err := fsys.Open(dir)
+	if err != nil {
+		return
+	}
+	if s, ok := d.(interface{ Sync() error }); ok {
+		s.Sync()
+	}
+	d.Close()
+}
+
+func pathError(op, path string, err error) error {
+	return &fs.PathError{Op: op, Path: path, Err: err}
+}
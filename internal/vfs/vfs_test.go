@@ -0,0 +1,143 @@
+package vfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func names(t *testing.T, fsys FS, dir string) []string {
+	entries, err := fsys.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestMemFS(t *testing.T) {
+	fsys := NewMemFS()
+	require.NoError(t, fsys.MkdirAll("/work/archive", 0755))
+	require.NoError(t, WriteFile(fsys, "/work/report.csv", []byte("a,b\n"), 0644))
+
+	data, err := fs.ReadFile(fsys, "/work/report.csv")
+	require.NoError(t, err)
+	assert.Equal(t, "a,b\n", string(data))
+
+	info, err := fsys.Stat("/work/report.csv")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), info.Size())
+	assert.Equal(t, []string{"archive", "report.csv"}, names(t, fsys, "/work"))
+
+	t.Run("append", func(t *testing.T) {
+		f, err := fsys.OpenFile("/work/report.csv", os.O_WRONLY|os.O_APPEND, 0)
+		require.NoError(t, err)
+		_, err = f.Write([]byte("1,2\n"))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		data, err := fs.ReadFile(fsys, "/work/report.csv")
+		require.NoError(t, err)
+		assert.Equal(t, "a,b\n1,2\n", string(data))
+	})
+
+	t.Run("exclusive create", func(t *testing.T) {
+		_, err := fsys.OpenFile("/work/report.csv", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		assert.ErrorIs(t, err, fs.ErrExist)
+		_, err = Create(fsys, "/missing/report.csv")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("rename directory", func(t *testing.T) {
+		require.NoError(t, WriteFile(fsys, "/work/archive/old.csv", []byte("old"), 0644))
+		require.NoError(t, fsys.Rename("/work/archive", "/work/history"))
+		assert.Equal(t, []string{"old.csv"}, names(t, fsys, "/work/history"))
+		_, err := fsys.Stat("/work/archive")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		assert.Error(t, fsys.Remove("/work/history"), "Expected error for non-empty dir")
+		require.NoError(t, fsys.RemoveAll("/work/history"))
+		assert.Equal(t, []string{"report.csv"}, names(t, fsys, "/work"))
+	})
+
+	t.Run("temp files", func(t *testing.T) {
+		f, err := CreateTemp(fsys, "", "merge-*.csv")
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		assert.Equal(t, os.TempDir(), filepath.Dir(f.Name()))
+		assert.NoError(t, Move(fsys, f.Name(), "/work/merged.csv"))
+		assert.NoError(t, Link(fsys, "/work/merged.csv", "/work/linked.csv"))
+		assert.Equal(t, []string{"linked.csv", "merged.csv", "report.csv"}, names(t, fsys, "/work"))
+	})
+}
+
+func TestOverlay(t *testing.T) {
+	base := fstest.MapFS{
+		"report_1.csv":      {Data: []byte("a\n1\n")},
+		"report_2.csv":      {Data: []byte("a\n2\n")},
+		"archive/old_1.csv": {Data: []byte("a\n0\n")},
+	}
+	fsys := NewOverlay("/work", base, NewMemFS())
+
+	assert.Equal(t, []string{"archive", "report_1.csv", "report_2.csv"}, names(t, fsys, "/work"))
+
+	t.Run("writes go to upper", func(t *testing.T) {
+		require.NoError(t, WriteFile(fsys, "/work/merged.csv", []byte("a\n1\n2\n"), 0644))
+		assert.Equal(t, []string{"archive", "merged.csv", "report_1.csv", "report_2.csv"}, names(t, fsys, "/work"))
+		_, err := base.Stat("merged.csv")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	})
+
+	t.Run("append copies up", func(t *testing.T) {
+		f, err := fsys.OpenFile("/work/report_1.csv", os.O_WRONLY|os.O_APPEND, 0)
+		require.NoError(t, err)
+		_, err = f.Write([]byte("3\n"))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		data, err := fs.ReadFile(fsys, "/work/report_1.csv")
+		require.NoError(t, err)
+		assert.Equal(t, "a\n1\n3\n", string(data))
+		assert.Equal(t, "a\n1\n", string(base["report_1.csv"].Data))
+	})
+
+	t.Run("rename hides the base file", func(t *testing.T) {
+		require.NoError(t, Move(fsys, "/work/report_2.csv", "/work/archive/report_2.csv"))
+		_, err := fsys.Stat("/work/report_2.csv")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+		assert.Equal(t, []string{"old_1.csv", "report_2.csv"}, names(t, fsys, "/work/archive"))
+
+		data, err := fs.ReadFile(fsys, "/work/archive/report_2.csv")
+		require.NoError(t, err)
+		assert.Equal(t, "a\n2\n", string(data))
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		require.NoError(t, fsys.Remove("/work/report_1.csv"))
+		_, err := fsys.Stat("/work/report_1.csv")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+
+		require.NoError(t, fsys.RemoveAll("/work/archive"))
+		assert.Equal(t, []string{"merged.csv"}, names(t, fsys, "/work"))
+
+		require.NoError(t, fsys.Mkdir("/work/archive", 0755))
+		assert.Empty(t, names(t, fsys, "/work/archive"))
+	})
+
+	t.Run("base directories", func(t *testing.T) {
+		fsys := NewOverlay("/work", base, NewMemFS())
+		err := fsys.Rename("/work/archive", "/work/history")
+		assert.ErrorIs(t, err, errors.ErrUnsupported)
+		_, err = fsys.OpenFile("/work/report_1.csv", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		assert.ErrorIs(t, err, fs.ErrExist)
+	})
+}